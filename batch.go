@@ -0,0 +1,306 @@
+package minilsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"minilsm/block"
+	"minilsm/config"
+	"minilsm/kv"
+	"minilsm/memtable"
+	"sync/atomic"
+)
+
+type batchOp uint8
+
+const (
+	batchOpPut batchOp = iota
+	batchOpDelete
+	batchOpDeleteRange
+)
+
+// WriteBatch collects writes that StorageInner.Write applies atomically.
+// The writes are applied in the order they were added to the batch.
+//
+// A batch is kept in its serialized form:
+//
+// +-------+-------+-----+-------+
+// | count | op 1  | ... | op n  |
+// +-------+-------+-----+-------+
+// | u32   |       |     |       |
+// +-------+-------+-----+-------+
+//
+// with every op encoded as
+//
+// +------+----------+-------+------------+-------+
+// | type | key size |  key  | value size | value |
+// +------+----------+-------+------------+-------+
+// | u8   | uvarint  | bytes |  uvarint   | bytes |
+// +------+----------+-------+------------+-------+
+//
+// where a delete has an empty value and a range delete stores the end of
+// its range as the value.
+type WriteBatch struct {
+	data []byte
+}
+
+const batchHeaderSize = block.SizeOfUint32
+
+var ErrInvalidBatch = errors.New("invalid write batch")
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{data: make([]byte, batchHeaderSize)}
+}
+
+// DecodeWriteBatch parses a batch serialized by WriteBatch.Bytes.
+func DecodeWriteBatch(data []byte) (*WriteBatch, error) {
+	if len(data) < batchHeaderSize {
+		return nil, fmt.Errorf("decode write batch: %w", ErrInvalidBatch)
+	}
+	b := &WriteBatch{data: bytes.Clone(data)}
+	n := 0
+	err := b.iterate(func(op batchOp, key, value []byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode write batch: %w", err)
+	}
+	if n != b.Count() {
+		return nil, fmt.Errorf("decode write batch: %w", ErrInvalidBatch)
+	}
+	return b, nil
+}
+
+// Put adds a write of value to key.
+func (b *WriteBatch) Put(key, value []byte) {
+	b.add(batchOpPut, key, value)
+}
+
+// Delete adds a delete of key.
+func (b *WriteBatch) Delete(key []byte) {
+	b.add(batchOpDelete, key, nil)
+}
+
+// DeleteRange adds a delete of every key in [start, end).
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.add(batchOpDeleteRange, start, end)
+}
+
+func (b *WriteBatch) add(op batchOp, key, value []byte) {
+	b.data = append(b.data, byte(op))
+	b.data = binary.AppendUvarint(b.data, uint64(len(key)))
+	b.data = append(b.data, key...)
+	b.data = binary.AppendUvarint(b.data, uint64(len(value)))
+	b.data = append(b.data, value...)
+	binary.LittleEndian.PutUint32(b.data, uint32(b.Count()+1))
+}
+
+// Count returns the number of writes in the batch.
+func (b *WriteBatch) Count() int {
+	return int(binary.LittleEndian.Uint32(b.data))
+}
+
+// Bytes returns the serialized batch. It is only valid until the next write
+// to the batch.
+func (b *WriteBatch) Bytes() []byte {
+	return b.data
+}
+
+// Reset empties the batch for reuse.
+func (b *WriteBatch) Reset() {
+	b.data = b.data[:batchHeaderSize]
+	binary.LittleEndian.PutUint32(b.data, 0)
+}
+
+func (b *WriteBatch) iterate(fn func(op batchOp, key, value []byte) error) error {
+	data := b.data[batchHeaderSize:]
+	next := func() ([]byte, bool) {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, false
+		}
+		field := data[n : n+int(size)]
+		data = data[n+int(size):]
+		return field, true
+	}
+	for len(data) > 0 {
+		op := batchOp(data[0])
+		data = data[1:]
+		key, ok := next()
+		if !ok || op > batchOpDeleteRange {
+			return ErrInvalidBatch
+		}
+		value, ok := next()
+		if !ok {
+			return ErrInvalidBatch
+		}
+		if err := fn(op, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateKey(key []byte) error {
+	if len(key) == 0 || len(key)+kv.TrailerSize > config.MaxKeyLength {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// Write applies every write of batch, or none of them if it fails. Readers
+// see either none of the batch or all of it.
+//
+// Writers only serialize on logging their batches. The batches are applied
+// to the memtable concurrently, and made visible in the order they were
+// logged.
+func (si *StorageInner) Write(batch *WriteBatch) error {
+	si.writeMu.Lock()
+	if err := si.makeRoomForWrite(batch); err != nil {
+		si.writeMu.Unlock()
+		return fmt.Errorf("write: %w", err)
+	}
+	w, err := si.logBatch(batch)
+	si.writeMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := si.applyWrite(w); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+// makeRoomForWrite throttles the write of batch if flushes or compactions
+// fall behind, then replaces the memtable if it is full or its arena has no
+// room for batch, with one large enough for it. The replaced memtable is
+// queued for flushing by the background workers. The caller must hold
+// si.writeMu, so no other write takes the room before batch is logged, and
+// not si.mu.
+func (si *StorageInner) makeRoomForWrite(batch *WriteBatch) error {
+	if err := si.throttleWrite(); err != nil {
+		return err
+	}
+	// an entry takes no more than its key, value and trailer besides the
+	// overhead of the memtable
+	size := len(batch.data) + batch.Count()*(memtable.EntryOverhead+kv.TrailerSize)
+	si.mu.RLock()
+	hasRoom, full := si.memTable.HasRoom(size), si.memTableFull()
+	si.mu.RUnlock()
+	if hasRoom && !full {
+		return nil
+	}
+	si.log.Infof("create new memtable")
+	return si.newMemTableOfSize(max(si.arenaSize(), size+memtable.TableOverhead))
+}
+
+// pendingWrite is a batch logged to the memtable, but not yet visible.
+type pendingWrite struct {
+	memTable *memtable.Table
+	entries  []memtable.Entry
+	// seq is the sequence number of the last write of the batch.
+	seq uint64
+	// applied is set, under si.publishMu, once the batch is applied, and
+	// visible is closed once it is visible.
+	applied bool
+	visible chan struct{}
+}
+
+// logBatch gives the writes of batch sequence numbers and logs them to the
+// memtable as one record, to be applied by applyWrite. It returns nil for
+// a batch with nothing to write. The caller must hold si.writeMu and have
+// made room for batch with makeRoomForWrite.
+func (si *StorageInner) logBatch(batch *WriteBatch) (*pendingWrite, error) {
+	seq := si.loggedSeq
+	entries := make([]memtable.Entry, 0, batch.Count())
+	write := func(key, value []byte, kind kv.Kind) {
+		seq++
+		entries = append(entries, memtable.Entry{Key: kv.MakeKey(key, seq, kind), Value: value})
+	}
+
+	err := batch.iterate(func(op batchOp, key, value []byte) error {
+		if err := validateKey(key); err != nil {
+			return err
+		}
+		switch op {
+		case batchOpPut:
+			write(key, value, kv.KindPut)
+		case batchOpDelete:
+			write(key, nil, kv.KindDelete)
+		case batchOpDeleteRange:
+			if err := validateKey(value); err != nil {
+				return err
+			}
+			// the tombstone covers the writes of the batch before it, which
+			// have smaller sequence numbers, and not those after it
+			if bytes.Compare(key, value) < 0 {
+				write(key, value, kv.KindRangeDelete)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	si.mu.RLock()
+	mt := si.memTable
+	si.mu.RUnlock()
+	if err := mt.Log(entries); err != nil {
+		return nil, err
+	}
+	w := &pendingWrite{memTable: mt, entries: entries, seq: seq, visible: make(chan struct{})}
+	si.loggedSeq = seq
+	si.publishMu.Lock()
+	si.pendingWrites = append(si.pendingWrites, w)
+	si.publishMu.Unlock()
+	atomic.AddUint64(&si.memTableKeyCount, uint64(len(entries)))
+	return w, nil
+}
+
+// applyWrite applies a write logged by logBatch, syncing the log first if
+// the options say so, and makes it visible once the writes logged before
+// it are. If syncing fails, the write is applied anyway, as it is in the
+// log, but may not survive a crash of the machine.
+func (si *StorageInner) applyWrite(w *pendingWrite) error {
+	if w == nil {
+		return nil
+	}
+	var syncErr error
+	if si.opts.Sync == SyncEveryWrite {
+		syncErr = w.memTable.SyncWAL()
+	}
+	err := w.memTable.Apply(w.entries)
+
+	// the oldest applied writes become visible, up to the first one still
+	// being applied, whose writer publishes them in turn
+	si.publishMu.Lock()
+	w.applied = true
+	for len(si.pendingWrites) > 0 && si.pendingWrites[0].applied {
+		head := si.pendingWrites[0]
+		si.pendingWrites = si.pendingWrites[1:]
+		atomic.StoreUint64(&si.lastSeq, head.seq)
+		close(head.visible)
+	}
+	si.publishMu.Unlock()
+	<-w.visible
+	return errors.Join(syncErr, err)
+}
+
+// waitForWrites waits until the writes logged so far are visible. The
+// caller must hold si.writeMu, so no more are logged meanwhile.
+func (si *StorageInner) waitForWrites() {
+	si.publishMu.Lock()
+	if len(si.pendingWrites) == 0 {
+		si.publishMu.Unlock()
+		return
+	}
+	last := si.pendingWrites[len(si.pendingWrites)-1]
+	si.publishMu.Unlock()
+	<-last.visible
+}
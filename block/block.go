@@ -5,59 +5,58 @@ import (
 	"errors"
 )
 
+// Block is a sorted run of entries. The key of an entry only stores the
+// suffix it does not share with the key before it, except at the restart
+// points, whose keys are stored in full so seeks can binary-search them.
 type Block struct {
-	data    []byte
-	offsets []uint16
+	data     []byte
+	restarts []uint32
 }
 
-func (b *Block) bytesSize() uint16 {
-	return SizeOfUint16 + uint16(len(b.offsets))*SizeOfUint16 + SizeOfUint16 + uint16(len(b.data))
+// Size returns the size of the encoded block.
+func (b *Block) Size() int {
+	return len(b.data) + len(b.restarts)*SizeOfUint32 + SizeOfUint32
 }
 
-// +--------+--------+--------+-----+--------+-------------+-------+
-// | number | offset | offset | ... | offset | data length | data  |
-// +--------+--------+--------+-----+--------+-------------+-------+
-// | uint16 | uint16 | uint16 | ... | uint16 |   uint16    | bytes |
-// +--------+--------+--------+-----+--------+-------------+-------+
+// +---------+---------+-----+---------+--------------------+
+// | entries | restart | ... | restart | number of restarts |
+// +---------+---------+-----+---------+--------------------+
+// |  bytes  | uint32  | ... | uint32  |       uint32       |
+// +---------+---------+-----+---------+--------------------+
+//
+// A restart is the offset of an entry whose key is stored in full.
 func (b *Block) Encode() []byte {
-	buf := make([]byte, b.bytesSize())
-	idx := uint16(0)
-	binary.LittleEndian.PutUint16(buf, uint16(len(b.offsets)))
-	idx += SizeOfUint16
-	for _, offest := range b.offsets {
-		binary.LittleEndian.PutUint16(buf[idx:idx+SizeOfUint16], offest)
-		idx += SizeOfUint16
+	buf := make([]byte, 0, b.Size())
+	buf = append(buf, b.data...)
+	for _, restart := range b.restarts {
+		buf = binary.LittleEndian.AppendUint32(buf, restart)
 	}
-	binary.LittleEndian.PutUint16(buf[idx:idx+SizeOfUint16], uint16(len(b.data)))
-	idx += SizeOfUint16
-	idx += uint16(copy(buf[idx:], b.data))
-	return buf
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(b.restarts)))
 }
 
 var errDataTooShort = errors.New("binary data is too short")
 
 func (b *Block) Decode(data []byte) error {
-	if len(data) < SizeOfUint16 {
+	if len(data) < SizeOfUint32 {
 		return errDataTooShort
 	}
-	idx := 0
-	offsetsLen := binary.LittleEndian.Uint16(data[idx : idx+SizeOfUint16])
-	idx += SizeOfUint16
-	if len(data) < idx+int(offsetsLen*SizeOfUint16) {
+	numRestarts := uint64(binary.LittleEndian.Uint32(data[len(data)-SizeOfUint32:]))
+	if numRestarts > uint64(len(data)/SizeOfUint32) {
 		return errDataTooShort
 	}
-	offsets := make([]uint16, offsetsLen)
-	for i := 0; i < int(offsetsLen); i++ {
-		offsets[i] = binary.LittleEndian.Uint16(data[idx : idx+SizeOfUint16])
-		idx += SizeOfUint16
-	}
-	b.offsets = offsets
-	dataLen := binary.LittleEndian.Uint16(data[idx : idx+SizeOfUint16])
-	idx += SizeOfUint16
-	if len(data) < idx+int(dataLen) {
+	restartsOffset := len(data) - SizeOfUint32 - int(numRestarts)*SizeOfUint32
+	if restartsOffset < 0 {
 		return errDataTooShort
 	}
-	b.data = make([]byte, dataLen)
-	copy(b.data, data[idx:idx+int(dataLen)])
+	restarts := make([]uint32, numRestarts)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(data[restartsOffset+i*SizeOfUint32:])
+		if int64(restarts[i]) >= int64(restartsOffset) {
+			return errors.New("restart point out of range")
+		}
+	}
+	b.restarts = restarts
+	b.data = make([]byte, restartsOffset)
+	copy(b.data, data[:restartsOffset])
 	return nil
 }
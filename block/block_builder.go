@@ -1,77 +1,121 @@
 package block
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"math"
 	"minilsm/config"
+	"minilsm/kv"
 )
 
 const (
 	SizeOfUint16 = 2
+	SizeOfUint32 = 4
+
+	// RestartInterval is the number of entries between restart points.
+	RestartInterval = 16
 )
 
 type Builder struct {
-	offsets    []uint16
-	data       []byte
-	dataCursor uint16
-	blockSize  uint16
+	data     []byte
+	restarts []uint32
+	lastKey  []byte
+	// counter is the number of entries since the last restart point.
+	counter   int
+	blockSize uint32
 }
 
-func NewBlockBuilder(size uint16) *Builder {
+func NewBlockBuilder(size uint32) *Builder {
 	return &Builder{
-		offsets:    make([]uint16, 0),
-		data:       make([]byte, size),
-		dataCursor: 0,
-		blockSize:  size,
+		data:      make([]byte, 0, size),
+		restarts:  make([]uint32, 0),
+		blockSize: size,
 	}
 }
 
-func estimateGrow(key, value []byte) uint16 {
-	return uint16(len(key)) + uint16(len(value)) + SizeOfUint16*2 + SizeOfUint16 // kLen | key | vLen | value | offset
-}
-
 func (b *Builder) IsEmpty() bool {
-	return len(b.offsets) == 0
+	return len(b.data) == 0
 }
 
 var (
 	ErrKeyEmpty   = errors.New("key is empty")
 	ErrKeyTooLong = errors.New("key is too long")
 	ErrBlockFull  = errors.New("block is full")
+	// ErrValueTooLong is returned for an entry that does not fit in the 4 GiB
+	// a block can address.
+	ErrValueTooLong = errors.New("value is too long")
 )
 
-// +----------+-------+------------+-------+
-// | key size |  key  | value size | value |
-// +----------+-------+------------+-------+
-// | uint16   | bytes |  uint16    | bytes |
-// +----------+-------+------------+-------+
+// Add adds an entry whose key is an internal key. Keys must be added in
+// kv.Compare order. The first entry of a block is always accepted, so an
+// entry larger than the block size gets a block of its own.
+//
+// +--------------+----------------+------------+------------+-------+
+// | shared size  | unshared size  | value size | key suffix | value |
+// +--------------+----------------+------------+------------+-------+
+// |   uvarint    |    uvarint     |  uvarint   |   bytes    | bytes |
+// +--------------+----------------+------------+------------+-------+
+//
+// shared size is the length of the prefix the key shares with the key of
+// the entry before it, which is 0 at restart points.
 func (b *Builder) Add(key, value []byte) error {
-	if len(key) == 0 {
+	if len(key) <= kv.TrailerSize {
 		return ErrKeyEmpty
 	}
 	if len(key) > config.MaxKeyLength {
 		return ErrKeyTooLong
 	}
 
-	if b.dataCursor+estimateGrow(key, value) > b.blockSize {
+	shared := 0
+	restart := b.counter == 0 || b.counter >= RestartInterval
+	if !restart {
+		shared = sharedPrefixLen(b.lastKey, key)
+	}
+	grow := uvarintLen(shared) + uvarintLen(len(key)-shared) + uvarintLen(len(value)) +
+		len(key) - shared + len(value)
+	if restart {
+		grow += SizeOfUint32
+	}
+	if !b.IsEmpty() && len(b.data)+len(b.restarts)*SizeOfUint32+SizeOfUint32+grow > int(b.blockSize) {
 		return ErrBlockFull
 	}
+	if uint64(len(b.data))+uint64(grow) > math.MaxUint32 {
+		return ErrValueTooLong
+	}
 
-	b.offsets = append(b.offsets, b.dataCursor)
+	if restart {
+		b.restarts = append(b.restarts, uint32(len(b.data)))
+		b.counter = 0
+	}
+	b.data = binary.AppendUvarint(b.data, uint64(shared))
+	b.data = binary.AppendUvarint(b.data, uint64(len(key)-shared))
+	b.data = binary.AppendUvarint(b.data, uint64(len(value)))
+	b.data = append(b.data, key[shared:]...)
+	b.data = append(b.data, value...)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+	return nil
+}
 
-	binary.LittleEndian.PutUint16(b.data[b.dataCursor:b.dataCursor+SizeOfUint16], uint16(len(key)))
-	b.dataCursor += SizeOfUint16
-	b.dataCursor += uint16(copy(b.data[b.dataCursor:], key))
-	binary.LittleEndian.PutUint16(b.data[b.dataCursor:b.dataCursor+SizeOfUint16], uint16(len(value)))
-	b.dataCursor += SizeOfUint16
-	b.dataCursor += uint16(copy(b.data[b.dataCursor:], value))
+func uvarintLen(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
 
-	return nil
+func sharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
 }
 
 func (b *Builder) Build() *Block {
 	return &Block{
-		data:    b.data,
-		offsets: b.offsets,
+		data:     bytes.Clone(b.data),
+		restarts: b.restarts,
 	}
 }
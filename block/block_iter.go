@@ -1,20 +1,24 @@
 package block
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"minilsm/logger"
+	"minilsm/kv"
+	"sort"
 )
 
-var log = logger.GetLogger()
-
 type Iter struct {
 	block *Block
 	key   []byte
 	value []byte
-	idx   int
+	// cur is the offset of the current entry and next that of the entry
+	// after it.
+	cur   int
+	next  int
+	valid bool
+	// err is set once a corrupt entry is met.
+	err error
 }
 
 func (i *Iter) Key() []byte {
@@ -26,30 +30,106 @@ func (i *Iter) Value() []byte {
 }
 
 func (i *Iter) IsValid() bool {
-	return i != nil && i.block != nil && len(i.key) > 0 && i.idx < len(i.block.offsets)
+	return i != nil && i.valid && i.err == nil
 }
 
+// The moves below drop the errors of parseNext: running off the block only
+// invalidates the iterator, and a corrupt entry is kept for Error.
+
 func (i *Iter) Next() {
-	if i.block == nil {
+	if !i.IsValid() {
+		return
+	}
+	_ = i.parseNext()
+}
+
+// Prev moves to the entry before the current one. Entries only refer to the
+// entry before them through the shared prefix, so it scans forward from the
+// last restart point before the current entry.
+func (i *Iter) Prev() {
+	if !i.IsValid() {
 		return
 	}
-	i.idx++
-	if err := i.seekTo(i.idx); err != nil {
-		log.Infof("block iter next: %v", err)
+	_ = i.prev()
+}
+
+func (i *Iter) prev() error {
+	cur := i.cur
+	if cur == 0 {
+		i.valid = false
+		return errors.New("prev: start of block")
+	}
+	index := sort.Search(len(i.block.restarts), func(j int) bool {
+		return int(i.block.restarts[j]) >= cur
+	}) - 1
+	if err := i.seekToRestart(max(index, 0)); err != nil {
+		return err
+	}
+	for i.next < cur {
+		if err := i.parseNext(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seek positions the iterator at the first entry whose key is not less than
+// key, or leaves it invalid if there is none.
+func (i *Iter) Seek(key []byte) {
+	_ = i.SeekToKey(key)
+}
+
+func (i *Iter) SeekToFirst() {
+	_ = i.seekToRestart(0)
+}
+
+func (i *Iter) SeekToLast() {
+	_ = i.seekToLast()
+}
+
+func (i *Iter) seekToLast() error {
+	if err := i.seekToRestart(len(i.block.restarts) - 1); err != nil {
+		return err
+	}
+	for i.next < len(i.block.data) {
+		if err := i.parseNext(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SeekForPrev positions the iterator at the last entry whose key is not
+// greater than key.
+func (i *Iter) SeekForPrev(key []byte) {
+	if err := i.SeekToKey(key); err != nil {
+		i.SeekToLast()
 		return
 	}
+	if kv.Compare(i.key, key) > 0 {
+		i.Prev()
+	}
+}
+
+// Error returns the error of a corrupt entry met by the iterator.
+func (i *Iter) Error() error {
+	return i.err
+}
+
+func (i *Iter) Close() error {
+	i.valid = false
+	return nil
 }
 
 func NewBlockIter(block *Block) *Iter {
 	return &Iter{
 		block: block,
-		idx:   0,
 	}
 }
 
 func NewBlockIterAndSeekToFirst(block *Block) (*Iter, error) {
 	iter := NewBlockIter(block)
-	if err := iter.seekTo(0); err != nil {
+	if err := iter.seekToRestart(0); err != nil {
 		return nil, fmt.Errorf("new block iter and seek to first: %w", err)
 	}
 	return iter, nil
@@ -63,56 +143,88 @@ func NewBlockIterAndSeekToKey(block *Block, key []byte) (*Iter, error) {
 	return iter, nil
 }
 
-var ErrKeyNotFound = errors.New("key not found")
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	errInvalidEntry = errors.New("invalid entry")
+)
 
-func (i *Iter) seekTo(index int) error {
-	if index >= len(i.block.offsets) {
-		log.Info("seek to: invalid index")
-		return errors.New("seek to: invalid index")
+// seekToRestart positions the iterator at the entry of the restart point
+// with the given index.
+func (i *Iter) seekToRestart(index int) error {
+	if index < 0 || index >= len(i.block.restarts) {
+		i.valid = false
+		return errors.New("seek to restart: invalid index")
 	}
-	offset := i.block.offsets[index]
-	i.seekToOffset(offset)
-	i.idx = index
-	return nil
+	i.key = i.key[:0]
+	i.next = int(i.block.restarts[index])
+	return i.parseNext()
 }
 
-func (i *Iter) seekToOffset(offset uint16) error {
-	if int(offset) >= len(i.block.data) {
-		return errors.New("seek to invalid offset")
+// parseNext decodes the entry at i.next, whose key shares a prefix with the
+// current key.
+func (i *Iter) parseNext() error {
+	data := i.block.data
+	i.cur = i.next
+	if i.next >= len(data) {
+		i.valid = false
+		return errors.New("parse next: end of block")
 	}
-	entry := i.block.data[offset:]
-	ks := binary.LittleEndian.Uint16(entry[:SizeOfUint16])
-	key := make([]byte, ks)
-	copy(key, entry[SizeOfUint16:])
-	i.key = key
-	vs := binary.LittleEndian.Uint16(entry[SizeOfUint16+ks:])
+	entry := data[i.next:]
+	var header [3]uint64
+	for j := range header {
+		v, n := binary.Uvarint(entry)
+		if n <= 0 {
+			i.valid = false
+			i.err = errInvalidEntry
+			return errInvalidEntry
+		}
+		header[j] = v
+		entry = entry[n:]
+	}
+	if header[0] > uint64(len(i.key)) || header[1] > uint64(len(entry)) || header[2] > uint64(len(entry))-header[1] {
+		i.valid = false
+		i.err = errInvalidEntry
+		return errInvalidEntry
+	}
+	shared, unshared, vs := int(header[0]), int(header[1]), int(header[2])
+	key := make([]byte, shared+unshared)
+	copy(key, i.key[:shared])
+	copy(key[shared:], entry[:unshared])
 	value := make([]byte, vs)
-	copy(value, entry[SizeOfUint16+ks+SizeOfUint16:])
-	i.value = value
+	copy(value, entry[unshared:unshared+vs])
+	i.key, i.value = key, value
+	i.next = len(data) - len(entry) + unshared + vs
+	i.valid = true
 	return nil
 }
 
+// SeekToKey positions the iterator at the first entry whose key is not less
+// than key. It binary-searches the restart points for the last one before
+// key and scans forward from there.
 func (i *Iter) SeekToKey(key []byte) error {
 	if len(key) <= 0 {
 		return errors.New("seek to key: empty key")
 	}
-	l, r := 0, len(i.block.offsets)
+	l, r := 0, len(i.block.restarts)
 	for l < r {
 		mid := l + (r-l)/2
-		if err := i.seekTo(mid); err != nil {
-			return fmt.Errorf("2 seek to key: %w", err)
+		if err := i.seekToRestart(mid); err != nil {
+			return fmt.Errorf("seek to key: %w", err)
 		}
-		switch bytes.Compare(i.key, key) {
-		case -1:
+		if kv.Compare(i.key, key) < 0 {
 			l = mid + 1
-		case 0:
-			return nil
-		case 1:
+		} else {
 			r = mid
 		}
 	}
-	if err := i.seekTo(l); err != nil {
+	// the restart points before l all have keys less than key
+	if err := i.seekToRestart(max(l-1, 0)); err != nil {
 		return fmt.Errorf("seek to key: %w", ErrKeyNotFound)
 	}
+	for kv.Compare(i.key, key) < 0 {
+		if err := i.parseNext(); err != nil {
+			return fmt.Errorf("seek to key: %w", ErrKeyNotFound)
+		}
+	}
 	return nil
 }
@@ -13,8 +13,6 @@ type Meta struct {
 	FirstKey []byte
 }
 
-const SizeOfUint32 = 4
-
 func NewBlockMeta(offset uint32, firstKey []byte) *Meta {
 	return &Meta{
 		Offset:   offset,
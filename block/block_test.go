@@ -1,7 +1,9 @@
 package block
 
 import (
+	"bytes"
 	"fmt"
+	"minilsm/kv"
 	"strconv"
 	"testing"
 
@@ -10,7 +12,7 @@ import (
 
 func TestBlockBuilder_Add(t *testing.T) {
 	tests := []struct {
-		giveBlockSize uint16
+		giveBlockSize uint32
 		wantErr       error
 	}{
 		{
@@ -25,13 +27,15 @@ func TestBlockBuilder_Add(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("blockSize: %d", tt.giveBlockSize), func(t *testing.T) {
 			bb := NewBlockBuilder(tt.giveBlockSize)
-			err := bb.Add([]byte("key"), []byte("value"))
+			// the first entry always fits, so an oversized one gets its own block
+			assert.NoError(t, bb.Add(kv.MakeKey([]byte("key0"), 1, kv.KindPut), []byte("value")))
+			err := bb.Add(kv.MakeKey([]byte("key1"), 1, kv.KindPut), []byte("value"))
 			assert.Equal(t, tt.wantErr, err)
 		})
 	}
 }
 
-func generateBlock(t *testing.T, blockSize uint16) *Block {
+func generateBlock(t *testing.T, blockSize uint32) *Block {
 	bb := NewBlockBuilder(blockSize)
 	tests := []struct {
 		giveKey []byte
@@ -39,12 +43,12 @@ func generateBlock(t *testing.T, blockSize uint16) *Block {
 		want    error
 	}{
 		{
-			giveKey: []byte("key0"),
+			giveKey: kv.MakeKey([]byte("key0"), 1, kv.KindPut),
 			giveVal: []byte("value0"),
 			want:    nil,
 		},
 		{
-			giveKey: []byte("key1"),
+			giveKey: kv.MakeKey([]byte("key1"), 2, kv.KindPut),
 			giveVal: []byte("value1"),
 			want:    nil,
 		},
@@ -60,7 +64,7 @@ func generateBlock(t *testing.T, blockSize uint16) *Block {
 		},
 	}
 	for _, tt := range tests {
-		t.Run(string(tt.giveKey)+":"+string(tt.giveVal), func(t *testing.T) {
+		t.Run(string(tt.giveVal), func(t *testing.T) {
 			err := bb.Add(tt.giveKey, tt.giveVal)
 			assert.Equal(t, tt.want, err)
 		})
@@ -83,9 +87,9 @@ func TestBlock_Encode_Decode(t *testing.T) {
 func TestBlock_Iter_SeekToKey(t *testing.T) {
 	b := generateBlock(t, 100)
 	iter := NewBlockIter(b)
-	err := iter.SeekToKey([]byte("key1"))
+	err := iter.SeekToKey(kv.MakeSeekKey([]byte("key1"), kv.MaxSeq))
 	assert.NoError(t, err)
-	assert.Equal(t, []byte("key1"), iter.key)
+	assert.Equal(t, kv.MakeKey([]byte("key1"), 2, kv.KindPut), iter.key)
 	assert.Equal(t, []byte("value1"), iter.value)
 }
 
@@ -105,3 +109,102 @@ func TestBlockMeta_Encode_Decode(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, bms, got)
 }
+
+func TestBlock_Iter_SeekToVersion(t *testing.T) {
+	bb := NewBlockBuilder(200)
+	assert.NoError(t, bb.Add(kv.MakeKey([]byte("key0"), 3, kv.KindDelete), nil))
+	assert.NoError(t, bb.Add(kv.MakeKey([]byte("key0"), 2, kv.KindPut), []byte{}))
+	assert.NoError(t, bb.Add(kv.MakeKey([]byte("key0"), 1, kv.KindPut), []byte("value0")))
+	assert.NoError(t, bb.Add(kv.MakeKey([]byte("key1"), 4, kv.KindPut), []byte("value1")))
+
+	b := &Block{}
+	assert.NoError(t, b.Decode(bb.Build().Encode()))
+	iter, err := NewBlockIterAndSeekToKey(b, kv.MakeSeekKey([]byte("key0"), 2))
+	assert.NoError(t, err)
+	assert.Equal(t, kv.MakeKey([]byte("key0"), 2, kv.KindPut), iter.Key())
+	assert.Equal(t, []byte{}, iter.Value())
+	iter.Next()
+	assert.Equal(t, []byte("value0"), iter.Value())
+
+	iter, err = NewBlockIterAndSeekToKey(b, kv.MakeSeekKey([]byte("key0"), 0))
+	assert.NoError(t, err)
+	assert.Equal(t, kv.MakeKey([]byte("key1"), 4, kv.KindPut), iter.Key())
+}
+
+func TestBlock_Iter_SeekAcrossRestarts(t *testing.T) {
+	bb := NewBlockBuilder(4096)
+	fullSize := 0
+	for i := 0; i < 100; i++ {
+		key := kv.MakeKey([]byte(fmt.Sprintf("prefix-key-%03d", i)), 1, kv.KindPut)
+		assert.NoError(t, bb.Add(key, []byte(strconv.Itoa(i))))
+		fullSize += len(key)
+	}
+	b := &Block{}
+	assert.NoError(t, b.Decode(bb.Build().Encode()))
+	assert.Len(t, b.restarts, (100+RestartInterval-1)/RestartInterval)
+	assert.Less(t, len(b.data), fullSize)
+
+	for i := 0; i < 100; i++ {
+		iter, err := NewBlockIterAndSeekToKey(b, kv.MakeSeekKey([]byte(fmt.Sprintf("prefix-key-%03d", i)), kv.MaxSeq))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(strconv.Itoa(i)), iter.Value())
+	}
+
+	iter, err := NewBlockIterAndSeekToFirst(b)
+	assert.NoError(t, err)
+	n := 0
+	for ; iter.IsValid(); iter.Next() {
+		assert.Equal(t, kv.MakeKey([]byte(fmt.Sprintf("prefix-key-%03d", n)), 1, kv.KindPut), iter.Key())
+		n++
+	}
+	assert.Equal(t, 100, n)
+
+	_, err = NewBlockIterAndSeekToKey(b, kv.MakeSeekKey([]byte("prefix-key-100"), kv.MaxSeq))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestBlock_Iter_Backward(t *testing.T) {
+	bb := NewBlockBuilder(4096)
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(t, bb.Add(kv.MakeKey([]byte(fmt.Sprintf("prefix-key-%03d", i)), 1, kv.KindPut), []byte(strconv.Itoa(i))))
+	}
+	b := bb.Build()
+
+	iter := NewBlockIter(b)
+	iter.SeekToLast()
+	n := 98
+	for ; iter.IsValid(); iter.Prev() {
+		assert.Equal(t, kv.MakeKey([]byte(fmt.Sprintf("prefix-key-%03d", n)), 1, kv.KindPut), iter.Key())
+		assert.Equal(t, []byte(strconv.Itoa(n)), iter.Value())
+		n -= 2
+	}
+	assert.Equal(t, -2, n)
+
+	iter.SeekForPrev(kv.MakeSeekKey([]byte("prefix-key-051"), kv.MaxSeq))
+	assert.Equal(t, []byte("50"), iter.Value())
+	iter.SeekForPrev(kv.MakeKey([]byte("prefix-key-050"), 1, kv.KindPut))
+	assert.Equal(t, []byte("50"), iter.Value())
+	iter.SeekForPrev(kv.MakeSeekKey([]byte("prefix-key-999"), kv.MaxSeq))
+	assert.Equal(t, []byte("98"), iter.Value())
+	iter.SeekForPrev(kv.MakeSeekKey([]byte("a"), kv.MaxSeq))
+	assert.False(t, iter.IsValid())
+
+	iter.SeekToFirst()
+	iter.Next()
+	iter.Prev()
+	assert.Equal(t, []byte("0"), iter.Value())
+}
+
+func TestBlock_LargeValue(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 1<<17)
+	bb := NewBlockBuilder(4096)
+	assert.NoError(t, bb.Add(kv.MakeKey([]byte("key0"), 1, kv.KindPut), value))
+	assert.ErrorIs(t, bb.Add(kv.MakeKey([]byte("key1"), 1, kv.KindPut), []byte("value")), ErrBlockFull)
+
+	b := &Block{}
+	assert.NoError(t, b.Decode(bb.Build().Encode()))
+	iter, err := NewBlockIterAndSeekToFirst(b)
+	assert.NoError(t, err)
+	assert.Equal(t, kv.MakeKey([]byte("key0"), 1, kv.KindPut), iter.Key())
+	assert.Equal(t, value, iter.Value())
+}
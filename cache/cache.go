@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// numShards is the number of independently locked parts of a Cache.
+const numShards = 16
+
+// Key identifies a cached block: the ID from NewID of its owner, the file
+// it belongs to and its index in the file.
+type Key struct {
+	ID    uint64
+	File  uint32
+	Block uint32
+}
+
+func (k Key) shard() int {
+	// the finalizer of splitmix64 spreads consecutive keys over the shards
+	h := k.ID ^ uint64(k.File)<<32 ^ uint64(k.Block)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return int(h % numShards)
+}
+
+type fileKey struct {
+	id   uint64
+	file uint32
+}
+
+// Cache is an LRU cache whose entries are charged against a capacity in
+// bytes. It is split into shards that are evicted independently, and is
+// safe for concurrent use, so several stores may share one.
+type Cache struct {
+	shards [numShards]shard
+	lastID atomic.Uint64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// New returns a cache holding up to capacity bytes.
+func New(capacity int64) *Cache {
+	c := &Cache{}
+	for i := range c.shards {
+		c.shards[i].init((capacity + numShards - 1) / numShards)
+	}
+	return c
+}
+
+// NewID returns an ID not returned before, for an owner to tell its keys
+// from those of the other users of the cache.
+func (c *Cache) NewID() uint64 {
+	return c.lastID.Add(1)
+}
+
+// Get returns the value cached under key and marks it recently used.
+func (c *Cache) Get(key Key) (any, bool) {
+	v, ok := c.shards[key.shard()].get(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return v, ok
+}
+
+// Insert caches value under key, charging charge bytes for it, and evicts
+// the least recently used entries of its shard beyond the capacity. A value
+// larger than a shard is not cached.
+func (c *Cache) Insert(key Key, value any, charge int64) {
+	c.shards[key.shard()].insert(key, value, charge)
+}
+
+// EvictFile drops every entry of file cached by the owner of id.
+func (c *Cache) EvictFile(id uint64, file uint32) {
+	for i := range c.shards {
+		c.shards[i].evictFile(fileKey{id: id, file: file})
+	}
+}
+
+// Stats describes the use of a Cache.
+type Stats struct {
+	Hits     uint64
+	Misses   uint64
+	Count    int
+	Size     int64
+	Capacity int64
+}
+
+// Stats returns the hits and misses of Get so far and what is cached now.
+func (c *Cache) Stats() Stats {
+	s := Stats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		s.Count += len(sh.entries)
+		s.Size += sh.usage
+		s.Capacity += sh.capacity
+		sh.mu.Unlock()
+	}
+	return s
+}
+
+type entry struct {
+	key    Key
+	value  any
+	charge int64
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	usage    int64
+	// lru holds the entries from the most to the least recently used.
+	lru     *list.List
+	entries map[Key]*list.Element
+	files   map[fileKey]map[*list.Element]struct{}
+}
+
+func (s *shard) init(capacity int64) {
+	s.capacity = capacity
+	s.lru = list.New()
+	s.entries = make(map[Key]*list.Element)
+	s.files = make(map[fileKey]map[*list.Element]struct{})
+}
+
+func (s *shard) get(key Key) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*entry).value, true
+}
+
+func (s *shard) insert(key Key, value any, charge int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+	if charge > s.capacity {
+		return
+	}
+	e := s.lru.PushFront(&entry{key: key, value: value, charge: charge})
+	s.entries[key] = e
+	fk := fileKey{id: key.ID, file: key.File}
+	if s.files[fk] == nil {
+		s.files[fk] = make(map[*list.Element]struct{})
+	}
+	s.files[fk][e] = struct{}{}
+	s.usage += charge
+	for s.usage > s.capacity {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *shard) evictFile(fk fileKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := range s.files[fk] {
+		s.remove(e)
+	}
+}
+
+// remove drops e from the shard. The caller must hold s.mu.
+func (s *shard) remove(e *list.Element) {
+	ent := s.lru.Remove(e).(*entry)
+	delete(s.entries, ent.key)
+	fk := fileKey{id: ent.key.ID, file: ent.key.File}
+	delete(s.files[fk], e)
+	if len(s.files[fk]) == 0 {
+		delete(s.files, fk)
+	}
+	s.usage -= ent.charge
+}
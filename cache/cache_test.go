@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_GetInsert(t *testing.T) {
+	c := New(1 << 20)
+	key := Key{ID: c.NewID(), File: 1, Block: 2}
+	_, ok := c.Get(key)
+	assert.False(t, ok)
+
+	c.Insert(key, "block", 100)
+	v, ok := c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, "block", v)
+
+	// the same file and block of another owner is a different key
+	_, ok = c.Get(Key{ID: c.NewID(), File: 1, Block: 2})
+	assert.False(t, ok)
+
+	s := c.Stats()
+	assert.Equal(t, uint64(1), s.Hits)
+	assert.Equal(t, uint64(2), s.Misses)
+	assert.Equal(t, 1, s.Count)
+	assert.Equal(t, int64(100), s.Size)
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(numShards * 1000)
+	id := c.NewID()
+	for i := uint32(0); i < 10000; i++ {
+		c.Insert(Key{ID: id, File: 1, Block: i}, i, 100)
+		assert.LessOrEqual(t, c.Stats().Size, int64(numShards*1000))
+	}
+	for i := uint32(10000 - 5); i < 10000; i++ {
+		_, ok := c.Get(Key{ID: id, File: 1, Block: i})
+		assert.True(t, ok)
+	}
+	_, ok := c.Get(Key{ID: id, File: 1, Block: 0})
+	assert.False(t, ok)
+
+	// an entry larger than a shard is not cached
+	c.Insert(Key{ID: id, File: 2, Block: 0}, "big", 2000)
+	_, ok = c.Get(Key{ID: id, File: 2, Block: 0})
+	assert.False(t, ok)
+}
+
+func TestCache_EvictFile(t *testing.T) {
+	c := New(1 << 20)
+	id := c.NewID()
+	for file := uint32(1); file <= 2; file++ {
+		for i := uint32(0); i < 100; i++ {
+			c.Insert(Key{ID: id, File: file, Block: i}, i, 10)
+		}
+	}
+	c.EvictFile(id, 1)
+	s := c.Stats()
+	assert.Equal(t, 100, s.Count)
+	assert.Equal(t, int64(1000), s.Size)
+	for i := uint32(0); i < 100; i++ {
+		_, ok := c.Get(Key{ID: id, File: 1, Block: i})
+		assert.False(t, ok)
+		_, ok = c.Get(Key{ID: id, File: 2, Block: i})
+		assert.True(t, ok)
+	}
+}
+
+func TestCache_Concurrent(t *testing.T) {
+	c := New(numShards * 1000)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := c.NewID()
+			for i := uint32(0); i < 1000; i++ {
+				key := Key{ID: id, File: i % 10, Block: i}
+				c.Insert(key, i, 50)
+				c.Get(key)
+				if i%100 == 0 {
+					c.EvictFile(id, i%10)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, c.Stats().Size, int64(numShards*1000))
+}
@@ -0,0 +1,444 @@
+package minilsm
+
+import (
+	"bytes"
+	"fmt"
+	"minilsm/compaction"
+	"minilsm/iterator"
+	"minilsm/kv"
+	"minilsm/manifest"
+	"minilsm/rangedel"
+	"minilsm/sstable"
+	"minilsm/util"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+const (
+	// l0CompactionTrigger is the default number of L0 tables that makes L0
+	// due for compaction.
+	l0CompactionTrigger = 2
+	// maxLevels is the number of levels below L0.
+	maxLevels = 6
+	// levelBaseSize is the default target size of L1; every further level
+	// is levelSizeMultiplier times larger than the one above it.
+	levelBaseSize       = 512 * 1024
+	levelSizeMultiplier = 10
+	// targetSSTableSize is the default size at which compaction starts a
+	// new output table.
+	targetSSTableSize = 64 * 1024
+)
+
+// compactionTask is a compaction.Task with its table IDs resolved.
+type compactionTask struct {
+	levels      []int
+	inputs      [][]*sstable.Table
+	outputLevel int
+	// bottommost is set when no level below the output level holds data, so
+	// tombstones have nothing left to hide and can be dropped.
+	bottommost bool
+	// watermark is the oldest sequence number a reader may still read at.
+	// Of the versions of a key not newer than it, only the newest is kept.
+	watermark uint64
+	// deleteOnly is set when every entry of the inputs is deleted by a range
+	// tombstone of another table, so they are dropped without any output.
+	deleteOnly bool
+}
+
+func tableInfos(tables []*sstable.Table) []compaction.TableInfo {
+	infos := make([]compaction.TableInfo, 0, len(tables))
+	for _, t := range tables {
+		infos = append(infos, compaction.TableInfo{
+			ID:       t.SSTID(),
+			Size:     t.Size(),
+			FirstKey: kv.UserKey(t.FirstKey()),
+			LastKey:  kv.UserKey(t.LastKey()),
+		})
+	}
+	return infos
+}
+
+// pickCompaction asks the compaction strategy for the next compaction to run
+// and returns nil if there is none.
+func (si *StorageInner) pickCompaction() *compactionTask {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	return si.pickCompactionLocked()
+}
+
+// pickCompactionLocked is pickCompaction for a caller holding si.mu.
+func (si *StorageInner) pickCompactionLocked() *compactionTask {
+	// the strategy picks among the tables no running compaction reads, so
+	// another worker can run a compaction of the others
+	layout := &compaction.Layout{
+		L0:     tableInfos(si.unclaimed(si.l0SSTables)),
+		Levels: make([][]compaction.TableInfo, 0, len(si.levels)),
+	}
+	for _, level := range si.levels {
+		layout.Levels = append(layout.Levels, tableInfos(si.unclaimed(level)))
+	}
+	if task := si.pickDeleteOnlyCompaction(); task != nil {
+		return task
+	}
+	task := si.opts.CompactionStrategy.PickCompaction(layout)
+	if task == nil {
+		return nil
+	}
+
+	resolved := &compactionTask{
+		outputLevel: task.OutputLevel,
+		bottommost:  task.OutputLevel > 0,
+		watermark:   si.gcWatermark(),
+	}
+	for _, level := range si.levels[max(task.OutputLevel, 1):] {
+		if len(level) > 0 {
+			resolved.bottommost = false
+		}
+	}
+	for _, input := range task.Inputs {
+		if len(input.Tables) == 0 {
+			continue
+		}
+		level := si.l0SSTables
+		if input.Level > 0 {
+			level = si.levels[input.Level-1]
+		}
+		tables := make([]*sstable.Table, 0, len(input.Tables))
+		for _, id := range input.Tables {
+			idx := slices.IndexFunc(level, func(t *sstable.Table) bool { return t.SSTID() == id })
+			if idx < 0 {
+				si.log.Errorf("pick compaction: table %d is not in level %d", id, input.Level)
+				return nil
+			}
+			tables = append(tables, level[idx])
+		}
+		resolved.levels = append(resolved.levels, input.Level)
+		resolved.inputs = append(resolved.inputs, tables)
+	}
+	return resolved
+}
+
+// startCompaction picks the next compaction among the tables no running
+// compaction reads and claims its input tables. It returns nil if no
+// compaction is needed, or if the one needed spans keys of a running
+// compaction: compactions running at once cover disjoint key ranges, so
+// their outputs never overlap in a level and no key moves past an older
+// version of it. Release the tables with finishCompaction once the task
+// has run.
+func (si *StorageInner) startCompaction() *compactionTask {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	task := si.pickCompactionLocked()
+	if task == nil {
+		return nil
+	}
+	for _, running := range si.compactions {
+		if task.overlaps(running) {
+			return nil
+		}
+	}
+	si.compactions = append(si.compactions, task)
+	for _, tables := range task.inputs {
+		for _, t := range tables {
+			si.compacting[t] = true
+		}
+	}
+	return task
+}
+
+// finishCompaction releases the input tables of task claimed by
+// startCompaction.
+func (si *StorageInner) finishCompaction(task *compactionTask) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.compactions = slices.DeleteFunc(si.compactions, func(running *compactionTask) bool {
+		return running == task
+	})
+	for _, tables := range task.inputs {
+		for _, t := range tables {
+			delete(si.compacting, t)
+		}
+	}
+}
+
+// unclaimed returns the tables no running compaction reads. The caller must
+// hold si.mu.
+func (si *StorageInner) unclaimed(tables []*sstable.Table) []*sstable.Table {
+	if len(si.compacting) == 0 {
+		return tables
+	}
+	return slices.DeleteFunc(slices.Clone(tables), func(t *sstable.Table) bool {
+		return si.compacting[t]
+	})
+}
+
+// keyRange returns the smallest and the largest user key of the inputs of
+// task.
+func (task *compactionTask) keyRange() (first, last []byte) {
+	for _, tables := range task.inputs {
+		for _, t := range tables {
+			if k := kv.UserKey(t.FirstKey()); first == nil || bytes.Compare(k, first) < 0 {
+				first = k
+			}
+			if k := kv.UserKey(t.LastKey()); last == nil || bytes.Compare(k, last) > 0 {
+				last = k
+			}
+		}
+	}
+	return first, last
+}
+
+// overlaps reports whether the key ranges of task and other overlap.
+func (task *compactionTask) overlaps(other *compactionTask) bool {
+	first, last := task.keyRange()
+	otherFirst, otherLast := other.keyRange()
+	return bytes.Compare(first, otherLast) <= 0 && bytes.Compare(otherFirst, last) <= 0
+}
+
+// pickDeleteOnlyCompaction returns a task dropping the sstables whose key
+// range is covered by a range tombstone of another sstable that is newer
+// than all their entries and seen by every reader, or nil if there is none.
+// The caller must hold si.mu.
+func (si *StorageInner) pickDeleteOnlyCompaction() *compactionTask {
+	watermark := si.gcWatermark()
+	type owned struct {
+		owner *sstable.Table
+		rangedel.Tombstone
+	}
+	tombstones := make([]owned, 0)
+	for _, t := range si.currentView().sstables() {
+		for _, rd := range t.RangeDels() {
+			if rd.Seq <= watermark {
+				tombstones = append(tombstones, owned{owner: t, Tombstone: rd})
+			}
+		}
+	}
+	if len(tombstones) == 0 {
+		return nil
+	}
+	covered := func(t *sstable.Table) bool {
+		first, last := kv.UserKey(t.FirstKey()), kv.UserKey(t.LastKey())
+		for _, rd := range tombstones {
+			if rd.owner == t || rd.Seq <= t.MaxSeq() || bytes.Compare(rd.Start, first) > 0 {
+				continue
+			}
+			if c := bytes.Compare(last, rd.End); c < 0 || c == 0 && kv.IsSentinelKey(t.LastKey()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	task := &compactionTask{deleteOnly: true, watermark: watermark}
+	for level, tables := range append([][]*sstable.Table{si.l0SSTables}, si.levels...) {
+		var dropped []*sstable.Table
+		for _, t := range tables {
+			if !si.compacting[t] && covered(t) {
+				dropped = append(dropped, t)
+			}
+		}
+		if len(dropped) > 0 {
+			task.levels = append(task.levels, level)
+			task.inputs = append(task.inputs, dropped)
+		}
+	}
+	if len(task.inputs) == 0 {
+		return nil
+	}
+	return task
+}
+
+// compact runs task and installs its output in place of its input tables.
+func (si *StorageInner) compact(task *compactionTask) error {
+	var outputs []*sstable.Table
+	if task.deleteOnly {
+		si.log.Infof("drop tables of levels %v covered by range tombstones", task.levels)
+	} else {
+		si.log.Infof("compact levels %v into level %d", task.levels, task.outputLevel)
+
+		// the inputs of newer data take precedence in the merge, so they
+		// are ranked in their order
+		iters := make([]iterator.Source, 0, len(task.inputs))
+		tombstones := make([]rangedel.Tombstone, 0)
+		for i, tables := range task.inputs {
+			for _, t := range tables {
+				tombstones = append(tombstones, t.RangeDels()...)
+			}
+			if task.levels[i] > 0 {
+				iter, err := sstable.NewConcatIterAndSeekToFirst(tables)
+				if err != nil {
+					return fmt.Errorf("compact: %w", err)
+				}
+				iters = append(iters, iterator.Source{Iter: iter, Rank: len(iters)})
+				continue
+			}
+			for _, t := range tables {
+				iter, err := sstable.NewIterAndSeekToFirst(t)
+				if err != nil {
+					return fmt.Errorf("compact: %w", err)
+				}
+				iters = append(iters, iterator.Source{Iter: iter, Rank: len(iters)})
+			}
+		}
+
+		merged := iterator.NewMergeIterator(iters...)
+		var err error
+		outputs, err = si.buildTables(merged, tombstones, task)
+		merged.Close()
+		if err != nil {
+			return fmt.Errorf("compact: %w", err)
+		}
+	}
+
+	edit := &manifest.Edit{}
+	for i, tables := range task.inputs {
+		for _, t := range tables {
+			edit.Deleted = append(edit.Deleted, manifest.TableRef{Level: uint32(task.levels[i]), ID: t.SSTID()})
+		}
+	}
+	for _, t := range outputs {
+		edit.Added = append(edit.Added, manifest.TableRef{Level: uint32(task.outputLevel), ID: t.SSTID()})
+	}
+	edit.NextFileID = atomic.LoadUint32(&si.nextSSTableID)
+	if err := si.manifest.Log(edit); err != nil {
+		for _, t := range outputs {
+			t.Close()
+			os.Remove(si.sstPath(t.SSTID()))
+		}
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	si.mu.Lock()
+	l0InsertAt := -1
+	for i, tables := range task.inputs {
+		if task.levels[i] == 0 {
+			if l0InsertAt < 0 {
+				l0InsertAt = slices.Index(si.l0SSTables, tables[0])
+			}
+			si.l0SSTables = removeTables(si.l0SSTables, tables)
+		} else {
+			si.levels[task.levels[i]-1] = removeTables(si.levels[task.levels[i]-1], tables)
+		}
+	}
+	if task.outputLevel == 0 {
+		if len(outputs) > 0 {
+			si.l0SSTables = slices.Insert(si.l0SSTables, l0InsertAt, outputs...)
+		}
+	} else {
+		level := append(slices.Clone(si.levels[task.outputLevel-1]), outputs...)
+		sortLevel(level)
+		si.levels[task.outputLevel-1] = level
+	}
+	si.mu.Unlock()
+	si.wakeStalledWrites()
+
+	for _, tables := range task.inputs {
+		si.dropTables(tables)
+	}
+	return nil
+}
+
+// buildTables writes the entries of iter into new tables of task's output
+// level of about Options.TargetFileSize each, dropping the versions no
+// reader can see anymore: those shadowed by a newer version not newer than
+// the task's watermark, those deleted by a range tombstone not newer than
+// it, and, if the output is bottommost, tombstones that are such a version
+// themselves.
+// The versions of a key are never split across tables.
+//
+// The range tombstones are split between the tables at the first key of
+// each, so the key ranges of the tables do not overlap.
+func (si *StorageInner) buildTables(iter iterator.Iterator, tombstones []rangedel.Tombstone, task *compactionTask) ([]*sstable.Table, error) {
+	covering := rangedel.Fragment(tombstones, task.watermark)
+	if task.bottommost {
+		tombstones = slices.DeleteFunc(slices.Clone(tombstones), func(t rangedel.Tombstone) bool {
+			return t.Seq <= task.watermark
+		})
+	}
+
+	outputs := make([]*sstable.Table, 0)
+	abort := func() {
+		for _, t := range outputs {
+			t.Close()
+			os.Remove(si.sstPath(t.SSTID()))
+		}
+	}
+	// lower is the smallest user key of the next table, nil for the first
+	var lower []byte
+	build := func(builder *sstable.TableBulder, upper []byte) error {
+		for _, t := range tombstones {
+			if clipped, ok := t.Clip(lower, upper); ok {
+				builder.AddRangeDel(clipped)
+			}
+		}
+		lower = upper
+		if builder.IsEmpty() {
+			return nil
+		}
+		sstID := si.allocFileID()
+		t, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		return nil
+	}
+
+	builder := si.newTableBuilder(task.outputLevel)
+	var userKey []byte
+	visibleSeen := false
+	for ; iter.IsValid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.Equal(kv.UserKey(key), userKey) {
+			if uint64(builder.EstimatedSize()) >= si.opts.TargetFileSize {
+				if err := build(builder, util.DeepCopySlice(kv.UserKey(key))); err != nil {
+					abort()
+					return nil, err
+				}
+				builder = si.newTableBuilder(task.outputLevel)
+			}
+			userKey = util.DeepCopySlice(kv.UserKey(key))
+			visibleSeen = false
+		}
+		if kv.Seq(key) <= task.watermark {
+			if visibleSeen {
+				continue
+			}
+			visibleSeen = true
+			if task.bottommost && kv.KindOf(key) == kv.KindDelete {
+				continue
+			}
+			if covering.Covers(userKey, kv.Seq(key)) {
+				continue
+			}
+		}
+		if err := builder.Add(key, iter.Value()); err != nil {
+			abort()
+			return nil, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		// the outputs would silently lose the entries past the failure
+		abort()
+		return nil, err
+	}
+	if err := build(builder, nil); err != nil {
+		abort()
+		return nil, err
+	}
+	return outputs, nil
+}
+
+func removeTables(tables, removed []*sstable.Table) []*sstable.Table {
+	return slices.DeleteFunc(slices.Clone(tables), func(t *sstable.Table) bool {
+		return slices.Contains(removed, t)
+	})
+}
+
+func sortLevel(level []*sstable.Table) {
+	slices.SortFunc(level, func(a, b *sstable.Table) int {
+		return kv.Compare(a.FirstKey(), b.FirstKey())
+	})
+}
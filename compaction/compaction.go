@@ -0,0 +1,97 @@
+package compaction
+
+import (
+	"bytes"
+	"sort"
+)
+
+// TableInfo describes an sstable to a Strategy.
+type TableInfo struct {
+	ID       uint32
+	Size     uint64
+	FirstKey []byte
+	LastKey  []byte
+}
+
+// Layout is the current arrangement of sstables.
+type Layout struct {
+	// L0 is ordered from newest to oldest.
+	L0 []TableInfo
+	// Levels[i] is level i+1, a sorted run of non-overlapping tables. Every
+	// level holds older data than the levels above it.
+	Levels [][]TableInfo
+}
+
+// Input is a set of tables of one level taking part in a compaction.
+// Level 0 is L0.
+type Input struct {
+	Level  int
+	Tables []uint32
+}
+
+// Task merges the tables of Inputs into new tables of OutputLevel, which
+// replace them. Inputs are ordered from newest to oldest data. The tables of
+// OutputLevel outside the inputs must not overlap the inputs, unless
+// OutputLevel is L0, where the output takes the place of the inputs, which
+// must then be consecutive L0 tables.
+type Task struct {
+	Inputs      []Input
+	OutputLevel int
+}
+
+// Strategy decides which tables to compact next.
+type Strategy interface {
+	// PickCompaction returns the next compaction to run, or nil if none is
+	// needed.
+	PickCompaction(layout *Layout) *Task
+}
+
+func levelSize(tables []TableInfo) uint64 {
+	var size uint64
+	for _, t := range tables {
+		size += t.Size
+	}
+	return size
+}
+
+func ids(tables []TableInfo) []uint32 {
+	res := make([]uint32, 0, len(tables))
+	for _, t := range tables {
+		res = append(res, t.ID)
+	}
+	return res
+}
+
+// keyRange returns the smallest and the largest key of tables.
+func keyRange(tables []TableInfo) (smallest, largest []byte) {
+	for _, t := range tables {
+		if smallest == nil || bytes.Compare(t.FirstKey, smallest) < 0 {
+			smallest = t.FirstKey
+		}
+		if largest == nil || bytes.Compare(t.LastKey, largest) > 0 {
+			largest = t.LastKey
+		}
+	}
+	return smallest, largest
+}
+
+// findTable returns the index of the first table of a sorted level whose
+// last key is not less than key.
+func findTable(level []TableInfo, key []byte) int {
+	return sort.Search(len(level), func(i int) bool {
+		return bytes.Compare(level[i].LastKey, key) >= 0
+	})
+}
+
+// overlapping returns the tables of a sorted level that overlap
+// [smallest, largest].
+func overlapping(level []TableInfo, smallest, largest []byte) []TableInfo {
+	res := make([]TableInfo, 0)
+	for i := findTable(level, smallest); i < len(level); i++ {
+		if bytes.Compare(level[i].FirstKey, largest) > 0 {
+			break
+		}
+		res = append(res, level[i])
+	}
+	return res
+}
@@ -0,0 +1,90 @@
+package compaction
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func table(id uint32, size uint64, first, last string) TableInfo {
+	return TableInfo{ID: id, Size: size, FirstKey: []byte(first), LastKey: []byte(last)}
+}
+
+func TestLeveled_PickCompaction(t *testing.T) {
+	l := NewLeveled(2, 100, 10)
+
+	layout := &Layout{
+		L0:     []TableInfo{table(1, 10, "a", "c")},
+		Levels: [][]TableInfo{{}, {}, {}},
+	}
+	assert.Nil(t, l.PickCompaction(layout))
+
+	layout.L0 = append([]TableInfo{table(2, 10, "b", "e")}, layout.L0...)
+	layout.Levels[0] = []TableInfo{table(3, 10, "a", "a"), table(4, 10, "d", "f"), table(5, 10, "g", "h")}
+	assert.Equal(t, &Task{
+		Inputs: []Input{
+			{Level: 0, Tables: []uint32{2, 1}},
+			{Level: 1, Tables: []uint32{3, 4}},
+		},
+		OutputLevel: 1,
+	}, l.PickCompaction(layout))
+
+	// L1 is over its target, its tables are picked in turn
+	layout.L0 = nil
+	layout.Levels[0] = []TableInfo{table(3, 60, "a", "b"), table(4, 60, "c", "d")}
+	layout.Levels[1] = []TableInfo{table(5, 60, "b", "c")}
+	assert.Equal(t, &Task{
+		Inputs: []Input{
+			{Level: 1, Tables: []uint32{3}},
+			{Level: 2, Tables: []uint32{5}},
+		},
+		OutputLevel: 2,
+	}, l.PickCompaction(layout))
+	assert.Equal(t, &Task{
+		Inputs: []Input{
+			{Level: 1, Tables: []uint32{4}},
+			{Level: 2, Tables: []uint32{5}},
+		},
+		OutputLevel: 2,
+	}, l.PickCompaction(layout))
+}
+
+func TestTiered_PickCompaction(t *testing.T) {
+	tr := NewTiered(3)
+
+	layout := &Layout{
+		L0:     []TableInfo{table(1, 10, "a", "z"), table(2, 10, "a", "z")},
+		Levels: [][]TableInfo{{}, {}, {}},
+	}
+	assert.Nil(t, tr.PickCompaction(layout))
+
+	// similar sized runs are merged, into the deepest level when nothing is
+	// below them
+	layout.L0 = append([]TableInfo{table(3, 10, "a", "z")}, layout.L0...)
+	assert.Equal(t, &Task{
+		Inputs: []Input{
+			{Level: 0, Tables: []uint32{3}},
+			{Level: 0, Tables: []uint32{1}},
+			{Level: 0, Tables: []uint32{2}},
+		},
+		OutputLevel: 3,
+	}, tr.PickCompaction(layout))
+
+	// the output stays above older runs
+	layout.Levels[2] = []TableInfo{table(4, 1000, "a", "z")}
+	layout.L0 = []TableInfo{table(5, 10, "a", "z"), table(6, 10, "a", "z"), table(7, 100, "a", "z")}
+	assert.Equal(t, &Task{
+		Inputs: []Input{
+			{Level: 0, Tables: []uint32{5}},
+			{Level: 0, Tables: []uint32{6}},
+		},
+		OutputLevel: 0,
+	}, tr.PickCompaction(layout))
+
+	// too much space amplification merges everything
+	layout.L0 = []TableInfo{table(5, 10, "a", "z"), table(6, 100, "a", "z"), table(7, 1000, "a", "z")}
+	layout.Levels[2] = []TableInfo{table(4, 100, "a", "z")}
+	task := tr.PickCompaction(layout)
+	assert.Len(t, task.Inputs, 4)
+	assert.Equal(t, 3, task.OutputLevel)
+}
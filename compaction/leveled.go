@@ -0,0 +1,92 @@
+package compaction
+
+import "sync"
+
+// Leveled keeps every level below L0 a single sorted run whose target size
+// grows by SizeMultiplier from one level to the next. It compacts the level
+// that is furthest over its target into the level below, which keeps read
+// and space amplification low at the cost of rewriting data more often.
+type Leveled struct {
+	// L0Trigger is the number of L0 tables that makes L0 due for compaction.
+	L0Trigger int
+	// BaseSize is the target size of L1 in bytes.
+	BaseSize       uint64
+	SizeMultiplier uint64
+
+	mu sync.Mutex
+	// pointers[i] is the largest key of the table of level i+1 that was
+	// picked last.
+	pointers map[int][]byte
+}
+
+func NewLeveled(l0Trigger int, baseSize, sizeMultiplier uint64) *Leveled {
+	return &Leveled{
+		L0Trigger:      l0Trigger,
+		BaseSize:       baseSize,
+		SizeMultiplier: sizeMultiplier,
+		pointers:       make(map[int][]byte),
+	}
+}
+
+// TargetSize returns the target size of level, which must be at least 1.
+func (l *Leveled) TargetSize(level int) uint64 {
+	size := l.BaseSize
+	for i := 1; i < level; i++ {
+		size *= l.SizeMultiplier
+	}
+	return size
+}
+
+// PickCompaction implements Strategy. It scores every level by how far it
+// is over its target; the last level is never compacted.
+func (l *Leveled) PickCompaction(layout *Layout) *Task {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bestLevel, bestScore := -1, 1.0
+	if score := float64(len(layout.L0)) / float64(l.L0Trigger); score >= bestScore {
+		bestLevel, bestScore = 0, score
+	}
+	for i := 0; i < len(layout.Levels)-1; i++ {
+		score := float64(levelSize(layout.Levels[i])) / float64(l.TargetSize(i+1))
+		if score > bestScore {
+			bestLevel, bestScore = i+1, score
+		}
+	}
+
+	switch {
+	case bestLevel < 0:
+		return nil
+	case bestLevel == 0:
+		smallest, largest := keyRange(layout.L0)
+		return &Task{
+			Inputs: []Input{
+				{Level: 0, Tables: ids(layout.L0)},
+				{Level: 1, Tables: ids(overlapping(layout.Levels[0], smallest, largest))},
+			},
+			OutputLevel: 1,
+		}
+	default:
+		level := layout.Levels[bestLevel-1]
+		// compact the tables of a level in turn, so every key range gets
+		// pushed down eventually
+		idx := findTable(level, l.pointers[bestLevel])
+		if l.pointers[bestLevel] != nil && idx < len(level) && string(level[idx].LastKey) == string(l.pointers[bestLevel]) {
+			idx++
+		}
+		if idx == len(level) {
+			idx = 0
+		}
+		upper := level[idx]
+		l.pointers[bestLevel] = upper.LastKey
+		return &Task{
+			Inputs: []Input{
+				{Level: bestLevel, Tables: []uint32{upper.ID}},
+				{Level: bestLevel + 1, Tables: ids(overlapping(layout.Levels[bestLevel], upper.FirstKey, upper.LastKey))},
+			},
+			OutputLevel: bestLevel + 1,
+		}
+	}
+}
+
+var _ Strategy = (*Leveled)(nil)
@@ -0,0 +1,113 @@
+package compaction
+
+// Tiered is a size-tiered, or universal, strategy. Every L0 table and every
+// non-empty level is a sorted run, and runs of similar size are merged into
+// one. Data is rewritten fewer times than with Leveled, in exchange for more
+// runs to read and more space held by overwritten data.
+type Tiered struct {
+	// Trigger is the number of sorted runs at which a compaction is due.
+	Trigger int
+	// SizeRatio is how much larger, in percent, a run may be than the runs
+	// newer than it combined and still be merged with them.
+	SizeRatio uint64
+	// MinMergeWidth is the least number of runs a size-ratio compaction
+	// merges.
+	MinMergeWidth int
+	// MaxSizeAmplification is the size of all runs but the oldest, in
+	// percent of the oldest, above which all runs are merged into one.
+	MaxSizeAmplification uint64
+}
+
+func NewTiered(trigger int) *Tiered {
+	return &Tiered{
+		Trigger:              trigger,
+		SizeRatio:            1,
+		MinMergeWidth:        2,
+		MaxSizeAmplification: 200,
+	}
+}
+
+// sortedRun is an L0 table or a whole level.
+type sortedRun struct {
+	level  int
+	tables []TableInfo
+	size   uint64
+}
+
+func sortedRuns(layout *Layout) []sortedRun {
+	runs := make([]sortedRun, 0, len(layout.L0)+len(layout.Levels))
+	for _, t := range layout.L0 {
+		runs = append(runs, sortedRun{level: 0, tables: []TableInfo{t}, size: t.Size})
+	}
+	for i, level := range layout.Levels {
+		if len(level) > 0 {
+			runs = append(runs, sortedRun{level: i + 1, tables: level, size: levelSize(level)})
+		}
+	}
+	return runs
+}
+
+// PickCompaction implements Strategy. Runs are always merged from the
+// newest one on, so the output holds newer data than every remaining run.
+func (t *Tiered) PickCompaction(layout *Layout) *Task {
+	runs := sortedRuns(layout)
+	if len(runs) < t.Trigger || len(runs) < 2 {
+		return nil
+	}
+
+	// too much space is held by data that the oldest run may overwrite
+	var newerSize uint64
+	for _, run := range runs[:len(runs)-1] {
+		newerSize += run.size
+	}
+	if newerSize*100 > runs[len(runs)-1].size*t.MaxSizeAmplification {
+		return t.task(layout, runs, len(runs))
+	}
+
+	// merge the newest runs while the next one is not much larger than all
+	// of them together
+	width, accumulated := 1, runs[0].size
+	for width < len(runs) && runs[width].size*100 <= accumulated*(100+t.SizeRatio) {
+		accumulated += runs[width].size
+		width++
+	}
+	if width >= t.MinMergeWidth {
+		return t.task(layout, runs, width)
+	}
+
+	// reduce the number of runs below the trigger
+	return t.task(layout, runs, len(runs)-t.Trigger+2)
+}
+
+// task merges the newest width runs. The output goes to the level of the
+// oldest merged run. If that is an L0 table, the output stays in L0 when
+// older L0 tables remain, and otherwise goes to the deepest empty level above
+// every remaining level; if there is no such level, the next run is merged
+// as well.
+func (t *Tiered) task(layout *Layout, runs []sortedRun, width int) *Task {
+	if width > len(runs) {
+		width = len(runs)
+	}
+
+	outputLevel := runs[width-1].level
+	if outputLevel == 0 {
+		switch {
+		case width == len(runs):
+			outputLevel = len(layout.Levels)
+		case runs[width].level == 0:
+		case runs[width].level == 1:
+			width++
+			outputLevel = 1
+		default:
+			outputLevel = runs[width].level - 1
+		}
+	}
+
+	inputs := make([]Input, 0, width)
+	for _, run := range runs[:width] {
+		inputs = append(inputs, Input{Level: run.level, Tables: ids(run.tables)})
+	}
+	return &Task{Inputs: inputs, OutputLevel: outputLevel}
+}
+
+var _ Strategy = (*Tiered)(nil)
@@ -0,0 +1,139 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Type identifies a compression format on disk.
+type Type uint8
+
+const (
+	None Type = iota
+	Flate
+	Zlib
+)
+
+// Compressor compresses the blocks of tables. The type of a compressor is
+// stored with every block it compressed, so the block can be decompressed
+// by the compressor registered for that type.
+type Compressor interface {
+	Type() Type
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[Type]Compressor{}
+)
+
+// Register makes c the compressor used to decompress blocks of its type.
+// It panics if the type is None or already taken.
+func Register(c Compressor) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.Type() == None {
+		panic("compress: cannot register a compressor of type None")
+	}
+	if _, ok := registry[c.Type()]; ok {
+		panic(fmt.Sprintf("compress: type %d is already registered", c.Type()))
+	}
+	registry[c.Type()] = c
+}
+
+// Lookup returns the compressor registered for t.
+func Lookup(t Type) (Compressor, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := registry[t]
+	return c, ok
+}
+
+func init() {
+	Register(NewFlate(flate.DefaultCompression))
+	Register(NewZlib(zlib.DefaultCompression))
+}
+
+type flateCompressor struct {
+	level int
+}
+
+// NewFlate returns a compressor producing raw DEFLATE data at level, one of
+// the levels of compress/flate.
+func NewFlate(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+func (c *flateCompressor) Type() Type {
+	return Flate
+}
+
+func (c *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, fmt.Errorf("flate compress: %w", err)
+	}
+	return finish(&buf, w, src)
+}
+
+func (c *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("flate decompress: %w", err)
+	}
+	return out, nil
+}
+
+type zlibCompressor struct {
+	level int
+}
+
+// NewZlib returns a compressor producing zlib data at level, one of the
+// levels of compress/zlib.
+func NewZlib(level int) Compressor {
+	return &zlibCompressor{level: level}
+}
+
+func (c *zlibCompressor) Type() Type {
+	return Zlib
+}
+
+func (c *zlibCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, fmt.Errorf("zlib compress: %w", err)
+	}
+	return finish(&buf, w, src)
+}
+
+func (c *zlibCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("zlib decompress: %w", err)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("zlib decompress: %w", err)
+	}
+	return out, nil
+}
+
+func finish(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,47 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte(`{"name": "value", "count": 42}`), 100)
+	for _, c := range []Compressor{NewFlate(flate.BestSpeed), NewFlate(flate.BestCompression), NewZlib(flate.DefaultCompression)} {
+		compressed, err := c.Compress(src)
+		assert.NoError(t, err)
+		assert.Less(t, len(compressed), len(src)/10)
+
+		registered, ok := Lookup(c.Type())
+		assert.True(t, ok)
+		out, err := registered.Decompress(compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, src, out)
+
+		_, err = registered.Decompress(compressed[:len(compressed)/2])
+		assert.Error(t, err)
+	}
+}
+
+type fakeCompressor struct{}
+
+func (fakeCompressor) Type() Type                            { return 200 }
+func (fakeCompressor) Compress(src []byte) ([]byte, error)   { return src, nil }
+func (fakeCompressor) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+func TestRegister(t *testing.T) {
+	_, ok := Lookup(None)
+	assert.False(t, ok)
+	_, ok = Lookup(200)
+	assert.False(t, ok)
+
+	Register(fakeCompressor{})
+	c, ok := Lookup(200)
+	assert.True(t, ok)
+	assert.Equal(t, Type(200), c.Type())
+	assert.Panics(t, func() { Register(fakeCompressor{}) })
+	assert.Panics(t, func() { Register(NewFlate(flate.BestSpeed)) })
+}
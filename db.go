@@ -0,0 +1,119 @@
+package minilsm
+
+import (
+	"fmt"
+	"minilsm/cache"
+	"minilsm/iterator"
+)
+
+// DB is a key-value store kept in a directory. It is safe for concurrent
+// use.
+type DB struct {
+	si *StorageInner
+}
+
+// Open opens the store in dir, creating it if needed. A nil opts uses
+// DefaultOptions, and the zero fields of opts take their default values.
+// It returns an error matching ErrInvalidOptions if an option is out of
+// its range.
+func Open(dir string, opts *Options) (*DB, error) {
+	si, err := newStorageInner(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	return &DB{si: si}, nil
+}
+
+// Close stops the background work of the store and closes its files.
+func (db *DB) Close() {
+	db.si.Close()
+}
+
+// Get returns the latest value of key, or ErrKeyNotFound if the key was
+// never written or its latest entry is a tombstone. A key that could not
+// have been written, such as an empty one, is ErrInvalidKey.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.si.Get(key)
+}
+
+// GetAt returns the value key had right after the write with sequence number
+// seq. Versions overwritten before seq are only kept until compaction
+// garbage-collects them; use a Snapshot to keep them.
+func (db *DB) GetAt(key []byte, seq uint64) ([]byte, error) {
+	return db.si.GetAt(key, seq)
+}
+
+// LastSeq returns the sequence number of the latest write.
+func (db *DB) LastSeq() uint64 {
+	return db.si.LastSeq()
+}
+
+func (db *DB) Put(key, value []byte) error {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return db.si.Write(batch)
+}
+
+func (db *DB) Delete(key []byte) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return db.si.Write(batch)
+}
+
+// DeleteRange deletes every key in [start, end).
+func (db *DB) DeleteRange(start, end []byte) error {
+	batch := NewWriteBatch()
+	batch.DeleteRange(start, end)
+	return db.si.Write(batch)
+}
+
+// Write applies every write of batch, or none of them if it fails.
+func (db *DB) Write(batch *WriteBatch) error {
+	return db.si.Write(batch)
+}
+
+// Scan returns an iterator over the latest values of the keys in
+// [lower, upper]. Check Error once the iterator is no longer valid. The
+// iterator keeps the sstables it reads from on disk until it runs off
+// either end, fails or is closed, so Close an iterator not read to its end.
+func (db *DB) Scan(lower, upper []byte) (iterator.Iterator, error) {
+	return db.si.Scan(lower, upper)
+}
+
+// ScanAt is Scan as of right after the write with sequence number seq.
+func (db *DB) ScanAt(lower, upper []byte, seq uint64) (iterator.Iterator, error) {
+	return db.si.ScanAt(lower, upper, seq)
+}
+
+// ScanReverse is Scan from upper toward lower.
+func (db *DB) ScanReverse(lower, upper []byte) (iterator.Iterator, error) {
+	return db.si.ScanReverse(lower, upper)
+}
+
+// ScanWithOptions is Scan over the keys selected by opts.
+func (db *DB) ScanWithOptions(opts ScanOptions) (iterator.Iterator, error) {
+	return db.si.ScanWithOptions(opts)
+}
+
+// NewSnapshot takes a snapshot of the store as of the latest write. Release
+// it once done, so compaction can drop the data it keeps.
+func (db *DB) NewSnapshot() *Snapshot {
+	return db.si.NewSnapshot()
+}
+
+// Begin starts a transaction reading from the latest data.
+func (db *DB) Begin() *Txn {
+	return db.si.Begin()
+}
+
+// BlockCacheStats returns the hits and misses of the block cache and what it
+// holds.
+func (db *DB) BlockCacheStats() cache.Stats {
+	return db.si.BlockCacheStats()
+}
+
+// WriteStallStats returns how writes are throttled now and how they were so
+// far.
+func (db *DB) WriteStallStats() WriteStallStats {
+	return db.si.WriteStallStats()
+}
@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"encoding/binary"
+)
+
+// Policy builds filters over the keys of a table, which tell for a key
+// whether the table may contain it. A filter may answer true for a key that
+// is not in the table, but never false for one that is.
+type Policy interface {
+	// Name identifies the filter format. A filter is only ever queried by
+	// a policy of the same name as the one that built it.
+	Name() string
+	// NewFilter returns a filter over keys.
+	NewFilter(keys [][]byte) []byte
+	// MayContain reports whether key may be among the keys filter was
+	// built over.
+	MayContain(filter, key []byte) bool
+}
+
+type bloomPolicy struct {
+	bitsPerKey int
+	// k is the number of hash functions.
+	k int
+}
+
+// NewBloomPolicy returns a policy building bloom filters with bitsPerKey
+// bits per key. 10 bits per key gives a false positive rate of about 1%.
+func NewBloomPolicy(bitsPerKey int) Policy {
+	// ln(2) * bitsPerKey hash functions minimize the false positive rate
+	k := int(float64(bitsPerKey) * 0.69)
+	k = min(max(k, 1), 30)
+	return &bloomPolicy{bitsPerKey: bitsPerKey, k: k}
+}
+
+func (p *bloomPolicy) Name() string {
+	return "bloom"
+}
+
+// +--------+---+
+// |  bits  | k |
+// +--------+---+
+// | bytes  | 1 |
+// +--------+---+
+func (p *bloomPolicy) NewFilter(keys [][]byte) []byte {
+	// tiny filters have a high false positive rate, so use at least 64 bits
+	bits := max(len(keys)*p.bitsPerKey, 64)
+	nBytes := (bits + 7) / 8
+	bits = nBytes * 8
+
+	filter := make([]byte, nBytes+1)
+	filter[nBytes] = byte(p.k)
+	for _, key := range keys {
+		// double hashing derives the k hashes from a single one
+		h := hash(key)
+		delta := h>>17 | h<<15
+		for j := 0; j < p.k; j++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+func (p *bloomPolicy) MayContain(filter, key []byte) bool {
+	if len(filter) < 2 {
+		return false
+	}
+	nBytes := len(filter) - 1
+	bits := uint32(nBytes * 8)
+	k := filter[nBytes]
+	if k > 30 {
+		// reserved for other encodings, so treat it as a match
+		return true
+	}
+
+	h := hash(key)
+	delta := h>>17 | h<<15
+	for j := uint8(0); j < k; j++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// hash is the hash function of LevelDB, similar to murmur hash.
+func hash(data []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+		r    = 24
+	)
+	h := uint32(seed) ^ uint32(len(data))*m
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data)
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(data) {
+	case 3:
+		h += uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(data[0])
+		h *= m
+		h ^= h >> r
+	}
+	return h
+}
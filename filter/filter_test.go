@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloom_Empty(t *testing.T) {
+	p := NewBloomPolicy(10)
+	f := p.NewFilter(nil)
+	assert.False(t, p.MayContain(f, []byte("hello")))
+	assert.False(t, p.MayContain(nil, []byte("hello")))
+}
+
+func TestBloom_FalsePositiveRate(t *testing.T) {
+	p := NewBloomPolicy(10)
+	for _, n := range []int{1, 10, 100, 1000, 10000} {
+		t.Run(fmt.Sprintf("keys: %d", n), func(t *testing.T) {
+			keys := make([][]byte, 0, n)
+			for i := 0; i < n; i++ {
+				keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+			}
+			f := p.NewFilter(keys)
+			assert.LessOrEqual(t, len(f), n*10/8+8+1)
+			for _, key := range keys {
+				assert.True(t, p.MayContain(f, key))
+			}
+
+			const probes = 10000
+			falsePositives := 0
+			for i := 0; i < probes; i++ {
+				if p.MayContain(f, []byte(fmt.Sprintf("other-%d", i))) {
+					falsePositives++
+				}
+			}
+			assert.Less(t, float64(falsePositives)/probes, 0.02)
+		})
+	}
+}
+
+func TestBloom_BitsPerKey(t *testing.T) {
+	keys := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+	}
+	small, large := NewBloomPolicy(4), NewBloomPolicy(20)
+	smallFilter, largeFilter := small.NewFilter(keys), large.NewFilter(keys)
+	assert.Less(t, len(smallFilter), len(largeFilter))
+	for _, key := range keys {
+		assert.True(t, small.MayContain(smallFilter, key))
+		assert.True(t, large.MayContain(largeFilter, key))
+	}
+}
@@ -1,8 +1,28 @@
 package iterator
 
+// Iterator walks entries in key order, forward with Next and backward with
+// Prev. Below StorageInner, keys are internal keys as built by kv.MakeKey.
+//
+// An iterator that fails to read becomes invalid and reports why through
+// Error, so a loop ending on IsValid checks Error to tell a failure from
+// the end of the entries.
 type Iterator interface {
 	Key() []byte
 	Value() []byte
 	IsValid() bool
 	Next()
+	Prev()
+	// Seek moves to the first entry whose key is not less than key.
+	Seek(key []byte)
+	// SeekToFirst moves to the first entry.
+	SeekToFirst()
+	// SeekToLast moves to the last entry.
+	SeekToLast()
+	// SeekForPrev moves to the last entry whose key is not greater than key.
+	SeekForPrev(key []byte)
+	// Error returns the error that made the iterator invalid, if any.
+	Error() error
+	// Close releases the resources of the iterator, which must not be used
+	// afterwards.
+	Close() error
 }
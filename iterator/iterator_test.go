@@ -1,17 +1,26 @@
 package iterator
 
 import (
+	"errors"
+	"fmt"
+	"minilsm/kv"
+	"minilsm/rangedel"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// mockIterator yields internal keys with a sequence number of Seqs[i], or 0
+// when Seqs is nil. Entries with a nil value are tombstones.
 type mockIterator struct {
 	Data []struct {
 		K []byte
 		V []byte
 	}
+	Seqs  []uint64
 	Index int
+	// Err fails the iterator when set.
+	Err error
 }
 
 func newMockIterator(data []struct{ K, V []byte }) *mockIterator {
@@ -22,7 +31,15 @@ func newMockIterator(data []struct{ K, V []byte }) *mockIterator {
 }
 
 func (m *mockIterator) Key() []byte {
-	return m.Data[m.Index].K
+	var seq uint64
+	if m.Seqs != nil {
+		seq = m.Seqs[m.Index]
+	}
+	kind := kv.KindPut
+	if m.Data[m.Index].V == nil {
+		kind = kv.KindDelete
+	}
+	return kv.MakeKey(m.Data[m.Index].K, seq, kind)
 }
 
 func (m *mockIterator) Value() []byte {
@@ -33,8 +50,42 @@ func (m *mockIterator) Next() {
 	m.Index += 1
 }
 
+func (m *mockIterator) Prev() {
+	m.Index -= 1
+}
+
 func (m *mockIterator) IsValid() bool {
-	return m.Index < len(m.Data)
+	return m.Err == nil && m.Index >= 0 && m.Index < len(m.Data)
+}
+
+func (m *mockIterator) Seek(key []byte) {
+	m.Index = 0
+	for m.IsValid() && kv.Compare(m.Key(), key) < 0 {
+		m.Index++
+	}
+}
+
+func (m *mockIterator) Error() error {
+	return m.Err
+}
+
+func (m *mockIterator) Close() error {
+	return nil
+}
+
+func (m *mockIterator) SeekToFirst() {
+	m.Index = 0
+}
+
+func (m *mockIterator) SeekToLast() {
+	m.Index = len(m.Data) - 1
+}
+
+func (m *mockIterator) SeekForPrev(key []byte) {
+	m.Index = len(m.Data) - 1
+	for m.IsValid() && kv.Compare(m.Key(), key) > 0 {
+		m.Index--
+	}
 }
 
 var _ Iterator = (*mockIterator)(nil)
@@ -42,7 +93,7 @@ var _ Iterator = (*mockIterator)(nil)
 func checkIterResult(t *testing.T, iter Iterator, expected []struct{ K, V []byte }) {
 	for i := 0; i < len(expected); i++ {
 		assert.True(t, iter.IsValid())
-		assert.Equal(t, expected[i].K, iter.Key())
+		assert.Equal(t, expected[i].K, kv.UserKey(iter.Key()))
 		assert.Equal(t, expected[i].V, iter.Value())
 		iter.Next()
 	}
@@ -112,7 +163,7 @@ func TestMerge(t *testing.T) {
 		{[]byte("4"), []byte("4.c")},
 	})
 	t.Run("MergeIterator1", func(t *testing.T) {
-		checkIterResult(t, NewMergeIterator(i1, i2, i3), []struct{ K, V []byte }{
+		checkIterResult(t, NewMergeIterator(Source{i1, 0}, Source{i2, 1}, Source{i3, 2}), []struct{ K, V []byte }{
 			{[]byte("1"), []byte("1.a")},
 			{[]byte("2"), []byte("2.a")},
 			{[]byte("3"), []byte("3.a")},
@@ -125,11 +176,310 @@ func TestMerge(t *testing.T) {
 		})
 	})
 	t.Run("MergeIterator2", func(t *testing.T) {
-		checkIterResult(t, NewMergeIterator(i3, i2, i1), []struct{ K, V []byte }{
+		checkIterResult(t, NewMergeIterator(Source{i3, 0}, Source{i2, 1}, Source{i1, 2}), []struct{ K, V []byte }{
 			{[]byte("1"), []byte("1.b")},
 			{[]byte("2"), []byte("2.c")},
 			{[]byte("3"), []byte("3.c")},
 			{[]byte("4"), []byte("4.c")},
 		})
+		t.Cleanup(func() {
+			i1.Index = 0
+			i2.Index = 0
+			i3.Index = 0
+		})
+	})
+	t.Run("RankNotOrder", func(t *testing.T) {
+		// the rank, not the position of a source, decides which one wins
+		checkIterResult(t, NewMergeIterator(Source{i3, 2}, Source{i1, 0}, Source{i2, 1}), []struct{ K, V []byte }{
+			{[]byte("1"), []byte("1.a")},
+			{[]byte("2"), []byte("2.a")},
+			{[]byte("3"), []byte("3.a")},
+			{[]byte("4"), []byte("4.b")},
+		})
+	})
+}
+
+func TestMerge_ManySources(t *testing.T) {
+	// source i holds the keys that are multiples of i+1, so the newest
+	// source holding a key is the one of its smallest divisor
+	sources := make([]Source, 0, 40)
+	for i := 39; i >= 0; i-- {
+		entries := make([]struct{ K, V []byte }, 0)
+		for k := i + 1; k <= 200; k += i + 1 {
+			entries = append(entries, struct{ K, V []byte }{
+				[]byte(fmt.Sprintf("%03d", k)),
+				[]byte(fmt.Sprintf("%03d.%d", k, i)),
+			})
+		}
+		sources = append(sources, Source{newMockIterator(entries), i})
+	}
+	want := make([]struct{ K, V []byte }, 0, 200)
+	for k := 1; k <= 200; k++ {
+		want = append(want, struct{ K, V []byte }{
+			[]byte(fmt.Sprintf("%03d", k)),
+			[]byte(fmt.Sprintf("%03d.0", k)),
+		})
+	}
+	merged := NewMergeIterator(sources...)
+	checkIterResult(t, merged, want)
+	checkIterReverse(t, merged, want)
+}
+
+func TestMerge_Seek(t *testing.T) {
+	i1 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.a")},
+		{[]byte("3"), []byte("3.a")},
+	})
+	i2 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("2"), []byte("2.b")},
+		{[]byte("3"), []byte("3.b")},
+		{[]byte("4"), []byte("4.b")},
+	})
+	merged := NewTwoMerger(i1, i2)
+	merged.Seek(kv.MakeKey([]byte("2"), 0, kv.KindPut))
+	checkIterResult(t, merged, []struct{ K, V []byte }{
+		{[]byte("2"), []byte("2.b")},
+		{[]byte("3"), []byte("3.a")},
+		{[]byte("4"), []byte("4.b")},
+	})
+	assert.NoError(t, merged.Error())
+	assert.NoError(t, merged.Close())
+}
+
+func TestMerge_Error(t *testing.T) {
+	i1 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.a")},
+		{[]byte("3"), []byte("3.a")},
+	})
+	i2 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("2"), []byte("2.b")},
+		{[]byte("4"), []byte("4.b")},
+	})
+	merged := NewMergeIterator(Source{i1, 0}, Source{i2, 1})
+	user := NewUserIterator(merged, 0, nil, kv.Range{})
+	assert.Equal(t, []byte("1"), user.Key())
+	user.Next()
+	assert.Equal(t, []byte("2"), user.Key())
+	user.Next()
+	assert.Equal(t, []byte("3"), user.Key())
+
+	// the failure of one input ends the merge rather than skipping its keys
+	errRead := errors.New("read failed")
+	i1.Err = errRead
+	user.Next()
+	assert.False(t, user.IsValid())
+	assert.ErrorIs(t, merged.Error(), errRead)
+	assert.ErrorIs(t, user.Error(), errRead)
+
+	i1.Err = nil
+	user.SeekToFirst()
+	assert.NoError(t, user.Error())
+	assert.Equal(t, []byte("1"), user.Key())
+	user.Seek([]byte("3"))
+	assert.Equal(t, []byte("3"), user.Key())
+}
+
+func TestUser(t *testing.T) {
+	i1 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), nil},
+		{[]byte("2"), []byte("2.a")},
+		{[]byte("4"), nil},
+		{[]byte("5"), []byte("5.a")},
+	})
+	i1.Seqs = []uint64{5, 6, 7, 9}
+	i2 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.b")},
+		{[]byte("3"), nil},
+		{[]byte("4"), []byte("4.b")},
+		{[]byte("5"), []byte("5.b")},
 	})
+	i2.Seqs = []uint64{1, 2, 3, 4}
+
+	user := NewUserIterator(NewMergeIterator(Source{i1, 0}, Source{i2, 1}), 8, nil, kv.Range{})
+	for _, want := range []struct{ K, V []byte }{
+		{[]byte("2"), []byte("2.a")},
+		{[]byte("5"), []byte("5.b")},
+	} {
+		assert.True(t, user.IsValid())
+		assert.Equal(t, want.K, user.Key())
+		assert.Equal(t, want.V, user.Value())
+		user.Next()
+	}
+	assert.False(t, user.IsValid())
+
+	i1.Index, i2.Index = 0, 0
+	user = NewUserIterator(NewMergeIterator(Source{i1, 0}, Source{i2, 1}), 4, nil, kv.Range{})
+	for _, want := range []struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.b")},
+		{[]byte("4"), []byte("4.b")},
+		{[]byte("5"), []byte("5.b")},
+	} {
+		assert.True(t, user.IsValid())
+		assert.Equal(t, want.K, user.Key())
+		assert.Equal(t, want.V, user.Value())
+		user.Next()
+	}
+	assert.False(t, user.IsValid())
+}
+
+func TestUser_RangeTombstones(t *testing.T) {
+	i1 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.a")},
+		{[]byte("2"), []byte("2.a")},
+		{[]byte("3"), []byte("3.a")},
+		{[]byte("4"), []byte("4.a")},
+	})
+	i1.Seqs = []uint64{1, 6, 2, 3}
+	tombstones := []rangedel.Tombstone{{Start: []byte("2"), End: []byte("4"), Seq: 5}}
+	for _, tt := range []struct {
+		seq  uint64
+		want []struct{ K, V []byte }
+	}{
+		{4, []struct{ K, V []byte }{
+			{[]byte("1"), []byte("1.a")},
+			{[]byte("3"), []byte("3.a")},
+			{[]byte("4"), []byte("4.a")},
+		}},
+		{8, []struct{ K, V []byte }{
+			{[]byte("1"), []byte("1.a")},
+			{[]byte("2"), []byte("2.a")},
+			{[]byte("4"), []byte("4.a")},
+		}},
+	} {
+		i1.Index = 0
+		user := NewUserIterator(i1, tt.seq, rangedel.Fragment(tombstones, tt.seq), kv.Range{})
+		for _, want := range tt.want {
+			assert.True(t, user.IsValid())
+			assert.Equal(t, want.K, user.Key())
+			assert.Equal(t, want.V, user.Value())
+			user.Next()
+		}
+		assert.False(t, user.IsValid())
+	}
+}
+
+func checkIterReverse(t *testing.T, iter Iterator, expected []struct{ K, V []byte }) {
+	iter.SeekToLast()
+	for i := len(expected) - 1; i >= 0; i-- {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, expected[i].K, kv.UserKey(iter.Key()))
+		assert.Equal(t, expected[i].V, iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+}
+
+func TestMerge_Reverse(t *testing.T) {
+	i1 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.a")},
+		{[]byte("3"), []byte("3.a")},
+		{[]byte("5"), []byte("5.a")},
+	})
+	i2 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("2"), []byte("2.b")},
+		{[]byte("3"), []byte("3.b")},
+		{[]byte("6"), []byte("6.b")},
+	})
+	want := []struct{ K, V []byte }{
+		{[]byte("1"), []byte("1.a")},
+		{[]byte("2"), []byte("2.b")},
+		{[]byte("3"), []byte("3.a")},
+		{[]byte("5"), []byte("5.a")},
+		{[]byte("6"), []byte("6.b")},
+	}
+	merged := NewMergeIterator(Source{i1, 0}, Source{i2, 1})
+	checkIterReverse(t, merged, want)
+
+	// switch direction in the middle, including at a key both share
+	merged.SeekToFirst()
+	merged.Next()
+	merged.Next()
+	assert.Equal(t, []byte("3.a"), merged.Value())
+	merged.Prev()
+	assert.Equal(t, []byte("2.b"), merged.Value())
+	merged.Next()
+	assert.Equal(t, []byte("3.a"), merged.Value())
+	merged.Next()
+	assert.Equal(t, []byte("5.a"), merged.Value())
+	merged.Prev()
+	merged.Prev()
+	assert.Equal(t, []byte("2.b"), merged.Value())
+	merged.Prev()
+	merged.Prev()
+	assert.False(t, merged.IsValid())
+
+	merged.SeekForPrev(kv.MakeKey([]byte("4"), 0, kv.KindPut))
+	assert.Equal(t, []byte("3.a"), merged.Value())
+	merged.Next()
+	assert.Equal(t, []byte("5.a"), merged.Value())
+
+	checkIterReverse(t, NewTwoMerger(i1, i2), want)
+}
+
+func TestUser_Reverse(t *testing.T) {
+	i1 := newMockIterator([]struct{ K, V []byte }{
+		{[]byte("1"), nil},
+		{[]byte("1"), []byte("1.b")},
+		{[]byte("2"), []byte("2.a")},
+		{[]byte("3"), []byte("3.b")},
+		{[]byte("3"), []byte("3.a")},
+		{[]byte("4"), []byte("4.a")},
+		{[]byte("5"), []byte("5.a")},
+	})
+	i1.Seqs = []uint64{5, 1, 6, 8, 2, 3, 4}
+	tombstones := []rangedel.Tombstone{{Start: []byte("4"), End: []byte("5"), Seq: 7}}
+
+	user := NewUserIterator(i1, 7, rangedel.Fragment(tombstones, 7), kv.Range{})
+	user.SeekToLast()
+	for _, want := range []struct{ K, V []byte }{
+		{[]byte("5"), []byte("5.a")},
+		{[]byte("3"), []byte("3.a")},
+		{[]byte("2"), []byte("2.a")},
+	} {
+		assert.True(t, user.IsValid())
+		assert.Equal(t, want.K, user.Key())
+		assert.Equal(t, want.V, user.Value())
+		user.Prev()
+	}
+	assert.False(t, user.IsValid())
+
+	user.SeekForPrev([]byte("4"))
+	assert.Equal(t, []byte("3"), user.Key())
+	user.Next()
+	assert.Equal(t, []byte("5"), user.Key())
+	user.Prev()
+	assert.Equal(t, []byte("3"), user.Key())
+	user.Prev()
+	assert.Equal(t, []byte("2"), user.Key())
+	user.Next()
+	assert.Equal(t, []byte("3.a"), user.Value())
+
+	bounded := NewUserIterator(i1, 7, nil, kv.Range{Lower: []byte("2"), Upper: []byte("4")})
+	bounded.SeekToLast()
+	for _, want := range []string{"4", "3", "2"} {
+		assert.Equal(t, []byte(want), bounded.Key())
+		bounded.Prev()
+	}
+	assert.False(t, bounded.IsValid())
+	bounded.SeekToFirst()
+	for _, want := range []string{"2", "3", "4"} {
+		assert.Equal(t, []byte(want), bounded.Key())
+		bounded.Next()
+	}
+	assert.False(t, bounded.IsValid())
+
+	exclusive := kv.Range{Lower: []byte("2"), LowerExclusive: true, Upper: []byte("5"), UpperExclusive: true}
+	bounded = NewUserIterator(i1, 7, nil, exclusive)
+	bounded.SeekToFirst()
+	for _, want := range []string{"3", "4"} {
+		assert.Equal(t, []byte(want), bounded.Key())
+		bounded.Next()
+	}
+	assert.False(t, bounded.IsValid())
+	bounded.SeekToLast()
+	assert.Equal(t, []byte("4"), bounded.Key())
+	bounded.SeekForPrev([]byte("9"))
+	assert.Equal(t, []byte("4"), bounded.Key())
+	bounded.Seek([]byte("0"))
+	assert.Equal(t, []byte("3"), bounded.Key())
 }
@@ -2,51 +2,115 @@ package iterator
 
 import (
 	"bytes"
+	"container/heap"
+	"errors"
+	"minilsm/kv"
 	"minilsm/util"
 )
 
+// Source is an iterator merged by a MergeIterator. Rank orders the sources
+// by age: at the same key, the entry of the source of the smallest rank,
+// the newest, wins.
+type Source struct {
+	Iter Iterator
+	Rank int
+}
+
+// MergeIterator merges iterators into one stream in key order. When several
+// of them are at the same key, the one of the smallest rank wins and the
+// others skip it. The valid iterators are kept in a heap ordered by key and
+// rank, so a step costs O(log n) in the number of them.
+// It stops at the first error of any of them, since going on without the
+// entries of one would yield a wrong result.
 type MergeIterator struct {
-	iterators []Iterator
-	currrent  int
+	sources []Source
+	heap    mergeHeap
+	err     error
 }
 
-func NewMergeIterator(in ...Iterator) *MergeIterator {
-	if len(in) == 0 {
-		return &MergeIterator{
-			iterators: in,
-			currrent:  -1,
-		}
+// NewMergeIterator merges sources, positioned at their first keys.
+func NewMergeIterator(sources ...Source) *MergeIterator {
+	m := &MergeIterator{sources: sources}
+	m.heap.items = make([]Source, 0, len(sources))
+	m.rebuild()
+	return m
+}
+
+// mergeHeap orders the valid sources by key, ascending or, when reverse is
+// true, descending, and then by rank. reverse is true while moving with
+// Prev. Every source then sits at its last key not greater than the
+// current key, instead of its first key not less than it.
+type mergeHeap struct {
+	items   []Source
+	reverse bool
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	c := kv.Compare(a.Iter.Key(), b.Iter.Key())
+	if h.reverse {
+		c = -c
 	}
-	iterators := make([]Iterator, 0)
-	for _, in := range in {
-		if in.IsValid() {
-			iterators = append(iterators, in)
-		}
+	if c != 0 {
+		return c < 0
 	}
-	if len(iterators) == 0 {
-		return &MergeIterator{
-			iterators: in,
-			currrent:  -1,
+	return a.Rank < b.Rank
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.items = append(h.items, x.(Source))
+}
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.items)
+	s := h.items[n-1]
+	h.items = h.items[:n-1]
+	return s
+}
+
+// rebuild records the first error of the sources and heaps the valid ones,
+// after all of them moved.
+func (m *MergeIterator) rebuild() {
+	m.err = nil
+	m.heap.items = m.heap.items[:0]
+	for _, s := range m.sources {
+		if err := s.Iter.Error(); err != nil {
+			if m.err == nil {
+				m.err = err
+			}
+			continue
+		}
+		if s.Iter.IsValid() {
+			m.heap.items = append(m.heap.items, s)
 		}
 	}
-	return &MergeIterator{
-		iterators: iterators,
-		currrent:  minIter(iterators),
-	}
+	heap.Init(&m.heap)
 }
 
-func minIter(iterators []Iterator) int {
-	min := 0
-	for i, it := range iterators {
-		if bytes.Compare(it.Key(), iterators[min].Key()) < 0 {
-			min = i
-		}
+// fixTop restores the heap after its top source moved, dropping it if it
+// is no longer valid.
+func (m *MergeIterator) fixTop() {
+	top := m.heap.items[0].Iter
+	if err := top.Error(); err != nil && m.err == nil {
+		m.err = err
+	}
+	if top.IsValid() {
+		heap.Fix(&m.heap, 0)
+	} else {
+		heap.Pop(&m.heap)
 	}
-	return min
 }
 
 func (m *MergeIterator) currentIter() Iterator {
-	return m.iterators[m.currrent]
+	return m.heap.items[0].Iter
 }
 
 func (m *MergeIterator) Key() []byte {
@@ -58,33 +122,115 @@ func (m *MergeIterator) Value() []byte {
 }
 
 func (m *MergeIterator) IsValid() bool {
-	return m.currrent >= 0 && m.currrent < len(m.iterators) && m.currentIter().IsValid()
+	return m.err == nil && m.heap.Len() > 0
 }
 
-// Next skip all same key in iters
+// Next skips the current key in every source.
 func (m *MergeIterator) Next() {
+	if !m.IsValid() {
+		return
+	}
+	if m.heap.reverse {
+		m.switchForward()
+	}
 	currentKey := util.DeepCopySlice(m.Key())
+	for m.err == nil && m.heap.Len() > 0 && bytes.Equal(m.Key(), currentKey) {
+		m.currentIter().Next()
+		m.fixTop()
+	}
+}
 
-	m.currentIter().Next()
-	if !m.currentIter().IsValid() { // currrent iter has no elements
-		m.iterators = append(m.iterators[:m.currrent], m.iterators[m.currrent+1:]...)
+// Prev skips the current key in every source.
+func (m *MergeIterator) Prev() {
+	if !m.IsValid() {
+		return
 	}
+	if !m.heap.reverse {
+		m.switchReverse()
+	}
+	currentKey := util.DeepCopySlice(m.Key())
+	for m.err == nil && m.heap.Len() > 0 && bytes.Equal(m.Key(), currentKey) {
+		m.currentIter().Prev()
+		m.fixTop()
+	}
+}
 
-	// remove all duplicate keys
-	for i := 0; i < len(m.iterators); i++ {
-		for m.iterators[i].IsValid() && bytes.Equal(m.iterators[i].Key(), currentKey) {
-			m.iterators[i].Next()
+// switchReverse moves the other sources from their first key not less
+// than the current key to their last key not greater than it.
+func (m *MergeIterator) switchReverse() {
+	m.reposition(func(it Iterator, key []byte) {
+		it.SeekForPrev(key)
+	})
+	m.heap.reverse = true
+	m.rebuild()
+}
+
+// switchForward moves the other sources from their last key not greater
+// than the current key to their first key not less than it.
+func (m *MergeIterator) switchForward() {
+	m.reposition(func(it Iterator, key []byte) {
+		it.Seek(key)
+	})
+	m.heap.reverse = false
+	m.rebuild()
+}
+
+// reposition seeks every source but the current one to the current key.
+func (m *MergeIterator) reposition(seek func(it Iterator, key []byte)) {
+	current := m.currentIter()
+	currentKey := util.DeepCopySlice(m.Key())
+	for _, s := range m.sources {
+		if s.Iter != current {
+			seek(s.Iter, currentKey)
 		}
 	}
+}
 
-	// remove invalid iter
-	i := len(m.iterators) - 1
-	for i >= 0 {
-		if !m.iterators[i].IsValid() {
-			m.iterators = append(m.iterators[:i], m.iterators[i+1:]...)
-		}
-		i--
+func (m *MergeIterator) Seek(key []byte) {
+	for _, s := range m.sources {
+		s.Iter.Seek(key)
+	}
+	m.heap.reverse = false
+	m.rebuild()
+}
+
+func (m *MergeIterator) SeekToFirst() {
+	for _, s := range m.sources {
+		s.Iter.SeekToFirst()
 	}
+	m.heap.reverse = false
+	m.rebuild()
+}
 
-	m.currrent = minIter(m.iterators)
+func (m *MergeIterator) SeekToLast() {
+	for _, s := range m.sources {
+		s.Iter.SeekToLast()
+	}
+	m.heap.reverse = true
+	m.rebuild()
 }
+
+func (m *MergeIterator) SeekForPrev(key []byte) {
+	for _, s := range m.sources {
+		s.Iter.SeekForPrev(key)
+	}
+	m.heap.reverse = true
+	m.rebuild()
+}
+
+func (m *MergeIterator) Error() error {
+	return m.err
+}
+
+// Close closes every merged iterator.
+func (m *MergeIterator) Close() error {
+	errs := make([]error, 0)
+	for _, s := range m.sources {
+		if err := s.Iter.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var _ Iterator = (*MergeIterator)(nil)
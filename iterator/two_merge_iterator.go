@@ -1,72 +1,17 @@
 package iterator
 
-import (
-	"bytes"
-)
-
+// TwoMergeIterator merges A and B, taking the entry of A when both are at
+// the same key.
 type TwoMergeIterator struct {
-	A       Iterator
-	B       Iterator
-	chooseA bool
+	*MergeIterator
+	A Iterator
+	B Iterator
 }
 
 func NewTwoMerger(a, b Iterator) *TwoMergeIterator {
-	iter := &TwoMergeIterator{
-		A: a,
-		B: b,
-	}
-	iter.skipB()
-	iter.choose()
-	return iter
-}
-
-func (t *TwoMergeIterator) skipB() {
-	if t.A.IsValid() {
-		for t.B.IsValid() && bytes.Equal(t.A.Key(), t.B.Key()) {
-			t.B.Next()
-		}
-	}
-}
-
-func (t *TwoMergeIterator) choose() {
-	if !t.A.IsValid() {
-		t.chooseA = false
-		return
-	}
-	if !t.B.IsValid() {
-		t.chooseA = true
-		return
-	}
-	t.chooseA = bytes.Compare(t.A.Key(), t.B.Key()) < 0
-}
-
-func (t *TwoMergeIterator) Key() []byte {
-	if t.chooseA {
-		return t.A.Key()
-	}
-	return t.B.Key()
-}
-
-func (t *TwoMergeIterator) Value() []byte {
-	if t.chooseA {
-		return t.A.Value()
-	}
-	return t.B.Value()
-}
-
-func (t *TwoMergeIterator) IsValid() bool {
-	if t.chooseA {
-		return t.A.IsValid()
-	}
-	return t.B.IsValid()
-}
-
-func (t *TwoMergeIterator) Next() {
-	if t.chooseA {
-		t.A.Next()
-	} else {
-		t.B.Next()
+	return &TwoMergeIterator{
+		MergeIterator: NewMergeIterator(Source{Iter: a, Rank: 0}, Source{Iter: b, Rank: 1}),
+		A:             a,
+		B:             b,
 	}
-	t.skipB()
-	t.choose()
 }
@@ -0,0 +1,195 @@
+package iterator
+
+import (
+	"bytes"
+	"minilsm/kv"
+	"minilsm/rangedel"
+	"minilsm/util"
+)
+
+// UserIterator turns a merged stream of internal keys into what a reader at
+// sequence number seq sees: the newest version of every user key not newer
+// than seq, with deleted keys left out. A key is also deleted when its
+// newest version is older than a range tombstone over it. Its keys are user
+// keys in a kv.Range.
+type UserIterator struct {
+	iter       Iterator
+	seq        uint64
+	tombstones *rangedel.Fragments
+	// start and end are the internal keys [start, end) of the range, where
+	// nil leaves that side open.
+	start []byte
+	end   []byte
+	key   []byte
+	value []byte
+	// reverse is true while moving with Prev. iter is then before every
+	// version of key rather than at its newest visible one.
+	reverse bool
+}
+
+// NewUserIterator returns a UserIterator over iter, starting from where iter
+// is. tombstones are the range tombstones visible at seq, or nil if there
+// are none. r bounds the keys of the iterator.
+func NewUserIterator(iter Iterator, seq uint64, tombstones *rangedel.Fragments, r kv.Range) *UserIterator {
+	u := &UserIterator{iter: iter, seq: seq, tombstones: tombstones, start: r.Start(), end: r.End()}
+	u.findVisible()
+	return u
+}
+
+// findVisible moves to the newest visible version of the next user key
+// that was not deleted.
+func (u *UserIterator) findVisible() {
+	for u.iter.IsValid() {
+		key := u.iter.Key()
+		if u.end != nil && kv.Compare(key, u.end) >= 0 {
+			break
+		}
+		if kv.Seq(key) > u.seq {
+			u.iter.Next()
+			continue
+		}
+		if kv.KindOf(key) == kv.KindPut && !u.tombstones.Covers(kv.UserKey(key), kv.Seq(key)) {
+			u.key = util.DeepCopySlice(kv.UserKey(key))
+			u.value = u.iter.Value()
+			return
+		}
+		u.skipVersions(kv.UserKey(key))
+	}
+	u.key, u.value = nil, nil
+}
+
+// findPrevVisible moves to the newest visible version of the previous user
+// key that was not deleted. Moving backward meets the versions of a user key
+// from the oldest to the newest, so it walks past all of them to find the
+// newest visible one.
+func (u *UserIterator) findPrevVisible() {
+	for u.iter.IsValid() {
+		if u.start != nil && kv.Compare(u.iter.Key(), u.start) < 0 {
+			break
+		}
+		userKey := util.DeepCopySlice(kv.UserKey(u.iter.Key()))
+		var newest, value []byte
+		for u.iter.IsValid() && bytes.Equal(kv.UserKey(u.iter.Key()), userKey) {
+			if key := u.iter.Key(); kv.Seq(key) <= u.seq {
+				newest, value = util.DeepCopySlice(key), u.iter.Value()
+			}
+			u.iter.Prev()
+		}
+		if newest != nil && kv.KindOf(newest) == kv.KindPut && !u.tombstones.Covers(userKey, kv.Seq(newest)) {
+			u.key, u.value = userKey, value
+			return
+		}
+	}
+	u.key, u.value = nil, nil
+}
+
+// skipVersions moves past every version of userKey.
+func (u *UserIterator) skipVersions(userKey []byte) {
+	userKey = util.DeepCopySlice(userKey)
+	for u.iter.IsValid() && bytes.Equal(kv.UserKey(u.iter.Key()), userKey) {
+		u.iter.Next()
+	}
+}
+
+func (u *UserIterator) Key() []byte {
+	return u.key
+}
+
+func (u *UserIterator) Value() []byte {
+	return u.value
+}
+
+func (u *UserIterator) IsValid() bool {
+	return u.key != nil
+}
+
+func (u *UserIterator) Next() {
+	if u.reverse {
+		// from before every version of key back to the first of them
+		u.iter.Seek(firstKey(u.key))
+		u.reverse = false
+	}
+	u.skipVersions(u.key)
+	u.findVisible()
+}
+
+func (u *UserIterator) Prev() {
+	if !u.reverse {
+		u.iter.SeekForPrev(firstKey(u.key))
+		u.reverse = true
+	}
+	u.findPrevVisible()
+}
+
+// Seek moves to the first user key not less than key.
+func (u *UserIterator) Seek(key []byte) {
+	u.seek(firstKey(key))
+}
+
+func (u *UserIterator) seek(internalKey []byte) {
+	if u.start != nil && kv.Compare(internalKey, u.start) < 0 {
+		internalKey = u.start
+	}
+	u.reverse = false
+	u.iter.Seek(internalKey)
+	u.findVisible()
+}
+
+func (u *UserIterator) SeekToFirst() {
+	if u.start != nil {
+		u.seek(u.start)
+		return
+	}
+	u.reverse = false
+	u.iter.SeekToFirst()
+	u.findVisible()
+}
+
+func (u *UserIterator) SeekToLast() {
+	if u.end != nil {
+		// no entry has the key end
+		u.seekForPrev(u.end)
+		return
+	}
+	u.reverse = true
+	u.iter.SeekToLast()
+	u.findPrevVisible()
+}
+
+// SeekForPrev moves to the last user key not greater than key.
+func (u *UserIterator) SeekForPrev(key []byte) {
+	u.seekForPrev(lastKey(key))
+}
+
+func (u *UserIterator) seekForPrev(internalKey []byte) {
+	if u.end != nil && kv.Compare(internalKey, u.end) > 0 {
+		internalKey = u.end
+	}
+	u.reverse = true
+	u.iter.SeekForPrev(internalKey)
+	u.findPrevVisible()
+}
+
+// Error returns the error that stopped the merged stream, if any.
+func (u *UserIterator) Error() error {
+	return u.iter.Error()
+}
+
+func (u *UserIterator) Close() error {
+	u.key, u.value = nil, nil
+	return u.iter.Close()
+}
+
+// firstKey returns the smallest internal key of userKey, which is before
+// every version of it.
+func firstKey(userKey []byte) []byte {
+	return kv.MakeSeekKey(userKey, kv.MaxSeq)
+}
+
+// lastKey returns the largest internal key of userKey, which is after every
+// version of it.
+func lastKey(userKey []byte) []byte {
+	return kv.MakeKey(userKey, 0, kv.KindDelete)
+}
+
+var _ Iterator = (*UserIterator)(nil)
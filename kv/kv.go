@@ -0,0 +1,202 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Kind tells a put apart from a delete, whose tombstone hides older values
+// of the key.
+type Kind uint8
+
+const (
+	KindDelete Kind = iota
+	KindPut
+	// KindRangeDelete marks a range tombstone, whose internal key holds the
+	// start of the range and whose value the exclusive end.
+	KindRangeDelete
+
+	// kindForSeek is the largest Kind, so an internal key built with it
+	// sorts before every other entry of the same user key and sequence
+	// number.
+	kindForSeek = KindRangeDelete
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindDelete:
+		return "delete"
+	case KindPut:
+		return "put"
+	case KindRangeDelete:
+		return "range delete"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// TrailerSize is the number of bytes an internal key adds to a user key.
+	TrailerSize = 8
+	// MaxSeq is the largest sequence number that fits the trailer.
+	MaxSeq = 1<<56 - 1
+)
+
+// An internal key is a user key followed by a trailer holding the sequence
+// number of the write and its Kind:
+//
+// +----------+--------------------+
+// | user key | seq << 8 | kind    |
+// +----------+--------------------+
+// |  bytes   | uint64 (little end)|
+// +----------+--------------------+
+//
+// Internal keys sort by user key ascending and then by sequence number
+// descending, so the newest version of a key comes first.
+func MakeKey(userKey []byte, seq uint64, kind Kind) []byte {
+	key := make([]byte, len(userKey)+TrailerSize)
+	copy(key, userKey)
+	binary.LittleEndian.PutUint64(key[len(userKey):], seq<<8|uint64(kind))
+	return key
+}
+
+// MakeSeekKey returns the internal key that sorts before every version of
+// userKey visible at seq, that is, every version with a sequence number not
+// greater than seq.
+func MakeSeekKey(userKey []byte, seq uint64) []byte {
+	return MakeKey(userKey, seq, kindForSeek)
+}
+
+// MakeSentinelKey returns the internal key that sorts before every version
+// of userKey. As the largest key of a table it stands for the exclusive end
+// of a range tombstone, so the table does not cover userKey itself.
+func MakeSentinelKey(userKey []byte) []byte {
+	return MakeKey(userKey, MaxSeq, KindRangeDelete)
+}
+
+// IsSentinelKey reports whether key was built by MakeSentinelKey.
+func IsSentinelKey(key []byte) bool {
+	return trailer(key) == MaxSeq<<8|uint64(KindRangeDelete)
+}
+
+func UserKey(key []byte) []byte {
+	return key[:len(key)-TrailerSize]
+}
+
+func trailer(key []byte) uint64 {
+	return binary.LittleEndian.Uint64(key[len(key)-TrailerSize:])
+}
+
+func Seq(key []byte) uint64 {
+	return trailer(key) >> 8
+}
+
+func KindOf(key []byte) Kind {
+	return Kind(trailer(key) & 0xff)
+}
+
+// Compare orders internal keys by user key ascending and then by sequence
+// number and kind descending.
+func Compare(a, b []byte) int {
+	if c := bytes.Compare(UserKey(a), UserKey(b)); c != 0 {
+		return c
+	}
+	ta, tb := trailer(a), trailer(b)
+	switch {
+	case ta > tb:
+		return -1
+	case ta < tb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Range is a range of user keys whose bounds are each inclusive or
+// exclusive. A nil bound leaves that side of the range open.
+type Range struct {
+	Lower          []byte
+	LowerExclusive bool
+	Upper          []byte
+	UpperExclusive bool
+}
+
+// PrefixRange returns the range of the user keys starting with prefix.
+func PrefixRange(prefix []byte) Range {
+	r := Range{Lower: prefix}
+	// the upper bound is the first key past the prefix: drop its trailing
+	// 0xff bytes and increment the last byte left
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			r.Upper = append(bytes.Clone(prefix[:i]), prefix[i]+1)
+			r.UpperExclusive = true
+			break
+		}
+	}
+	return r
+}
+
+// Contains reports whether userKey is in r.
+func (r Range) Contains(userKey []byte) bool {
+	if r.Lower != nil {
+		if c := bytes.Compare(userKey, r.Lower); c < 0 || c == 0 && r.LowerExclusive {
+			return false
+		}
+	}
+	if r.Upper != nil {
+		if c := bytes.Compare(userKey, r.Upper); c > 0 || c == 0 && r.UpperExclusive {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect returns the user keys in both r and o.
+func (r Range) Intersect(o Range) Range {
+	res := r
+	if o.Lower != nil {
+		c := bytes.Compare(o.Lower, r.Lower)
+		if r.Lower == nil || c > 0 {
+			res.Lower, res.LowerExclusive = o.Lower, o.LowerExclusive
+		} else if c == 0 {
+			res.LowerExclusive = r.LowerExclusive || o.LowerExclusive
+		}
+	}
+	if o.Upper != nil {
+		c := bytes.Compare(o.Upper, r.Upper)
+		if r.Upper == nil || c < 0 {
+			res.Upper, res.UpperExclusive = o.Upper, o.UpperExclusive
+		} else if c == 0 {
+			res.UpperExclusive = r.UpperExclusive || o.UpperExclusive
+		}
+	}
+	return res
+}
+
+// Start returns the smallest internal key of the user keys in r, or nil if
+// r has no lower bound.
+func (r Range) Start() []byte {
+	switch {
+	case r.Lower == nil:
+		return nil
+	case r.LowerExclusive:
+		// the user key right after Lower
+		return MakeSeekKey(append(bytes.Clone(r.Lower), 0), MaxSeq)
+	default:
+		return MakeSeekKey(r.Lower, MaxSeq)
+	}
+}
+
+// End returns the smallest internal key of the user keys past r, or nil if
+// r has no upper bound. No entry has this key, so the internal keys of r
+// are those in [Start, End).
+func (r Range) End() []byte {
+	switch {
+	case r.Upper == nil:
+		return nil
+	case r.UpperExclusive:
+		return MakeSeekKey(r.Upper, MaxSeq)
+	default:
+		return MakeSeekKey(append(bytes.Clone(r.Upper), 0), MaxSeq)
+	}
+}
@@ -0,0 +1,80 @@
+package kv
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeKey(t *testing.T) {
+	key := MakeKey([]byte("key"), 42, KindDelete)
+	assert.Equal(t, []byte("key"), UserKey(key))
+	assert.Equal(t, uint64(42), Seq(key))
+	assert.Equal(t, KindDelete, KindOf(key))
+}
+
+func TestCompare(t *testing.T) {
+	keys := [][]byte{
+		MakeKey([]byte("b"), 1, KindPut),
+		MakeKey([]byte("a"), 1, KindPut),
+		MakeKey([]byte("ab"), 3, KindPut),
+		MakeKey([]byte("a"), 2, KindDelete),
+		MakeKey([]byte("ab"), 1, KindPut),
+	}
+	slices.SortFunc(keys, Compare)
+	assert.Equal(t, [][]byte{
+		MakeKey([]byte("a"), 2, KindDelete),
+		MakeKey([]byte("a"), 1, KindPut),
+		MakeKey([]byte("ab"), 3, KindPut),
+		MakeKey([]byte("ab"), 1, KindPut),
+		MakeKey([]byte("b"), 1, KindPut),
+	}, keys)
+
+	// a seek key sorts before the versions visible at its sequence number
+	assert.Equal(t, 1, Compare(MakeSeekKey([]byte("a"), 1), keys[0]))
+	assert.LessOrEqual(t, Compare(MakeSeekKey([]byte("a"), 1), keys[1]), 0)
+}
+
+func TestRange(t *testing.T) {
+	for _, tt := range []struct {
+		r   Range
+		in  []string
+		out []string
+	}{
+		{Range{Lower: []byte("b"), Upper: []byte("d")}, []string{"b", "c", "d"}, []string{"a", "d0"}},
+		{Range{Lower: []byte("b"), LowerExclusive: true, Upper: []byte("d"), UpperExclusive: true}, []string{"b0", "c"}, []string{"b", "d"}},
+		{Range{Upper: []byte("b")}, []string{"", "a", "b"}, []string{"b0"}},
+		{PrefixRange([]byte("ab")), []string{"ab", "ab\xff"}, []string{"aa", "ac", "b"}},
+		{PrefixRange([]byte("a\xff")), []string{"a\xff", "a\xff\xff"}, []string{"a", "b"}},
+		{PrefixRange([]byte("\xff")), []string{"\xff", "\xff\xff"}, []string{"a"}},
+	} {
+		for _, key := range tt.in {
+			assert.True(t, tt.r.Contains([]byte(key)), "%q", key)
+			internal := MakeKey([]byte(key), 1, KindPut)
+			if start := tt.r.Start(); start != nil {
+				assert.GreaterOrEqual(t, Compare(internal, start), 0, "%q", key)
+			}
+			if end := tt.r.End(); end != nil {
+				assert.Less(t, Compare(internal, end), 0, "%q", key)
+			}
+		}
+		for _, key := range tt.out {
+			assert.False(t, tt.r.Contains([]byte(key)), "%q", key)
+			internal := MakeKey([]byte(key), 1, KindPut)
+			start, end := tt.r.Start(), tt.r.End()
+			assert.True(t, start != nil && Compare(internal, start) < 0 || end != nil && Compare(internal, end) >= 0, "%q", key)
+		}
+	}
+}
+
+func TestRange_Intersect(t *testing.T) {
+	r := Range{Lower: []byte("b"), Upper: []byte("m")}.Intersect(PrefixRange([]byte("c")))
+	assert.Equal(t, Range{Lower: []byte("c"), Upper: []byte("d"), UpperExclusive: true}, r)
+
+	r = Range{Lower: []byte("b"), LowerExclusive: true}.Intersect(Range{Lower: []byte("b"), Upper: []byte("c")})
+	assert.Equal(t, Range{Lower: []byte("b"), LowerExclusive: true, Upper: []byte("c")}, r)
+
+	r = Range{Upper: []byte("c")}.Intersect(Range{Upper: []byte("c"), UpperExclusive: true})
+	assert.Equal(t, Range{Upper: []byte("c"), UpperExclusive: true}, r)
+}
@@ -19,3 +19,10 @@ func GetLogger() *zap.SugaredLogger {
 	}
 	return log
 }
+
+// Logger receives the messages of a store. *zap.SugaredLogger implements
+// it.
+type Logger interface {
+	Infof(template string, args ...any)
+	Errorf(template string, args ...any)
+}
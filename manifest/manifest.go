@@ -0,0 +1,376 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"minilsm/wal"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	currentFileName      = "CURRENT"
+	manifestFilePrefix   = "MANIFEST-"
+	currentTempFileName  = currentFileName + ".tmp"
+	manifestNumberFormat = "%06d"
+)
+
+// TableRef names an sstable and the level it lives in. Level 0 is L0,
+// level i > 0 is StorageInner.levels[i-1].
+type TableRef struct {
+	Level uint32
+	ID    uint32
+}
+
+// Edit is an atomic change to the set of live sstables.
+type Edit struct {
+	NextFileID uint32
+	// LastSeq is a sequence number not less than that of any write in the
+	// live sstables.
+	LastSeq uint64
+	Added   []TableRef
+	Deleted []TableRef
+}
+
+const (
+	tagNextFileID byte = iota + 1
+	tagAdded
+	tagDeleted
+	tagLastSeq
+)
+
+// +-----+---------+-----+---------+-----+
+// | tag | payload | tag | payload | ... |
+// +-----+---------+-----+---------+-----+
+// | u8  | uvarint | u8  | uvarint | ... |
+// +-----+---------+-----+---------+-----+
+func (e *Edit) encode() []byte {
+	buf := make([]byte, 0)
+	if e.NextFileID != 0 {
+		buf = append(buf, tagNextFileID)
+		buf = binary.AppendUvarint(buf, uint64(e.NextFileID))
+	}
+	if e.LastSeq != 0 {
+		buf = append(buf, tagLastSeq)
+		buf = binary.AppendUvarint(buf, e.LastSeq)
+	}
+	for _, ref := range e.Added {
+		buf = append(buf, tagAdded)
+		buf = binary.AppendUvarint(buf, uint64(ref.Level))
+		buf = binary.AppendUvarint(buf, uint64(ref.ID))
+	}
+	for _, ref := range e.Deleted {
+		buf = append(buf, tagDeleted)
+		buf = binary.AppendUvarint(buf, uint64(ref.Level))
+		buf = binary.AppendUvarint(buf, uint64(ref.ID))
+	}
+	return buf
+}
+
+var errInvalidEdit = errors.New("invalid manifest edit")
+
+func decodeEdit(raw []byte) (*Edit, error) {
+	e := &Edit{}
+	readUvarint64 := func() (uint64, error) {
+		v, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return 0, errInvalidEdit
+		}
+		raw = raw[n:]
+		return v, nil
+	}
+	readUvarint := func() (uint32, error) {
+		v, err := readUvarint64()
+		return uint32(v), err
+	}
+	for len(raw) > 0 {
+		tag := raw[0]
+		raw = raw[1:]
+		switch tag {
+		case tagNextFileID:
+			id, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			e.NextFileID = id
+		case tagLastSeq:
+			seq, err := readUvarint64()
+			if err != nil {
+				return nil, err
+			}
+			e.LastSeq = seq
+		case tagAdded, tagDeleted:
+			level, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			id, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			if tag == tagAdded {
+				e.Added = append(e.Added, TableRef{Level: level, ID: id})
+			} else {
+				e.Deleted = append(e.Deleted, TableRef{Level: level, ID: id})
+			}
+		default:
+			return nil, errInvalidEdit
+		}
+	}
+	return e, nil
+}
+
+// State is the set of live sstables recorded by the manifest.
+type State struct {
+	// L0 is ordered from newest to oldest.
+	L0 []uint32
+	// Levels[i] holds the IDs of level i+1 in no particular order.
+	Levels     [][]uint32
+	NextFileID uint32
+	LastSeq    uint64
+}
+
+// Apply applies e to s. Tables added to L0 take the place of the first L0
+// table deleted by the same edit, or become the newest L0 tables otherwise.
+func (s *State) Apply(e *Edit) {
+	if e.NextFileID > s.NextFileID {
+		s.NextFileID = e.NextFileID
+	}
+	if e.LastSeq > s.LastSeq {
+		s.LastSeq = e.LastSeq
+	}
+
+	insertAt := -1
+	for _, ref := range e.Deleted {
+		if ref.Level == 0 {
+			idx := indexOf(s.L0, ref.ID)
+			if idx < 0 {
+				continue
+			}
+			if insertAt < 0 || idx < insertAt {
+				insertAt = idx
+			}
+			s.L0 = append(s.L0[:idx], s.L0[idx+1:]...)
+			continue
+		}
+		if int(ref.Level) <= len(s.Levels) {
+			ids := s.Levels[ref.Level-1]
+			if idx := indexOf(ids, ref.ID); idx >= 0 {
+				s.Levels[ref.Level-1] = append(ids[:idx], ids[idx+1:]...)
+			}
+		}
+	}
+
+	addedL0 := make([]uint32, 0)
+	for _, ref := range e.Added {
+		if ref.Level == 0 {
+			addedL0 = append(addedL0, ref.ID)
+			continue
+		}
+		for int(ref.Level) > len(s.Levels) {
+			s.Levels = append(s.Levels, make([]uint32, 0))
+		}
+		s.Levels[ref.Level-1] = append(s.Levels[ref.Level-1], ref.ID)
+	}
+	if insertAt < 0 {
+		insertAt = 0
+	}
+	s.L0 = append(s.L0[:insertAt], append(addedL0, s.L0[insertAt:]...)...)
+}
+
+func (s *State) snapshot() *Edit {
+	e := &Edit{NextFileID: s.NextFileID, LastSeq: s.LastSeq}
+	for _, id := range s.L0 {
+		e.Added = append(e.Added, TableRef{Level: 0, ID: id})
+	}
+	for i, ids := range s.Levels {
+		for _, id := range ids {
+			e.Added = append(e.Added, TableRef{Level: uint32(i + 1), ID: id})
+		}
+	}
+	return e
+}
+
+func indexOf(ids []uint32, id uint32) int {
+	for i := range ids {
+		if ids[i] == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Manifest is a log of edits to the set of live sstables. The name of the
+// log in use is kept in the CURRENT file, which is only ever replaced
+// atomically, so a crash leaves either the old or the new manifest in effect.
+type Manifest struct {
+	mu     sync.Mutex
+	dir    string
+	number uint64
+	log    *wal.WAL
+}
+
+// Open replays the manifest in dir, or starts an empty one if there is
+// none, and rewrites the recovered state into a fresh manifest.
+func Open(dir string) (*Manifest, *State, error) {
+	state := &State{
+		L0:     make([]uint32, 0),
+		Levels: make([][]uint32, 0),
+	}
+
+	var number uint64
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	switch {
+	case err == nil:
+		name := strings.TrimSpace(string(current))
+		number, err = strconv.ParseUint(strings.TrimPrefix(name, manifestFilePrefix), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("manifest open: invalid CURRENT %q", name)
+		}
+		old, err := wal.Recover(filepath.Join(dir, name), func(record []byte) error {
+			e, err := decodeEdit(record)
+			if err != nil {
+				return err
+			}
+			state.Apply(e)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("manifest open: %w", err)
+		}
+		if err := old.Close(); err != nil {
+			return nil, nil, fmt.Errorf("manifest open: %w", err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return nil, nil, fmt.Errorf("manifest open: %w", err)
+	}
+
+	m := &Manifest{dir: dir, number: number}
+	if err := m.rewrite(state); err != nil {
+		return nil, nil, fmt.Errorf("manifest open: %w", err)
+	}
+	return m, state, nil
+}
+
+func (m *Manifest) path(number uint64) string {
+	return filepath.Join(m.dir, manifestFilePrefix+fmt.Sprintf(manifestNumberFormat, number))
+}
+
+// manifestNumbers returns the numbers of the manifests in dir.
+func manifestNumbers(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]uint64, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), manifestFilePrefix)
+		if !ok {
+			continue
+		}
+		if number, err := strconv.ParseUint(name, 10, 64); err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers, nil
+}
+
+// rewrite writes state into a new manifest, points CURRENT at it and
+// removes every other manifest. The new manifest is numbered past those
+// left behind by a crash before CURRENT was switched to them.
+func (m *Manifest) rewrite(state *State) error {
+	numbers, err := manifestNumbers(m.dir)
+	if err != nil {
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	number := m.number + 1
+	for _, n := range numbers {
+		number = max(number, n+1)
+	}
+	log, err := wal.Create(m.path(number))
+	if err != nil {
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	if err := log.Append(state.snapshot().encode()); err != nil {
+		log.Close()
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	if err := log.Sync(); err != nil {
+		log.Close()
+		return fmt.Errorf("rewrite: %w", err)
+	}
+
+	tmp := filepath.Join(m.dir, currentTempFileName)
+	name := filepath.Base(m.path(number)) + "\n"
+	if err := writeFileSync(tmp, []byte(name)); err != nil {
+		log.Close()
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, currentFileName)); err != nil {
+		log.Close()
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	if err := syncDir(m.dir); err != nil {
+		log.Close()
+		return fmt.Errorf("rewrite: %w", err)
+	}
+
+	for _, n := range numbers {
+		os.Remove(m.path(n))
+	}
+	m.number = number
+	m.log = log
+	return nil
+}
+
+// Log durably appends e to the manifest.
+func (m *Manifest) Log(e *Edit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.log.Append(e.encode()); err != nil {
+		return fmt.Errorf("manifest log: %w", err)
+	}
+	if err := m.log.Sync(); err != nil {
+		return fmt.Errorf("manifest log: %w", err)
+	}
+	return nil
+}
+
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.log.Close(); err != nil {
+		return fmt.Errorf("manifest close: %w", err)
+	}
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
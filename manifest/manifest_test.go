@@ -0,0 +1,96 @@
+package manifest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestState_Apply(t *testing.T) {
+	s := &State{}
+	s.Apply(&Edit{NextFileID: 2, Added: []TableRef{{Level: 0, ID: 1}}})
+	s.Apply(&Edit{NextFileID: 3, Added: []TableRef{{Level: 0, ID: 2}}})
+	s.Apply(&Edit{NextFileID: 4, Added: []TableRef{{Level: 0, ID: 3}}})
+	assert.Equal(t, []uint32{3, 2, 1}, s.L0)
+
+	// a table replacing older L0 tables keeps their place
+	s.Apply(&Edit{
+		NextFileID: 5,
+		Added:      []TableRef{{Level: 0, ID: 4}},
+		Deleted:    []TableRef{{Level: 0, ID: 1}, {Level: 0, ID: 2}},
+	})
+	assert.Equal(t, []uint32{3, 4}, s.L0)
+
+	s.Apply(&Edit{
+		NextFileID: 6,
+		Added:      []TableRef{{Level: 2, ID: 5}},
+		Deleted:    []TableRef{{Level: 0, ID: 4}},
+	})
+	assert.Equal(t, []uint32{3}, s.L0)
+	assert.Equal(t, [][]uint32{{}, {5}}, s.Levels)
+	assert.Equal(t, uint32(6), s.NextFileID)
+}
+
+func TestEdit_Encode_Decode(t *testing.T) {
+	e := &Edit{
+		NextFileID: 300,
+		LastSeq:    1 << 40,
+		Added:      []TableRef{{Level: 0, ID: 1}, {Level: 1, ID: 299}},
+		Deleted:    []TableRef{{Level: 0, ID: 2}},
+	}
+	got, err := decodeEdit(e.encode())
+	assert.NoError(t, err)
+	assert.Equal(t, e, got)
+}
+
+func TestManifest_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	m, state, err := Open(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, state.L0)
+
+	assert.NoError(t, m.Log(&Edit{NextFileID: 2, Added: []TableRef{{Level: 0, ID: 1}}}))
+	assert.NoError(t, m.Log(&Edit{NextFileID: 3, LastSeq: 7, Added: []TableRef{{Level: 0, ID: 2}}}))
+	assert.NoError(t, m.Close())
+
+	m, state, err = Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{2, 1}, state.L0)
+	assert.Equal(t, uint32(3), state.NextFileID)
+	assert.Equal(t, uint64(7), state.LastSeq)
+	assert.NoError(t, m.Log(&Edit{NextFileID: 4, Deleted: []TableRef{{Level: 0, ID: 2}}}))
+	assert.NoError(t, m.Close())
+
+	m, state, err = Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1}, state.L0)
+	assert.Equal(t, uint32(4), state.NextFileID)
+	assert.NoError(t, m.Close())
+}
+
+func TestManifest_OrphanedManifest(t *testing.T) {
+	dir := t.TempDir()
+	m, _, err := Open(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Log(&Edit{NextFileID: 2, Added: []TableRef{{Level: 0, ID: 1}}}))
+	assert.NoError(t, m.Close())
+
+	// a crash in a rewrite before CURRENT is switched leaves the next
+	// manifests behind
+	for _, number := range []uint64{m.number + 1, m.number + 3} {
+		assert.NoError(t, os.WriteFile(m.path(number), []byte("partial"), 0o600))
+	}
+	m, state, err := Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1}, state.L0)
+	assert.NoError(t, m.Close())
+	numbers, err := manifestNumbers(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{m.number}, numbers)
+
+	m, state, err = Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1}, state.L0)
+	assert.NoError(t, m.Close())
+}
@@ -0,0 +1,58 @@
+package memtable
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+var errArenaFull = errors.New("arena is full")
+
+// arena hands out the memory of the skiplist from one preallocated buffer,
+// so inserts allocate nothing the garbage collector has to track. Memory is
+// never freed; the arena goes away with its memtable. Offsets into the
+// buffer stand for pointers, 0 for nil.
+type arena struct {
+	n   atomic.Uint64
+	buf []byte
+}
+
+func newArena(size int) *arena {
+	a := &arena{buf: make([]byte, size)}
+	// offset 0 is nil
+	a.n.Store(1)
+	return a
+}
+
+// size returns the number of bytes in use.
+func (a *arena) size() int {
+	return int(min(a.n.Load(), uint64(len(a.buf))))
+}
+
+func (a *arena) capacity() int {
+	return len(a.buf)
+}
+
+// alloc reserves size bytes aligned to align+1, which is a power of two,
+// and returns their offset. It is safe for concurrent use.
+func (a *arena) alloc(size, align uint32) (uint32, error) {
+	padded := uint64(size + align)
+	end := a.n.Add(padded)
+	if end > uint64(len(a.buf)) {
+		return 0, errArenaFull
+	}
+	return (uint32(end-padded) + align) &^ align, nil
+}
+
+// bytes returns the size bytes at offset. They may not be appended to.
+func (a *arena) bytes(offset, size uint32) []byte {
+	return a.buf[offset : offset+size : offset+size]
+}
+
+// node returns the node at offset, or nil for offset 0.
+func (a *arena) node(offset uint32) *node {
+	if offset == 0 {
+		return nil
+	}
+	return (*node)(unsafe.Pointer(&a.buf[offset]))
+}
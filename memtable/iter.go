@@ -1,33 +1,102 @@
 package memtable
 
 import (
-	"bytes"
+	"minilsm/kv"
 	"minilsm/util"
 )
 
+// Iterator walks the versions of the user keys in a range of a table. It
+// sees the entries inserted concurrently that it has not gone past.
 type Iterator struct {
-	ele *Node[string, []byte]
-	end []byte
+	sl *skiplist
+	// ele is the offset of the current node, 0 when invalid.
+	ele uint32
+	// start and end are the internal keys [start, end) of the range, where
+	// nil leaves that side open.
+	start []byte
+	end   []byte
 }
 
 func (i *Iterator) Value() []byte {
-	return util.DeepCopySlice(i.ele.value)
+	return util.DeepCopySlice(i.sl.value(i.ele))
 }
 
 func (i *Iterator) Key() []byte {
-	if i.ele == nil {
+	if i.ele == 0 {
 		return nil
 	}
-	return []byte(i.ele.key)
+	return i.sl.key(i.ele)
 }
 
 func (i *Iterator) IsValid() bool {
-	return i.ele != nil && len(i.ele.key) != 0
+	return i.ele != 0
 }
 
 func (i *Iterator) Next() {
-	i.ele = i.ele.forwards[0]
-	if i.ele != nil && bytes.Compare([]byte(i.ele.key), i.end) > 0 {
-		i.ele = nil
+	i.ele = i.sl.next(i.ele, 0)
+	i.clamp()
+}
+
+func (i *Iterator) Prev() {
+	i.ele = i.sl.prev(i.ele)
+	i.clamp()
+}
+
+func (i *Iterator) Seek(key []byte) {
+	if i.start != nil && kv.Compare(key, i.start) < 0 {
+		key = i.start
+	}
+	i.ele = i.sl.lowerBound(key)
+	i.clamp()
+}
+
+func (i *Iterator) SeekToFirst() {
+	if i.start != nil {
+		i.Seek(i.start)
+		return
+	}
+	i.ele = i.sl.first()
+	i.clamp()
+}
+
+func (i *Iterator) SeekToLast() {
+	if i.end != nil {
+		i.ele = i.sl.nodeOrNil(i.sl.lastBefore(i.end))
+	} else {
+		i.ele = i.sl.last()
+	}
+	i.clamp()
+}
+
+func (i *Iterator) SeekForPrev(key []byte) {
+	if i.end != nil && kv.Compare(key, i.end) >= 0 {
+		i.SeekToLast()
+		return
+	}
+	i.ele = i.sl.lowerBound(key)
+	if i.ele == 0 || kv.Compare(i.sl.key(i.ele), key) != 0 {
+		i.ele = i.sl.nodeOrNil(i.sl.lastBefore(key))
+	}
+	i.clamp()
+}
+
+// Error returns nil, as reading a memtable does not fail.
+func (i *Iterator) Error() error {
+	return nil
+}
+
+func (i *Iterator) Close() error {
+	i.ele = 0
+	return nil
+}
+
+// clamp invalidates the iterator once it leaves [start, end).
+func (i *Iterator) clamp() {
+	if i.ele == 0 {
+		return
+	}
+	key := i.sl.key(i.ele)
+	if i.end != nil && kv.Compare(key, i.end) >= 0 || i.start != nil && kv.Compare(key, i.start) < 0 {
+		i.ele = 0
 	}
 }
@@ -1,94 +1,397 @@
 package memtable
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"minilsm/config"
-	"minilsm/logger"
+	"minilsm/kv"
+	"minilsm/rangedel"
 	"minilsm/sstable"
 	"minilsm/util"
+	"minilsm/wal"
+	"slices"
 	"sync"
+	"sync/atomic"
 )
 
-var log = logger.GetLogger()
+// DefaultArenaSize is the capacity in bytes of the arena of a table created
+// by NewTable.
+const DefaultArenaSize = 4 << 20
 
+// ErrFull is returned by Write when the arena of the table has no room for
+// the entries.
+var ErrFull = errors.New("memtable is full")
+
+// ErrInvalidKey is returned by Put and Delete for an empty key or one too
+// long to be stored.
+var ErrInvalidKey = errors.New("invalid key")
+
+// Table maps internal keys to values, so every write adds a new version of
+// its user key. Range tombstones are kept apart from the other entries.
+//
+// The entries live in a lock-free skiplist, so writers only serialize on
+// appending to the write-ahead log, and readers never block.
 type Table struct {
-	mu sync.RWMutex
-	sl *SkipList[string, []byte]
+	sl *skiplist
+	// writeMu serializes the appends to the write-ahead log and guards
+	// reserved, the arena space promised to the writes in progress.
+	writeMu  sync.Mutex
+	reserved int
+	// pending counts the writes logged but not yet applied.
+	pending sync.WaitGroup
+	// rangeDels is replaced rather than modified, under rangeMu, so
+	// readers can use it without a lock.
+	rangeMu      sync.Mutex
+	rangeDels    atomic.Pointer[[]rangedel.Tombstone]
+	rangeDelSize atomic.Int64
+	id           uint32
+	wal          *wal.WAL
+	maxSeq       atomic.Uint64
 }
 
 func NewTable() *Table {
-	return &Table{
-		sl: NewSkipList[string, []byte](),
+	return newTable(DefaultArenaSize)
+}
+
+func newTable(arenaSize int) *Table {
+	t := &Table{sl: newSkiplist(arenaSize)}
+	t.reserved = t.sl.size()
+	t.rangeDels.Store(&[]rangedel.Tombstone{})
+	return t
+}
+
+// NewTableWithWAL creates an empty table with an arena of arenaSize bytes
+// whose writes are logged to a new write-ahead log at path before they are
+// applied.
+func NewTableWithWAL(id uint32, path string, arenaSize int) (*Table, error) {
+	w, err := wal.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("new memtable with wal: %w", err)
 	}
+	t := newTable(arenaSize)
+	t.id = id
+	t.wal = w
+	return t, nil
 }
 
-func (t *Table) Get(key []byte) (val []byte, ok bool) {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	if len(key) == 0 {
-		log.Error("memtable get: key cannot be empty")
-		return nil, false
+// RecoverFromWAL rebuilds a table by replaying the write-ahead log at path.
+// The table keeps appending to the same log, but its arena is only large
+// enough for the log, as a recovered table is meant to be flushed.
+func RecoverFromWAL(id uint32, path string) (*Table, error) {
+	entries := make([]Entry, 0)
+	w, err := wal.Recover(path, func(record []byte) error {
+		recordEntries, err := decodeRecord(record)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, recordEntries...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("recover memtable from wal: %w", err)
+	}
+	t := newTable(TableOverhead + ArenaSize(entries))
+	t.id = id
+	if err := t.apply(entries); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("recover memtable from wal: %w", err)
+	}
+	t.wal = w
+	return t, nil
+}
+
+func (t *Table) ID() uint32 {
+	return t.id
+}
+
+// MaxSeq returns the largest sequence number written to the table.
+func (t *Table) MaxSeq() uint64 {
+	return t.maxSeq.Load()
+}
+
+func (t *Table) IsEmpty() bool {
+	return t.sl.first() == 0 && len(*t.rangeDels.Load()) == 0
+}
+
+// Size returns the bytes taken by the entries of the table: the arena in
+// use and the range tombstones.
+func (t *Table) Size() int {
+	return t.sl.size() + int(t.rangeDelSize.Load())
+}
+
+// HasRoom reports whether Write can take entries of size bytes, as counted
+// by ArenaSize.
+func (t *Table) HasRoom(size int) bool {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.reserved+size <= t.sl.arena.capacity()
+}
+
+// ArenaSize returns the most arena space that writing entries takes.
+func ArenaSize(entries []Entry) int {
+	size := 0
+	for _, e := range entries {
+		size += EntryOverhead + len(e.Key) + len(e.Value)
+	}
+	return size
+}
+
+func (t *Table) SyncWAL() error {
+	if t.wal == nil {
+		return nil
+	}
+	return t.wal.Sync()
+}
+
+func (t *Table) CloseWAL() error {
+	if t.wal == nil {
+		return nil
+	}
+	return t.wal.Close()
+}
+
+// Entry is a write of Value to the internal key Key. For a range tombstone,
+// Key holds the start of the range and Value its end.
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// A record holds the entries of one Write, each encoded as
+//
+// +----------+-------+------------+-------+
+// | key size |  key  | value size | value |
+// +----------+-------+------------+-------+
+// | uvarint  | bytes |  uvarint   | bytes |
+// +----------+-------+------------+-------+
+//
+// where key is the internal key of the entry.
+func encodeRecord(entries []Entry) []byte {
+	size := 0
+	for _, e := range entries {
+		size += 2*binary.MaxVarintLen64 + len(e.Key) + len(e.Value)
+	}
+	buf := make([]byte, 0, size)
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(len(e.Key)))
+		buf = append(buf, e.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(e.Value)))
+		buf = append(buf, e.Value...)
 	}
-	val, ok = t.sl.Search(string(key))
+	return buf
+}
+
+var errInvalidRecord = errors.New("invalid wal record")
+
+func decodeRecord(record []byte) ([]Entry, error) {
+	entries := make([]Entry, 0, 1)
+	for len(record) > 0 {
+		ks, n := binary.Uvarint(record)
+		if n <= 0 || uint64(len(record)-n) < ks || ks <= kv.TrailerSize {
+			return nil, errInvalidRecord
+		}
+		record = record[n:]
+		key := util.DeepCopySlice(record[:ks])
+		record = record[ks:]
+		vs, n := binary.Uvarint(record)
+		if n <= 0 || uint64(len(record)-n) < vs {
+			return nil, errInvalidRecord
+		}
+		record = record[n:]
+		value := util.DeepCopySlice(record[:vs])
+		record = record[vs:]
+		entries = append(entries, Entry{Key: key, Value: value})
+	}
+	return entries, nil
+}
+
+// Get returns the newest entry of key whose sequence number is not greater
+// than seq. ok is true for a tombstone too, so the caller knows not to look
+// for the key in older tables.
+func (t *Table) Get(key []byte, seq uint64) (val []byte, kind kv.Kind, ok bool) {
+	internalKey, val, ok := t.Lookup(key, seq)
 	if !ok {
-		return nil, false
+		return nil, 0, false
 	}
-	val = util.DeepCopySlice(val)
-	return val, true
+	return val, kv.KindOf(internalKey), true
 }
 
-func (t *Table) Put(key, value []byte) bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+// Lookup is Get returning the internal key of the entry found. An empty
+// key, which is never written, is not found.
+func (t *Table) Lookup(key []byte, seq uint64) (internalKey, val []byte, ok bool) {
 	if len(key) == 0 {
-		log.Error("memtable put: key cannot be empty")
-		return false
+		return nil, nil, false
+	}
+	node := t.sl.lowerBound(kv.MakeSeekKey(key, seq))
+	if node == 0 || !bytes.Equal(kv.UserKey(t.sl.key(node)), key) {
+		return nil, nil, false
 	}
-	if len(key) > config.MaxKeyLength {
-		log.Error("memtable put: key is too long")
-		return false
+	return t.sl.key(node), util.DeepCopySlice(t.sl.value(node)), true
+}
+
+// RangeDelSeq returns the largest sequence number, not greater than seq, of
+// the range tombstones that contain key, or 0 if there is none.
+func (t *Table) RangeDelSeq(key []byte, seq uint64) uint64 {
+	return rangedel.MaxSeq(*t.rangeDels.Load(), key, seq)
+}
+
+// RangeDels returns the range tombstones written to the table so far.
+func (t *Table) RangeDels() []rangedel.Tombstone {
+	return slices.Clone(*t.rangeDels.Load())
+}
+
+// Put writes value as the version seq of key.
+func (t *Table) Put(key, value []byte, seq uint64) error {
+	return t.put(key, value, seq, kv.KindPut)
+}
+
+// Delete writes a tombstone as the version seq of key.
+func (t *Table) Delete(key []byte, seq uint64) error {
+	return t.put(key, nil, seq, kv.KindDelete)
+}
+
+func (t *Table) put(key, value []byte, seq uint64, kind kv.Kind) error {
+	if len(key) == 0 || len(key)+kv.TrailerSize > config.MaxKeyLength {
+		return fmt.Errorf("memtable put: %w", ErrInvalidKey)
+	}
+	if err := t.Write([]Entry{{Key: kv.MakeKey(key, seq, kind), Value: value}}, false); err != nil {
+		return fmt.Errorf("memtable put: %w", err)
+	}
+	return nil
+}
+
+// Write applies entries, whose keys are internal keys, as one record of the
+// write-ahead log, so either all of them are recovered after a crash or
+// none is. With sync, the log is synced to disk before the entries are
+// applied. It returns ErrFull, and writes nothing, if the arena has no room
+// for them. Writes may run concurrently.
+func (t *Table) Write(entries []Entry, sync bool) error {
+	if err := t.Log(entries); err != nil {
+		return err
+	}
+	if sync {
+		if err := t.SyncWAL(); err != nil {
+			t.pending.Done()
+			return fmt.Errorf("memtable write: %w", err)
+		}
+	}
+	return t.Apply(entries)
+}
+
+// Log is the first half of Write: it reserves room in the arena for
+// entries and appends them to the write-ahead log. It returns ErrFull, and
+// logs nothing, if the arena has no room for them. Entries logged must be
+// passed to Apply, which may run concurrently with other Logs and Applies;
+// Flush waits for them.
+func (t *Table) Log(entries []Entry) error {
+	size := ArenaSize(entries)
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.reserved+size > t.sl.arena.capacity() {
+		return fmt.Errorf("memtable log: %w", ErrFull)
+	}
+	if t.wal != nil {
+		if err := t.wal.Append(encodeRecord(entries)); err != nil {
+			return fmt.Errorf("memtable log: %w", err)
+		}
 	}
-	t.sl.Insert(string(key), util.DeepCopySlice(value))
-	return true
+	t.reserved += size
+	t.pending.Add(1)
+	return nil
+}
+
+// Apply inserts entries logged by Log into the table.
+func (t *Table) Apply(entries []Entry) error {
+	defer t.pending.Done()
+	if err := t.apply(entries); err != nil {
+		return fmt.Errorf("memtable apply: %w", err)
+	}
+	return nil
+}
+
+// WaitForWrites waits until the entries logged so far are applied. It is
+// meant for a table no longer written to, before it is flushed.
+func (t *Table) WaitForWrites() {
+	t.pending.Wait()
+}
+
+// apply inserts entries into the table. The skiplist copies the keys and
+// values into its arena.
+func (t *Table) apply(entries []Entry) error {
+	for _, e := range entries {
+		if kv.KindOf(e.Key) == kv.KindRangeDelete {
+			t.addRangeDel(rangedel.Tombstone{
+				Start: util.DeepCopySlice(kv.UserKey(e.Key)),
+				End:   util.DeepCopySlice(e.Value),
+				Seq:   kv.Seq(e.Key),
+			})
+		} else if err := t.sl.insert(e.Key, e.Value); err != nil {
+			return err
+		}
+		seq := kv.Seq(e.Key)
+		for {
+			cur := t.maxSeq.Load()
+			if seq <= cur || t.maxSeq.CompareAndSwap(cur, seq) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Table) addRangeDel(ts rangedel.Tombstone) {
+	t.rangeMu.Lock()
+	defer t.rangeMu.Unlock()
+	rangeDels := append(slices.Clip(*t.rangeDels.Load()), ts)
+	t.rangeDels.Store(&rangeDels)
+	t.rangeDelSize.Add(int64(len(ts.Start) + len(ts.End) + kv.TrailerSize))
 }
 
+// Scan returns an iterator over every version of the user keys in
+// [lower, upper].
 func (t *Table) Scan(lower, upper []byte) (*Iterator, error) {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
 	if len(lower) == 0 {
 		return nil, errors.New("memtable scan: lower cannot be empty")
 	}
 	if len(upper) == 0 {
 		return nil, errors.New("memtable scan: upper cannot be empty")
 	}
-	head, _ := t.sl.find(string(lower))
-	return &Iterator{
-		ele: head,
-		end: upper,
-	}, nil
+	return t.ScanRange(kv.Range{Lower: lower, Upper: upper}), nil
 }
 
+// ScanRange returns an iterator over every version of the user keys in r.
+func (t *Table) ScanRange(r kv.Range) *Iterator {
+	iter := &Iterator{
+		sl:    t.sl,
+		start: r.Start(),
+		end:   r.End(),
+	}
+	iter.SeekToFirst()
+	return iter
+}
+
+// Flush adds the entries and range tombstones of the table to builder,
+// once the writes logged to it are applied.
 func (t *Table) Flush(builder *sstable.TableBulder) error {
-	head := t.sl.head
-	if head == nil {
-		return errors.New("memtable flush: table is empty")
+	t.WaitForWrites()
+	rangeDels := *t.rangeDels.Load()
+	for _, rd := range rangeDels {
+		builder.AddRangeDel(rd)
 	}
-	current := head.forwards[0]
-	if current == nil {
+	current := t.sl.first()
+	if current == 0 {
+		if len(rangeDels) > 0 {
+			return nil
+		}
 		return errors.New("memtable flush: table is empty")
 	}
 
-	for {
-		err := builder.Add([]byte(current.key), current.value)
-		if err != nil {
+	for ; current != 0; current = t.sl.next(current, 0) {
+		if err := builder.Add(t.sl.key(current), t.sl.value(current)); err != nil {
 			return fmt.Errorf("memtable flush: %w", err)
 		}
-		next := current.forwards[0]
-		if next == nil {
-			break
-		}
-		current = next
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package memtable
 
 import (
+	"minilsm/kv"
 	"minilsm/util"
 	"strconv"
 	"sync"
@@ -36,36 +37,131 @@ func TestMemtable_Put_Get(t *testing.T) {
 		},
 	}
 	mt := NewTable()
-	for _, tt := range tests {
+	for i, tt := range tests {
 		t.Run(string(tt.key)+":"+string(tt.value), func(t *testing.T) {
-			ok := mt.Put(tt.key, tt.value)
-			assert.Equal(t, tt.want, ok)
-			val, ok := mt.Get(tt.key)
+			err := mt.Put(tt.key, tt.value, uint64(i+1))
+			if tt.want {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidKey)
+			}
+			val, _, ok := mt.Get(tt.key, kv.MaxSeq)
 			assert.Equal(t, tt.wantVal, val)
 			assert.Equal(t, tt.want, ok)
 		})
 	}
 }
 
+func TestMemtable_Delete(t *testing.T) {
+	mt := NewTable()
+	assert.NoError(t, mt.Put([]byte("key"), []byte("value"), 1))
+	assert.NoError(t, mt.Delete([]byte("key"), 2))
+	val, kind, ok := mt.Get([]byte("key"), kv.MaxSeq)
+	assert.True(t, ok)
+	assert.Equal(t, kv.KindDelete, kind)
+	assert.Empty(t, val)
+
+	// an empty value is not a tombstone
+	assert.NoError(t, mt.Put([]byte("key"), []byte{}, 3))
+	_, kind, ok = mt.Get([]byte("key"), kv.MaxSeq)
+	assert.True(t, ok)
+	assert.Equal(t, kv.KindPut, kind)
+}
+
+func TestMemtable_Versions(t *testing.T) {
+	mt := NewTable()
+	assert.NoError(t, mt.Put([]byte("key"), []byte("v1"), 1))
+	assert.NoError(t, mt.Put([]byte("key"), []byte("v3"), 3))
+	assert.NoError(t, mt.Delete([]byte("key"), 5))
+
+	_, _, ok := mt.Get([]byte("key"), 0)
+	assert.False(t, ok)
+	for seq, want := range map[uint64][]byte{1: []byte("v1"), 2: []byte("v1"), 3: []byte("v3"), 4: []byte("v3")} {
+		val, kind, ok := mt.Get([]byte("key"), seq)
+		assert.True(t, ok)
+		assert.Equal(t, kv.KindPut, kind)
+		assert.Equal(t, want, val)
+	}
+	_, kind, ok := mt.Get([]byte("key"), 5)
+	assert.True(t, ok)
+	assert.Equal(t, kv.KindDelete, kind)
+	assert.Equal(t, uint64(5), mt.MaxSeq())
+}
+
 func TestMemtable_Iter(t *testing.T) {
 	mt := NewTable()
 	for i := 0; i < 10; i++ {
-		mt.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+		mt.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)), uint64(i+1))
 	}
 	iter, err := mt.Scan([]byte("2"), []byte("5"))
 	assert.NoError(t, err)
 
-	assert.Equal(t, []byte("2"), iter.Key())
+	assert.Equal(t, kv.MakeKey([]byte("2"), 3, kv.KindPut), iter.Key())
 	iter.Next()
-	assert.Equal(t, []byte("3"), iter.Key())
+	assert.Equal(t, kv.MakeKey([]byte("3"), 4, kv.KindPut), iter.Key())
 	iter.Next()
-	assert.Equal(t, []byte("4"), iter.Key())
+	assert.Equal(t, kv.MakeKey([]byte("4"), 5, kv.KindPut), iter.Key())
 	iter.Next()
-	assert.Equal(t, []byte("5"), iter.Key())
+	assert.Equal(t, kv.MakeKey([]byte("5"), 6, kv.KindPut), iter.Key())
 	iter.Next()
 	assert.Nil(t, iter.Key())
 }
 
+func TestMemtable_IterBackward(t *testing.T) {
+	mt := NewTable()
+	for i := 0; i < 10; i++ {
+		mt.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)), uint64(i+1))
+	}
+	mt.Put([]byte("3"), []byte("3.new"), 20)
+	iter, err := mt.Scan([]byte("2"), []byte("5"))
+	assert.NoError(t, err)
+
+	iter.SeekToLast()
+	for _, want := range [][]byte{
+		kv.MakeKey([]byte("5"), 6, kv.KindPut),
+		kv.MakeKey([]byte("4"), 5, kv.KindPut),
+		kv.MakeKey([]byte("3"), 4, kv.KindPut),
+		kv.MakeKey([]byte("3"), 20, kv.KindPut),
+		kv.MakeKey([]byte("2"), 3, kv.KindPut),
+	} {
+		assert.Equal(t, want, iter.Key())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+
+	iter.SeekForPrev(kv.MakeKey([]byte("3"), 10, kv.KindPut))
+	assert.Equal(t, kv.MakeKey([]byte("3"), 20, kv.KindPut), iter.Key())
+	iter.SeekForPrev(kv.MakeKey([]byte("9"), 10, kv.KindPut))
+	assert.Equal(t, kv.MakeKey([]byte("5"), 6, kv.KindPut), iter.Key())
+	iter.SeekForPrev(kv.MakeKey([]byte("1"), 10, kv.KindPut))
+	assert.False(t, iter.IsValid())
+	iter.SeekToFirst()
+	assert.Equal(t, kv.MakeKey([]byte("2"), 3, kv.KindPut), iter.Key())
+}
+
+func TestMemtable_ScanRange(t *testing.T) {
+	mt := NewTable()
+	for i := 0; i < 10; i++ {
+		mt.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)), uint64(i+1))
+	}
+	iter := mt.ScanRange(kv.Range{Lower: []byte("7"), LowerExclusive: true})
+	assert.Equal(t, []byte("8"), kv.UserKey(iter.Key()))
+	iter.Next()
+	assert.Equal(t, []byte("9"), kv.UserKey(iter.Key()))
+	iter.Next()
+	assert.False(t, iter.IsValid())
+
+	iter = mt.ScanRange(kv.Range{Upper: []byte("2"), UpperExclusive: true})
+	iter.SeekToLast()
+	assert.Equal(t, []byte("1"), kv.UserKey(iter.Key()))
+	iter.Prev()
+	assert.Equal(t, []byte("0"), kv.UserKey(iter.Key()))
+	iter.Prev()
+	assert.False(t, iter.IsValid())
+	iter.Seek(kv.MakeSeekKey([]byte("5"), kv.MaxSeq))
+	assert.False(t, iter.IsValid())
+}
+
 func TestMemtable_ConcurrentAccess(t *testing.T) {
 	mt := NewTable()
 	var wg sync.WaitGroup
@@ -75,8 +171,8 @@ func TestMemtable_ConcurrentAccess(t *testing.T) {
 
 		go func(i int) {
 			defer wg.Done()
-			mt.Put(util.KeyOf(i), util.ValueOf(i))
-			got, ok := mt.Get(util.KeyOf(i))
+			mt.Put(util.KeyOf(i), util.ValueOf(i), uint64(i+1))
+			got, _, ok := mt.Get(util.KeyOf(i), kv.MaxSeq)
 			assert.True(t, ok)
 			assert.Equal(t, util.ValueOf(i), got)
 		}(i)
@@ -84,3 +180,100 @@ func TestMemtable_ConcurrentAccess(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMemtable_RecoverFromWAL(t *testing.T) {
+	path := t.TempDir() + "/1.wal"
+	mt, err := NewTableWithWAL(1, path, DefaultArenaSize)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, mt.Put(util.KeyOf(i), util.ValueOf(i), uint64(i+1)))
+	}
+	assert.NoError(t, mt.Delete(util.KeyOf(100), 101))
+	assert.NoError(t, mt.CloseWAL())
+
+	mt, err = RecoverFromWAL(1, path)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		mt.CloseWAL()
+	})
+	assert.Equal(t, uint32(1), mt.ID())
+	for i := 0; i < 100; i++ {
+		got, _, ok := mt.Get(util.KeyOf(i), kv.MaxSeq)
+		assert.True(t, ok)
+		assert.Equal(t, util.ValueOf(i), got)
+	}
+	_, kind, ok := mt.Get(util.KeyOf(100), kv.MaxSeq)
+	assert.True(t, ok)
+	assert.Equal(t, kv.KindDelete, kind)
+	assert.Equal(t, uint64(101), mt.MaxSeq())
+}
+
+func TestMemtable_Write(t *testing.T) {
+	path := t.TempDir() + "/1.wal"
+	mt, err := NewTableWithWAL(1, path, DefaultArenaSize)
+	assert.NoError(t, err)
+	entries := []Entry{
+		{Key: kv.MakeKey([]byte("a"), 1, kv.KindPut), Value: []byte("1")},
+		{Key: kv.MakeKey([]byte("b"), 2, kv.KindPut), Value: []byte{}},
+		{Key: kv.MakeKey([]byte("a"), 3, kv.KindDelete)},
+	}
+	assert.NoError(t, mt.Write(entries, true))
+	assert.NoError(t, mt.CloseWAL())
+
+	for _, mt := range []*Table{mt, recoverTable(t, path)} {
+		_, kind, ok := mt.Get([]byte("a"), kv.MaxSeq)
+		assert.True(t, ok)
+		assert.Equal(t, kv.KindDelete, kind)
+		val, _, ok := mt.Get([]byte("a"), 2)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("1"), val)
+		val, kind, ok = mt.Get([]byte("b"), kv.MaxSeq)
+		assert.True(t, ok)
+		assert.Equal(t, kv.KindPut, kind)
+		assert.Empty(t, val)
+		assert.Equal(t, uint64(3), mt.MaxSeq())
+	}
+}
+
+func TestMemtable_Full(t *testing.T) {
+	mt := newTable(4096)
+	assert.True(t, mt.IsEmpty())
+	size := mt.Size()
+	entry := Entry{Key: kv.MakeKey([]byte("key"), 1, kv.KindPut), Value: []byte("value")}
+	assert.True(t, mt.HasRoom(ArenaSize([]Entry{entry})))
+	assert.NoError(t, mt.Write([]Entry{entry}, false))
+	assert.False(t, mt.IsEmpty())
+	// the node takes the links of its height only
+	assert.Greater(t, mt.Size()-size, len(entry.Key)+len(entry.Value))
+	assert.LessOrEqual(t, mt.Size()-size, ArenaSize([]Entry{entry}))
+
+	seq := uint64(2)
+	for mt.HasRoom(ArenaSize([]Entry{entry})) {
+		entry.Key = kv.MakeKey([]byte("key"), seq, kv.KindPut)
+		assert.NoError(t, mt.Write([]Entry{entry}, false))
+		seq++
+	}
+	entry.Key = kv.MakeKey([]byte("key"), seq, kv.KindPut)
+	assert.ErrorIs(t, mt.Write([]Entry{entry}, false), ErrFull)
+	assert.Equal(t, seq-1, mt.MaxSeq())
+	assert.LessOrEqual(t, mt.Size(), 4096)
+
+	// entries that did not fit are not half written
+	_, _, ok := mt.Get([]byte("key"), kv.MaxSeq)
+	assert.True(t, ok)
+	iter := mt.ScanRange(kv.Range{})
+	n := uint64(0)
+	for ; iter.IsValid(); iter.Next() {
+		n++
+	}
+	assert.Equal(t, seq-1, n)
+}
+
+func recoverTable(t *testing.T, path string) *Table {
+	mt, err := RecoverFromWAL(1, path)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		mt.CloseWAL()
+	})
+	return mt
+}
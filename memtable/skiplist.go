@@ -1,132 +1,211 @@
-package memtable
-
-import (
-	"cmp"
-	"math/rand"
-)
-
-type Node[K cmp.Ordered, V any] struct {
-	key      K
-	value    V
-	forwards []*Node[K, V]
-}
-
-func newNode[K cmp.Ordered, V any](key K, value V, level int) *Node[K, V] {
-	return &Node[K, V]{
-		key:      key,
-		value:    value,
-		forwards: make([]*Node[K, V], level+1),
-	}
-}
-
-type SkipList[K cmp.Ordered, V any] struct {
-	head  *Node[K, V]
-	level int
-}
-
-const (
-	MaxLevel = 16
-	P        = 0.25
-)
-
-func NewSkipList[K cmp.Ordered, V any]() *SkipList[K, V] {
-	var nilK K
-	var nilV V
-	head := newNode(nilK, nilV, MaxLevel)
-	return &SkipList[K, V]{head: head, level: 0}
-}
-
-func (sl *SkipList[K, V]) randomLevel() int {
-	level := 0
-	for rand.Float64() < P && level < MaxLevel {
-		level++
-	}
-	return level
-}
-
-func (sl *SkipList[K, V]) Insert(key K, value V) {
-	update := make([]*Node[K, V], MaxLevel+1)
-	current := sl.head
-
-	// 从左上角开始查找
-	for i := sl.level; i >= 0; i-- {
-		// 从左到右
-		for current.forwards[i] != nil && current.forwards[i].key < key {
-			current = current.forwards[i]
-		}
-		update[i] = current
-	}
-
-	// current 指向第0层第一个大于 key 的结点
-	current = current.forwards[0]
-	if current != nil && current.key == key {
-		return
-	}
-
-	// 为当前要插入的结点生成一个随机层数
-	randomLevel := sl.randomLevel()
-	if randomLevel > sl.level {
-		for i := sl.level + 1; i <= randomLevel; i++ {
-			update[i] = sl.head
-		}
-		sl.level = randomLevel
-	}
-
-	newNode := newNode(key, value, randomLevel)
-
-	for i := 0; i <= randomLevel; i++ {
-		newNode.forwards[i] = update[i].forwards[i] //新结点指向后面
-		update[i].forwards[i] = newNode
-	}
-}
-
-func (sl *SkipList[K, V]) find(key K) (*Node[K, V], bool) {
-	current := sl.head
-	for i := sl.level; i >= 0; i-- {
-		for current.forwards[i] != nil && current.forwards[i].key < key {
-			current = current.forwards[i]
-		}
-	}
-	current = current.forwards[0]
-	if current != nil && current.key == key {
-		return current, true
-	}
-	return nil, false
-}
-
-func (sl *SkipList[K, V]) Search(key K) (V, bool) {
-	current, ok := sl.find(key)
-	if !ok {
-		var nilV V
-		return nilV, false
-	}
-	return current.value, true
-}
-
-func (sl *SkipList[K, V]) Delete(key K) {
-	update := make([]*Node[K, V], MaxLevel+1)
-	current := sl.head
-
-	for i := sl.level; i >= 0; i-- {
-		for current.forwards[i] != nil && current.forwards[i].key < key {
-			current = current.forwards[i]
-		}
-		update[i] = current
-	}
-
-	current = current.forwards[0]
-	if current == nil || current.key != key {
-		return
-	}
-
-	for i := 0; i <= sl.level; i++ {
-		if update[i].forwards[i] != current {
-			break
-		}
-		update[i].forwards[i] = current.forwards[i]
-	}
-
-	for sl.level > 0 && sl.head.forwards[sl.level] == nil {
-		sl.level--
-	}
-}
+package memtable
+
+import (
+	"math/rand"
+	"minilsm/kv"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	maxHeight = 12
+	// P is the chance of a node to reach each level above the first.
+	P = 0.25
+)
+
+// node is an entry of the skiplist, stored in its arena together with the
+// key and the value, which follows the key. Only the first height links of
+// tower are allocated.
+type node struct {
+	keyOffset uint32
+	keySize   uint32
+	valueSize uint32
+	// tower[i] is the offset of the next node on level i.
+	tower [maxHeight]atomic.Uint32
+}
+
+const (
+	maxNodeSize = uint32(unsafe.Sizeof(node{}))
+	linkSize    = uint32(unsafe.Sizeof(atomic.Uint32{}))
+	nodeAlign   = uint32(unsafe.Alignof(node{})) - 1
+)
+
+// EntryOverhead is the most a skiplist spends on an entry besides its key
+// and value.
+const EntryOverhead = int(maxNodeSize + nodeAlign)
+
+// TableOverhead is what a skiplist spends besides its entries: the head
+// node and the byte at offset 0, which stands for nil.
+const TableOverhead = EntryOverhead + 1
+
+// skiplist is a sorted list of internal keys in an arena. It takes inserts
+// from many goroutines at once without locking, and readers never wait for
+// them: a node is linked into each level with a compare-and-swap, from the
+// bottom, once its key and value are written, so a reader following the
+// links only meets complete nodes. Nodes are never removed.
+//
+// There are no backward links, which could not be kept consistent with the
+// forward ones without a lock. Moving backward searches for the last node
+// before the current one instead.
+type skiplist struct {
+	arena  *arena
+	head   uint32
+	height atomic.Int32
+}
+
+func newSkiplist(arenaSize int) *skiplist {
+	a := newArena(arenaSize)
+	head, err := a.alloc(maxNodeSize, nodeAlign)
+	if err != nil {
+		panic("memtable: arena too small for the skiplist head")
+	}
+	s := &skiplist{arena: a, head: head}
+	s.height.Store(1)
+	return s
+}
+
+func randomHeight() int {
+	h := 1
+	for h < maxHeight && rand.Float64() < P {
+		h++
+	}
+	return h
+}
+
+// newNode allocates a node of height levels holding key and value.
+func (s *skiplist) newNode(key, value []byte, height int) (uint32, error) {
+	size := maxNodeSize - uint32(maxHeight-height)*linkSize
+	offset, err := s.arena.alloc(size, nodeAlign)
+	if err != nil {
+		return 0, err
+	}
+	kvOffset, err := s.arena.alloc(uint32(len(key)+len(value)), 0)
+	if err != nil {
+		return 0, err
+	}
+	copy(s.arena.buf[kvOffset:], key)
+	copy(s.arena.buf[kvOffset+uint32(len(key)):], value)
+	nd := s.arena.node(offset)
+	nd.keyOffset = kvOffset
+	nd.keySize = uint32(len(key))
+	nd.valueSize = uint32(len(value))
+	return offset, nil
+}
+
+func (s *skiplist) key(offset uint32) []byte {
+	nd := s.arena.node(offset)
+	return s.arena.bytes(nd.keyOffset, nd.keySize)
+}
+
+func (s *skiplist) value(offset uint32) []byte {
+	nd := s.arena.node(offset)
+	return s.arena.bytes(nd.keyOffset+nd.keySize, nd.valueSize)
+}
+
+func (s *skiplist) next(offset uint32, level int) uint32 {
+	return s.arena.node(offset).tower[level].Load()
+}
+
+// findSplice returns the nodes on level between which key goes, starting
+// from before, which is less than key. next is 0 at the end of the level.
+func (s *skiplist) findSplice(key []byte, before uint32, level int) (prev, next uint32) {
+	for {
+		next = s.next(before, level)
+		if next == 0 || kv.Compare(s.key(next), key) >= 0 {
+			return before, next
+		}
+		before = next
+	}
+}
+
+// insert adds key with value. Every internal key is written once, so a key
+// already in the list is left as it is.
+func (s *skiplist) insert(key, value []byte) error {
+	listHeight := int(s.height.Load())
+	var prev, next [maxHeight + 1]uint32
+	prev[listHeight] = s.head
+	for i := listHeight - 1; i >= 0; i-- {
+		prev[i], next[i] = s.findSplice(key, prev[i+1], i)
+	}
+	if next[0] != 0 && kv.Compare(s.key(next[0]), key) == 0 {
+		return nil
+	}
+
+	height := randomHeight()
+	offset, err := s.newNode(key, value, height)
+	if err != nil {
+		return err
+	}
+	for h := int32(listHeight); h < int32(height); h = s.height.Load() {
+		if s.height.CompareAndSwap(h, int32(height)) {
+			break
+		}
+	}
+
+	nd := s.arena.node(offset)
+	for i := 0; i < height; i++ {
+		if prev[i] == 0 {
+			// the level was above the list when it was searched
+			prev[i], next[i] = s.findSplice(key, s.head, i)
+		}
+		for {
+			nd.tower[i].Store(next[i])
+			if s.arena.node(prev[i]).tower[i].CompareAndSwap(next[i], offset) {
+				break
+			}
+			// a concurrent insert linked a node after prev
+			prev[i], next[i] = s.findSplice(key, prev[i], i)
+		}
+	}
+	return nil
+}
+
+// lastBefore returns the last node whose key is less than key, or the head
+// if there is none.
+func (s *skiplist) lastBefore(key []byte) uint32 {
+	x := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		x, _ = s.findSplice(key, x, level)
+	}
+	return x
+}
+
+// lowerBound returns the first node whose key is not less than key, or 0 if
+// there is none.
+func (s *skiplist) lowerBound(key []byte) uint32 {
+	return s.next(s.lastBefore(key), 0)
+}
+
+// prev returns the node before the one at offset, or 0 if it is the first.
+func (s *skiplist) prev(offset uint32) uint32 {
+	return s.nodeOrNil(s.lastBefore(s.key(offset)))
+}
+
+// first returns the first node, or 0 if the list is empty.
+func (s *skiplist) first() uint32 {
+	return s.next(s.head, 0)
+}
+
+// last returns the last node, or 0 if the list is empty.
+func (s *skiplist) last() uint32 {
+	x := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		for next := s.next(x, level); next != 0; next = s.next(x, level) {
+			x = next
+		}
+	}
+	return s.nodeOrNil(x)
+}
+
+// nodeOrNil maps the head to 0.
+func (s *skiplist) nodeOrNil(offset uint32) uint32 {
+	if offset == s.head {
+		return 0
+	}
+	return offset
+}
+
+// size returns the bytes of the arena in use.
+func (s *skiplist) size() int {
+	return s.arena.size()
+}
@@ -1,31 +1,95 @@
-package memtable
-
-import (
-	"testing"
-
-	"github.com/stretchr/testify/assert"
-)
-
-func TestSkipList(t *testing.T) {
-	sl := NewSkipList[int, int]()
-
-	nums := []int{3, 6, 7, 9, 12, 19, 23, 25}
-	for _, num := range nums {
-		sl.Insert(num, num)
-	}
-
-	got, ok := sl.Search(6)
-	assert.True(t, ok)
-	assert.Equal(t, 6, got)
-
-	_, ok = sl.Search(8)
-	assert.False(t, ok)
-
-	sl.Delete(6)
-	sl.Delete(23)
-
-	_, ok = sl.Search(6)
-	assert.False(t, ok)
-	_, ok = sl.Search(23)
-	assert.False(t, ok)
-}
+package memtable
+
+import (
+	"fmt"
+	"minilsm/kv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func skiplistKey(i int) []byte {
+	return kv.MakeKey([]byte(fmt.Sprintf("%05d", i)), 1, kv.KindPut)
+}
+
+func TestSkipList(t *testing.T) {
+	sl := newSkiplist(1 << 16)
+	nums := []int{19, 3, 25, 6, 7, 23, 9, 12}
+	for _, num := range nums {
+		assert.NoError(t, sl.insert(skiplistKey(num), []byte(fmt.Sprint(num))))
+	}
+	// a key already there keeps its value
+	assert.NoError(t, sl.insert(skiplistKey(6), []byte("six")))
+
+	node := sl.lowerBound(skiplistKey(6))
+	assert.Equal(t, skiplistKey(6), sl.key(node))
+	assert.Equal(t, []byte("6"), sl.value(node))
+	node = sl.lowerBound(skiplistKey(8))
+	assert.Equal(t, skiplistKey(9), sl.key(node))
+	assert.Zero(t, sl.lowerBound(skiplistKey(26)))
+
+	got := make([]int, 0)
+	for node := sl.first(); node != 0; node = sl.next(node, 0) {
+		var num int
+		fmt.Sscanf(string(kv.UserKey(sl.key(node))), "%d", &num)
+		got = append(got, num)
+	}
+	assert.Equal(t, []int{3, 6, 7, 9, 12, 19, 23, 25}, got)
+}
+
+func TestSkipList_Backward(t *testing.T) {
+	sl := newSkiplist(1 << 16)
+	assert.Equal(t, sl.head, sl.lastBefore(skiplistKey(10)))
+	assert.Zero(t, sl.last())
+
+	for i := 98; i >= 0; i -= 2 {
+		assert.NoError(t, sl.insert(skiplistKey(i), nil))
+	}
+	assert.Equal(t, sl.head, sl.lastBefore(skiplistKey(0)))
+	assert.Equal(t, skiplistKey(0), sl.key(sl.lastBefore(skiplistKey(1))))
+	assert.Equal(t, skiplistKey(50), sl.key(sl.lastBefore(skiplistKey(51))))
+
+	want := 98
+	for node := sl.last(); node != 0; node = sl.prev(node) {
+		assert.Equal(t, skiplistKey(want), sl.key(node))
+		want -= 2
+	}
+	assert.Equal(t, -2, want)
+}
+
+func TestSkipList_ConcurrentInsert(t *testing.T) {
+	sl := newSkiplist(1 << 20)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 2000; i += 8 {
+				assert.NoError(t, sl.insert(skiplistKey(i), []byte(fmt.Sprint(i))))
+				// readers see complete nodes while others insert
+				node := sl.lowerBound(skiplistKey(i))
+				assert.Equal(t, skiplistKey(i), sl.key(node))
+				assert.Equal(t, []byte(fmt.Sprint(i)), sl.value(node))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	i := 0
+	for node := sl.first(); node != 0; node = sl.next(node, 0) {
+		assert.Equal(t, skiplistKey(i), sl.key(node))
+		i++
+	}
+	assert.Equal(t, 2000, i)
+}
+
+func TestSkipList_ArenaFull(t *testing.T) {
+	sl := newSkiplist(int(maxNodeSize) * 4)
+	var err error
+	for i := 0; err == nil; i++ {
+		err = sl.insert(skiplistKey(i), []byte("value"))
+	}
+	assert.ErrorIs(t, err, errArenaFull)
+	assert.LessOrEqual(t, sl.size(), sl.arena.capacity())
+}
@@ -1,133 +1,246 @@
 package minilsm
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"minilsm/block"
+	"minilsm/cache"
+	"minilsm/config"
 	"minilsm/iterator"
+	"minilsm/kv"
 	"minilsm/logger"
+	"minilsm/manifest"
 	"minilsm/memtable"
 	"minilsm/sstable"
+	"minilsm/wal"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
-var log = logger.GetLogger()
-
 type StorageInner struct {
 	mu sync.RWMutex
+	// writeMu serializes writers, and flushMu flushes.
+	writeMu sync.Mutex
+	flushMu sync.Mutex
+	// lastSeq is the sequence number of the latest write visible to readers.
+	lastSeq uint64
+	// loggedSeq, guarded by writeMu, is that of the latest write logged.
+	// Writes are applied to the memtable outside writeMu, and lastSeq
+	// catches up with loggedSeq as they are, in order. publishMu guards
+	// pendingWrites, the writes logged but not yet visible, oldest first.
+	loggedSeq     uint64
+	publishMu     sync.Mutex
+	pendingWrites []*pendingWrite
 
 	memTableKeyCount uint64
-	memTableSize     uint64
 	memTable         *memtable.Table
 
+	// immMemTables and l0SSTables are ordered from newest to oldest.
 	immMemTables []*memtable.Table
 
 	l0SSTables []*sstable.Table
-	levels     [][]*sstable.Table
+	// levels[i] is level i+1, a sorted run of non-overlapping tables.
+	levels [][]*sstable.Table
 
 	nextSSTableID uint32
 	path          string
-	blockCache    *sync.Map
+	// opts are the options the storage was opened with, with the defaults
+	// filled in.
+	opts       Options
+	log        logger.Logger
+	blockCache *sstable.BlockCache
+	manifest   *manifest.Manifest
+
+	// refMu guards the bookkeeping of snapshots. tableRefs counts the
+	// snapshots reading from each sstable, and obsoleteTables holds the
+	// sstables compacted away while still referenced.
+	refMu          sync.Mutex
+	snapshots      map[*Snapshot]struct{}
+	tableRefs      map[*sstable.Table]int
+	obsoleteTables map[*sstable.Table]bool
+
+	// stallCond wakes the writes blocked by a write stall. stallMu guards
+	// closing, which is set once Close is called, and bgErr, the error of
+	// the last background flush or compaction, which is nil once one
+	// succeeds.
+	stallMu        sync.Mutex
+	stallCond      *sync.Cond
+	closing        bool
+	bgErr          error
+	stallSlowdowns uint64
+	stallStops     uint64
+	stallNanos     int64
+
+	// compactions are the running compactions, and compacting holds their
+	// input tables. They are guarded by si.mu.
+	compactions []*compactionTask
+	compacting  map[*sstable.Table]bool
+
+	// bgCond wakes the background workers, which run the flushes and
+	// compactions. bgMu guards bgFlushing, which is set while one of them
+	// flushes, and bgClosed, which is set once they are stopped. bgDone is
+	// closed at the same time.
+	bgMu       sync.Mutex
+	bgCond     *sync.Cond
+	bgFlushing bool
+	bgClosed   bool
+	bgDone     chan struct{}
+	bgWorkers  sync.WaitGroup
+}
 
-	shouldClose chan struct{}
-	isClosed    chan struct{}
+var (
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrSnapshotReleased = errors.New("snapshot released")
+	ErrInvalidKey       = errors.New("invalid key")
+	// ErrCorruption is matched by the errors of reads that found corrupted
+	// table data, and of opening a storage whose manifest or write-ahead
+	// logs hold a damaged record. errors.As with an *sstable.CorruptionError
+	// tells where in a table.
+	ErrCorruption = sstable.ErrCorruption
+)
+
+// LastSeq returns the sequence number of the latest write. Passing it to
+// GetAt or ScanAt reads the store as of now.
+func (si *StorageInner) LastSeq() uint64 {
+	return atomic.LoadUint64(&si.lastSeq)
 }
 
+// Get returns the latest value of key, or ErrKeyNotFound if the key was
+// never written or its latest entry is a tombstone. A key that could not
+// have been written, such as an empty one, is ErrInvalidKey.
 func (si *StorageInner) Get(key []byte) ([]byte, error) {
+	return si.GetAt(key, si.LastSeq())
+}
+
+// GetAt returns the value key had right after the write with sequence number
+// seq. Versions overwritten before seq are only kept until compaction
+// garbage-collects them, so reads far in the past may see newer data; use a
+// Snapshot to keep them.
+func (si *StorageInner) GetAt(key []byte, seq uint64) ([]byte, error) {
 	si.mu.RLock()
 	defer si.mu.RUnlock()
+	return si.currentView().get(key, seq)
+}
 
-	val, ok := si.memTable.Get(key)
-	if ok {
-		return val, nil
-	}
-	for _, imt := range si.immMemTables {
-		val, ok := imt.Get(key)
-		if ok {
-			return val, nil
-		}
-	}
+func (si *StorageInner) Put(key, value []byte) bool {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return si.writeOne(batch)
+}
 
-	iterators := make([]iterator.Iterator, 0, len(si.l0SSTables))
-	for _, t := range si.l0SSTables {
-		iter, err := sstable.NewIterAndSeekToKey(t, key)
-		if err != nil {
-			if errors.Is(err, block.ErrKeyNotFound) {
-				continue
-			}
-			return nil, fmt.Errorf("scan: %w", err)
-		}
-		iterators = append(iterators, iter)
-	}
+func (si *StorageInner) Del(key []byte) bool {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return si.writeOne(batch)
+}
 
-	mergedIter := iterator.NewMergeIterator(iterators...)
-	if mergedIter.IsValid() && bytes.Equal(key, mergedIter.Key()) {
-		return mergedIter.Value(), nil
+// DeleteRange deletes every key in [start, end) with a single range
+// tombstone, however many keys the range holds.
+func (si *StorageInner) DeleteRange(start, end []byte) bool {
+	batch := NewWriteBatch()
+	batch.DeleteRange(start, end)
+	return si.writeOne(batch)
+}
+
+func (si *StorageInner) writeOne(batch *WriteBatch) bool {
+	if err := si.Write(batch); err != nil {
+		si.log.Errorf("%v", err)
+		return false
 	}
+	return true
+}
 
-	return nil, errors.New("get: key not found")
+// Scan returns an iterator over the latest values of the keys in
+// [lower, upper]. A scan that fails to read a table stops early, so check
+// Error once the iterator is no longer valid. The iterator keeps the
+// sstables it reads from on disk until it runs off either end, fails or is
+// closed, so close one that is not read to its end.
+func (si *StorageInner) Scan(lower, upper []byte) (iterator.Iterator, error) {
+	return si.ScanAt(lower, upper, si.LastSeq())
 }
 
-func (si *StorageInner) Put(key, value []byte) bool {
-	si.mu.RLock()
-	ok := si.memTable.Put(key, value)
-	si.mu.RUnlock()
-	if ok {
-		atomic.AddUint64(&si.memTableKeyCount, 1)
-		estimateSize := block.SizeOfUint16*2 + len(key) + len(value) + block.SizeOfUint16
-		atomic.AddUint64(&si.memTableSize, uint64(estimateSize))
-	}
-	return ok
+// ScanAt is Scan as of right after the write with sequence number seq.
+//
+// The iterator reads from the sstables that were live when ScanAt was
+// called, and keeps compactions from removing them until it runs off
+// either end, fails or is closed.
+func (si *StorageInner) ScanAt(lower, upper []byte, seq uint64) (iterator.Iterator, error) {
+	return si.scanAt(ScanOptions{Lower: Include(lower), Upper: Include(upper)}, seq)
 }
 
-func (si *StorageInner) Del(key []byte) bool {
-	return si.memTable.Put(key, nil)
+// ScanReverse returns an iterator at the largest of the latest values of
+// the keys in [lower, upper], which walks toward lower with Prev. Like that
+// of Scan, close it unless it is read to its end.
+func (si *StorageInner) ScanReverse(lower, upper []byte) (iterator.Iterator, error) {
+	return si.ScanWithOptions(ScanOptions{Lower: Include(lower), Upper: Include(upper), Reverse: true})
 }
 
-func (si *StorageInner) Scan(lower, upper []byte) (iterator.Iterator, error) {
-	iters := make([]iterator.Iterator, 0, 1+len(si.immMemTables)+len(si.l0SSTables))
-	iter, err := si.memTable.Scan(lower, upper)
+// ScanWithOptions is Scan over the keys selected by opts.
+func (si *StorageInner) ScanWithOptions(opts ScanOptions) (iterator.Iterator, error) {
+	return si.scanAt(opts, si.LastSeq())
+}
+
+// scanAt returns an iterator over the view of the storage as of seq, which
+// references the sstables of the view.
+func (si *StorageInner) scanAt(opts ScanOptions, seq uint64) (iterator.Iterator, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	v := si.currentView()
+	iter, err := v.scanWithOptions(opts, seq)
 	if err != nil {
-		return nil, fmt.Errorf("scan: %w", err)
+		return nil, err
 	}
-	iters = append(iters, iter)
-	for _, t := range si.immMemTables {
-		iter, err := t.Scan(lower, upper)
-		if err != nil {
-			return nil, fmt.Errorf("scan: %w", err)
-		}
-		iters = append(iters, iter)
-	}
-	for _, t := range si.l0SSTables {
-		iter, err := sstable.NewIterAndSeekToKey(t, lower)
-		if err != nil {
-			if errors.Is(err, block.ErrKeyNotFound) {
-				continue
-			}
-			return nil, fmt.Errorf("scan: %w", err)
-		}
-		iters = append(iters, iter)
-	}
-	return iterator.NewMergeIterator(iters...), nil
+	return newPinnedIterator(si, iter, v.sstables()), nil
+}
+
+// BlockCacheStats returns the hits and misses of the block cache and what it
+// holds. A cache shared through Options.BlockCache reports those of all its
+// stores.
+func (si *StorageInner) BlockCacheStats() cache.Stats {
+	return si.blockCache.Stats()
+}
+
+// memTableFull reports whether the memtable has reached
+// Options.MemTableSize or Options.MemTableEntries, so it is due to be
+// replaced. The caller must hold si.mu.
+func (si *StorageInner) memTableFull() bool {
+	return atomic.LoadUint64(&si.memTableKeyCount) >= uint64(si.opts.MemTableEntries) || si.memTable.Size() >= si.opts.MemTableSize
+}
+
+// arenaSize returns the arena size of a new memtable: Options.MemTableSize,
+// the overhead of the skiplist and room for the entry that crosses
+// MemTableSize, if it is no larger than the largest key. A larger write
+// that does not fit in the rest of the arena replaces the memtable early,
+// by one large enough for it.
+func (si *StorageInner) arenaSize() int {
+	slack := memtable.EntryOverhead + config.MaxKeyLength + kv.TrailerSize
+	return si.opts.MemTableSize + memtable.TableOverhead + slack
 }
 
-func (si *StorageInner) checkIfNewMemTableShouldBeCreate() bool {
-	return atomic.LoadUint64(&si.memTableKeyCount) >= 1000 || atomic.LoadUint64(&si.memTableSize) >= 10*4*1024
+func (si *StorageInner) newMemTable() error {
+	return si.newMemTableOfSize(si.arenaSize())
 }
 
-func (si *StorageInner) newMemTable() {
+// newMemTableOfSize makes the memtable immutable and replaces it with a new
+// one whose arena holds arenaSize bytes.
+func (si *StorageInner) newMemTableOfSize(arenaSize int) error {
+	id := si.allocFileID()
+	mt, err := memtable.NewTableWithWAL(id, si.walPath(id), arenaSize)
+	if err != nil {
+		return fmt.Errorf("new memtable: %w", err)
+	}
+
 	si.mu.Lock()
-	si.memTable, si.immMemTables = memtable.NewTable(), append(si.immMemTables, si.memTable)
+	si.memTable, si.immMemTables = mt, append([]*memtable.Table{si.memTable}, si.immMemTables...)
 	si.mu.Unlock()
 
 	atomic.SwapUint64(&si.memTableKeyCount, 0)
-	atomic.SwapUint64(&si.memTableSize, 0)
+	si.scheduleBackgroundWork()
+	return nil
 }
 
 func (si *StorageInner) checkIfImmMemTableShouldFlushToSSTable() bool {
@@ -137,146 +250,298 @@ func (si *StorageInner) checkIfImmMemTableShouldFlushToSSTable() bool {
 	return len(si.immMemTables) > 0
 }
 
+// newTableBuilder returns a builder for an sstable of the given level.
+func (si *StorageInner) newTableBuilder(level int) *sstable.TableBulder {
+	opts := make([]sstable.BuilderOption, 0, 2)
+	if si.opts.FilterPolicy != nil {
+		opts = append(opts, sstable.WithFilterPolicy(si.opts.FilterPolicy))
+	}
+	if compressors := si.opts.Compression; len(compressors) > 0 {
+		if c := compressors[min(level, len(compressors)-1)]; c != nil {
+			opts = append(opts, sstable.WithCompressor(c))
+		}
+	}
+	return sstable.NewTableBuilder(uint32(si.opts.BlockSize), opts...)
+}
+
+func (si *StorageInner) allocFileID() uint32 {
+	return atomic.AddUint32(&si.nextSSTableID, 1) - 1
+}
+
 func (si *StorageInner) sstPath(id uint32) string {
 	return filepath.Join(si.path, strconv.Itoa(int(id))+".sst")
 }
 
+func (si *StorageInner) walPath(id uint32) string {
+	return filepath.Join(si.path, strconv.Itoa(int(id))+".wal")
+}
+
+// sinkImmMemTableToSSTable flushes the oldest immutable memtable into an L0
+// table. The table is built and logged to the manifest without si.mu, which
+// is only taken to install it in place of the memtable, so reads and writes
+// go on meanwhile. Flushes run one at a time, so L0 keeps the order of the
+// memtables.
 func (si *StorageInner) sinkImmMemTableToSSTable() error {
-	si.mu.Lock()
-	defer si.mu.Unlock()
+	si.flushMu.Lock()
+	defer si.flushMu.Unlock()
 
+	si.mu.RLock()
 	if len(si.immMemTables) == 0 {
+		si.mu.RUnlock()
 		return nil
 	}
-
-	sstID := si.nextSSTableID
 	flushMemTable := si.immMemTables[len(si.immMemTables)-1]
-	builder := sstable.NewTableBuilder(4096)
-	err := flushMemTable.Flush(builder)
-	if err != nil {
-		return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
-	}
+	si.mu.RUnlock()
 
-	ssTable, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
-	if err != nil {
-		return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
+	sstID := flushMemTable.ID()
+	flushMemTable.WaitForWrites()
+	var ssTable *sstable.Table
+	if !flushMemTable.IsEmpty() {
+		builder := si.newTableBuilder(0)
+		err := flushMemTable.Flush(builder)
+		if err != nil {
+			return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
+		}
+
+		ssTable, err = builder.Build(sstID, si.blockCache, si.sstPath(sstID))
+		if err != nil {
+			return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
+		}
+		err = si.manifest.Log(&manifest.Edit{
+			NextFileID: atomic.LoadUint32(&si.nextSSTableID),
+			LastSeq:    atomic.LoadUint64(&si.lastSeq),
+			Added:      []manifest.TableRef{{Level: 0, ID: sstID}},
+		})
+		if err != nil {
+			ssTable.Close()
+			os.Remove(si.sstPath(sstID))
+			return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
+		}
 	}
 
+	// new memtables are queued in front, so the flushed one is still last
+	si.mu.Lock()
+	if ssTable != nil {
+		si.l0SSTables = append([]*sstable.Table{ssTable}, si.l0SSTables...)
+	}
 	si.immMemTables = si.immMemTables[:len(si.immMemTables)-1]
-	si.l0SSTables = append([]*sstable.Table{ssTable}, si.l0SSTables...)
-	si.nextSSTableID += 1
+	si.mu.Unlock()
+	si.wakeStalledWrites()
+
+	// the memtable is durable in the sstable now, so its log is no longer needed
+	if err := flushMemTable.CloseWAL(); err != nil {
+		return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
+	}
+	if err := os.Remove(si.walPath(sstID)); err != nil {
+		return fmt.Errorf("sinkImmMemTableToSSTable: %w", err)
+	}
 
 	return nil
 }
 
-func (si *StorageInner) checkIfSSTShouldBeCompact() bool {
-	si.mu.RLock()
-	defer si.mu.RUnlock()
-
-	return len(si.l0SSTables) >= 2
+// Close waits for the running flushes and compactions, stops the
+// background workers and closes the files of the storage. Writes blocked by
+// a write stall fail with ErrClosed.
+func (si *StorageInner) Close() {
+	si.stallMu.Lock()
+	si.closing = true
+	si.stallCond.Broadcast()
+	si.stallMu.Unlock()
+	si.stopBackgroundWorkers()
+
+	for _, sst := range si.l0SSTables {
+		sst.Close()
+	}
+	for _, level := range si.levels {
+		for _, sst := range level {
+			sst.Close()
+		}
+	}
+	si.refMu.Lock()
+	for sst := range si.obsoleteTables {
+		sst.Close()
+	}
+	si.refMu.Unlock()
+	if err := si.manifest.Close(); err != nil {
+		si.log.Errorf("close: %v", err)
+	}
+	for _, mt := range append([]*memtable.Table{si.memTable}, si.immMemTables...) {
+		if err := mt.CloseWAL(); err != nil {
+			si.log.Errorf("close: %v", err)
+		}
+	}
 }
 
-func (si *StorageInner) compactSSTs() error {
-	log.Infof("compact with l0SSTables: %v", len(si.l0SSTables))
-	if len(si.l0SSTables) >= 2 {
-		si.mu.RLock()
-		l0SSTableLength := len(si.l0SSTables)
-		sn := si.l0SSTables[l0SSTableLength-1]
-		snID := sn.SSTID()
-		snm1 := si.l0SSTables[l0SSTableLength-2]
-		snm1ID := snm1.SSTID()
-		si.mu.RUnlock()
+// newStorageInner opens the storage at path, creating it if needed. The
+// sstables recorded in the manifest are reopened, and memtables that were not
+// yet flushed when the storage was last closed are recovered from their
+// write-ahead logs and queued for flushing. A nil opts uses DefaultOptions.
+func newStorageInner(path string, opts *Options) (*StorageInner, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	o := *opts
+	o.setDefaults()
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("new storage inner: %w", err)
+	}
+	o.CompactionStrategy = o.compactionStrategy()
 
-		snIter, error := sstable.NewIterAndSeekToFirst(sn)
-		if error != nil {
-			return fmt.Errorf("compact: %w", error)
-		}
-		snm1Iter, error := sstable.NewIterAndSeekToFirst(snm1)
-		if error != nil {
-			return fmt.Errorf("compact: %w", error)
-		}
+	si := &StorageInner{
+		opts:           o,
+		log:            o.Logger,
+		immMemTables:   make([]*memtable.Table, 0),
+		l0SSTables:     make([]*sstable.Table, 0),
+		levels:         make([][]*sstable.Table, maxLevels),
+		nextSSTableID:  1,
+		path:           path,
+		snapshots:      make(map[*Snapshot]struct{}),
+		tableRefs:      make(map[*sstable.Table]int),
+		obsoleteTables: make(map[*sstable.Table]bool),
+		compacting:     make(map[*sstable.Table]bool),
+		bgDone:         make(chan struct{}),
+	}
+	si.stallCond = sync.NewCond(&si.stallMu)
+	si.bgCond = sync.NewCond(&si.bgMu)
+	if o.BlockCache != nil {
+		si.blockCache = sstable.NewBlockCache(o.BlockCache)
+	} else {
+		si.blockCache = sstable.NewBlockCache(cache.New(o.BlockCacheSize))
+	}
 
-		mergedIter := iterator.NewMergeIterator(snIter, snm1Iter)
-		builder := sstable.NewTableBuilder(4096)
-		for mergedIter.IsValid() {
-			builder.Add(mergedIter.Key(), mergedIter.Value())
-			mergedIter.Next()
-		}
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("new storage inner: %w", err)
+	}
+	if err := si.recoverSSTables(); err != nil {
+		return nil, fmt.Errorf("new storage inner: %w", recoveryError(err))
+	}
+	if err := si.recoverMemTables(); err != nil {
+		return nil, fmt.Errorf("new storage inner: %w", recoveryError(err))
+	}
+	si.loggedSeq = si.lastSeq
+
+	id := si.allocFileID()
+	mt, err := memtable.NewTableWithWAL(id, si.walPath(id), si.arenaSize())
+	if err != nil {
+		return nil, fmt.Errorf("new storage inner: %w", err)
+	}
+	si.memTable = mt
+
+	// the workers flush the recovered memtables right away
+	si.startBackgroundWorkers()
+	return si, nil
+}
 
-		sstID := si.nextSSTableID
-		ssTable, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
+// recoveryError makes err match ErrCorruption if a log was found damaged.
+func recoveryError(err error) error {
+	if errors.Is(err, wal.ErrCorruption) {
+		return fmt.Errorf("%w: %w", ErrCorruption, err)
+	}
+	return err
+}
+
+// recoverSSTables opens the manifest and every sstable it records as live.
+func (si *StorageInner) recoverSSTables() error {
+	m, state, err := manifest.Open(si.path)
+	if err != nil {
+		return fmt.Errorf("recover sstables: %w", err)
+	}
+	si.manifest = m
+	if state.NextFileID > si.nextSSTableID {
+		si.nextSSTableID = state.NextFileID
+	}
+	si.lastSeq = state.LastSeq
+
+	for _, id := range state.L0 {
+		t, err := sstable.OpenTable(id, si.blockCache, si.sstPath(id))
 		if err != nil {
-			return fmt.Errorf("compact: %w", err)
+			return fmt.Errorf("recover sstables: %w", err)
 		}
-		si.nextSSTableID += 1
-
-		defer func() {
-			sn.Close()
-			snm1.Close()
-			os.Remove(si.sstPath(snID))
-			os.Remove(si.sstPath(snm1ID))
-		}()
-
-		si.mu.Lock()
-		if si.l0SSTables[l0SSTableLength-1].SSTID() == snID && si.l0SSTables[l0SSTableLength-2].SSTID() == snm1ID {
-			si.l0SSTables = append(si.l0SSTables[0:l0SSTableLength-2], ssTable)
+		si.l0SSTables = append(si.l0SSTables, t)
+	}
+	for i, ids := range state.Levels {
+		level := make([]*sstable.Table, 0, len(ids))
+		for _, id := range ids {
+			t, err := sstable.OpenTable(id, si.blockCache, si.sstPath(id))
+			if err != nil {
+				return fmt.Errorf("recover sstables: %w", err)
+			}
+			level = append(level, t)
 		}
-		si.mu.Unlock()
+		sortLevel(level)
+		si.levels[i] = level
 	}
 	return nil
 }
 
-func (si *StorageInner) internalLoopTask() {
-	ticker := time.NewTicker(time.Second * 5)
-	for range ticker.C {
-		if si.checkIfNewMemTableShouldBeCreate() {
-			log.Info("create new memtable\n")
-			si.newMemTable()
+func (si *StorageInner) isLiveSSTable(id uint32) bool {
+	for _, t := range si.l0SSTables {
+		if t.SSTID() == id {
+			return true
 		}
-
-		if si.checkIfImmMemTableShouldFlushToSSTable() {
-			log.Info("start to sink immutable memtable to sstable\n")
-			err := si.sinkImmMemTableToSSTable()
-			if err != nil {
-				log.Errorf("internalLoopTask: ", err)
+	}
+	for _, level := range si.levels {
+		for _, t := range level {
+			if t.SSTID() == id {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		if si.checkIfSSTShouldBeCompact() {
-			si.compactSSTs()
-		}
+// recoverMemTables replays every write-ahead log found in si.path into an
+// immutable memtable and moves nextSSTableID past all existing file IDs.
+// sstables missing from the manifest were left behind by an interrupted
+// flush or compaction and are removed, and so are the logs of the
+// memtables whose flush was interrupted after their table was recorded.
+func (si *StorageInner) recoverMemTables() error {
+	entries, err := os.ReadDir(si.path)
+	if err != nil {
+		return fmt.Errorf("recover memtables: %w", err)
+	}
 
-		select {
-		case <-si.shouldClose:
-			for _, sst := range si.l0SSTables {
-				sst.Close()
-			}
-			ticker.Stop()
-			si.isClosed <- struct{}{}
-			return
-		default:
+	walIDs := make([]uint32, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if ext != ".wal" && ext != ".sst" {
 			continue
 		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 32)
+		if err != nil {
+			continue
+		}
+		if uint32(id) >= si.nextSSTableID {
+			si.nextSSTableID = uint32(id) + 1
+		}
+		if ext == ".wal" {
+			// a log whose table is live was flushed before the crash, but
+			// not yet removed
+			if si.isLiveSSTable(uint32(id)) {
+				if err := os.Remove(si.walPath(uint32(id))); err != nil {
+					return fmt.Errorf("recover memtables: %w", err)
+				}
+				continue
+			}
+			walIDs = append(walIDs, uint32(id))
+		} else if !si.isLiveSSTable(uint32(id)) {
+			if err := os.Remove(si.sstPath(uint32(id))); err != nil {
+				return fmt.Errorf("recover memtables: %w", err)
+			}
+		}
 	}
-}
 
-func (si *StorageInner) Close() {
-	si.shouldClose <- struct{}{}
-	<-si.isClosed
-}
-
-func NewStorageInner(path string) *StorageInner {
-	si := &StorageInner{
-		memTable:      memtable.NewTable(),
-		immMemTables:  make([]*memtable.Table, 0),
-		l0SSTables:    make([]*sstable.Table, 0),
-		levels:        make([][]*sstable.Table, 0),
-		nextSSTableID: 1,
-		path:          path,
-		blockCache:    &sync.Map{},
-		shouldClose:   make(chan struct{}, 1),
-		isClosed:      make(chan struct{}),
-	}
-	go si.internalLoopTask()
-	return si
+	slices.Sort(walIDs)
+	for _, id := range walIDs {
+		mt, err := memtable.RecoverFromWAL(id, si.walPath(id))
+		if err != nil {
+			return fmt.Errorf("recover memtables: %w", err)
+		}
+		if mt.MaxSeq() > si.lastSeq {
+			si.lastSeq = mt.MaxSeq()
+		}
+		si.immMemTables = append([]*memtable.Table{mt}, si.immMemTables...)
+	}
+	return nil
 }
@@ -1,9 +1,24 @@
 package minilsm
 
 import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
 	"math/rand"
+	"minilsm/cache"
+	"minilsm/compaction"
+	"minilsm/compress"
+	"minilsm/filter"
+	"minilsm/kv"
+	"minilsm/sstable"
 	"minilsm/util"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,7 +27,8 @@ import (
 
 func TestInternalStorage(t *testing.T) {
 	path := t.TempDir()
-	si := NewStorageInner(path)
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
 	t.Cleanup(func() {
 		si.Close()
 	})
@@ -30,6 +46,7 @@ func TestInternalStorage(t *testing.T) {
 func testRange(t *testing.T, si *StorageInner, from, to int) {
 	scanner, err := si.Scan(util.KeyOf(from), util.KeyOf(to))
 	assert.NoError(t, err)
+	defer scanner.Close()
 
 	for i := from; i < to; i++ {
 		assert.True(t, scanner.IsValid())
@@ -39,9 +56,326 @@ func testRange(t *testing.T, si *StorageInner, from, to int) {
 	}
 }
 
+func TestRecoverFromWAL(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+
+	for _, kv := range util.GeneratePairs(100) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	si.Close()
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	for i := 0; i < 100; i++ {
+		got, err := si.Get(util.KeyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, util.ValueOf(i), got)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := t.TempDir()
+	// L0 keeps every flushed table
+	opts := DefaultOptions()
+	opts.L0CompactionTrigger = 4
+	si, err := newStorageInner(path, opts)
+	assert.NoError(t, err)
+
+	for _, kv := range util.GeneratePairs(100) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	assert.NoError(t, si.newMemTable())
+	assert.NoError(t, si.sinkImmMemTableToSSTable())
+	si.Close()
+
+	si, err = newStorageInner(path, opts)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	assert.Len(t, si.l0SSTables, 1)
+
+	testRange(t, si, 0, 100)
+	for _, kv := range util.GeneratePairs(200)[100:] {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	assert.NoError(t, si.newMemTable())
+	for si.checkIfImmMemTableShouldFlushToSSTable() {
+		assert.NoError(t, si.sinkImmMemTableToSSTable())
+	}
+	assert.Len(t, si.l0SSTables, 2)
+	testRange(t, si, 0, 200)
+}
+
+func flushAll(t *testing.T, si *StorageInner) {
+	assert.NoError(t, si.newMemTable())
+	for si.checkIfImmMemTableShouldFlushToSSTable() {
+		assert.NoError(t, si.sinkImmMemTableToSSTable())
+	}
+}
+
+// compactAll runs compactions until none is needed, waiting for those the
+// background workers run.
+func compactAll(t *testing.T, si *StorageInner) {
+	for {
+		task := si.startCompaction()
+		if task == nil {
+			si.mu.RLock()
+			running := len(si.compactions) > 0
+			si.mu.RUnlock()
+			if !running && si.pickCompaction() == nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		assert.NoError(t, si.compact(task))
+		si.finishCompaction(task)
+	}
+}
+
+// switchedStrategy is the default strategy once enabled, and compacts
+// nothing before, so the background workers leave the tables as a test
+// lays them out.
+type switchedStrategy struct {
+	compaction.Strategy
+	enabled atomic.Bool
+}
+
+func newSwitchedStrategy() *switchedStrategy {
+	return &switchedStrategy{Strategy: compaction.NewLeveled(l0CompactionTrigger, levelBaseSize, levelSizeMultiplier)}
+}
+
+func (s *switchedStrategy) PickCompaction(layout *compaction.Layout) *compaction.Task {
+	if !s.enabled.Load() {
+		return nil
+	}
+	return s.Strategy.PickCompaction(layout)
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	for _, kv := range util.GeneratePairs(1000) {
+		assert.True(t, si.Put(kv.K, []byte("stale")))
+	}
+	flushAll(t, si)
+
+	const n = 40000
+	kvs := util.GeneratePairs(n)
+	for from := 0; from < n; from += 2000 {
+		for _, kv := range kvs[from : from+2000] {
+			assert.True(t, si.Put(kv.K, kv.V))
+		}
+		flushAll(t, si)
+		compactAll(t, si)
+	}
+
+	strategy := si.opts.CompactionStrategy.(*compaction.Leveled)
+	assert.Less(t, len(si.l0SSTables), l0CompactionTrigger)
+	assert.NotEmpty(t, si.levels[1])
+	for i, level := range si.levels {
+		if i < len(si.levels)-1 {
+			var size uint64
+			for _, sst := range level {
+				size += sst.Size()
+			}
+			assert.LessOrEqual(t, size, strategy.TargetSize(i+1))
+		}
+		checkSortedRun(t, level)
+	}
+	checkAllKeys(t, si, n)
+}
+
+func checkSortedRun(t *testing.T, level []*sstable.Table) {
+	for j := 1; j < len(level); j++ {
+		assert.Less(t, string(level[j-1].LastKey()), string(level[j].FirstKey()))
+	}
+}
+
+func checkAllKeys(t *testing.T, si *StorageInner, n int) {
+	for i := 0; i < n; i += 7 {
+		got, err := si.Get(util.KeyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, util.ValueOf(i), got)
+	}
+	testRange(t, si, 0, n)
+}
+
+func TestTieredCompaction(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, &Options{CompactionStrategy: compaction.NewTiered(4)})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	for _, kv := range util.GeneratePairs(1000) {
+		assert.True(t, si.Put(kv.K, []byte("stale")))
+	}
+	flushAll(t, si)
+
+	const n = 20000
+	kvs := util.GeneratePairs(n)
+	for from := 0; from < n; from += 1000 {
+		for _, kv := range kvs[from : from+1000] {
+			assert.True(t, si.Put(kv.K, kv.V))
+		}
+		flushAll(t, si)
+		compactAll(t, si)
+
+		runs := len(si.l0SSTables)
+		for _, level := range si.levels {
+			if len(level) > 0 {
+				runs++
+			}
+			checkSortedRun(t, level)
+		}
+		assert.Less(t, runs, 4)
+	}
+	checkAllKeys(t, si, n)
+}
+
+func TestDelete(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	for _, kv := range util.GeneratePairs(100) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	flushAll(t, si)
+	for i := 0; i < 100; i += 2 {
+		assert.True(t, si.Del(util.KeyOf(i)))
+	}
+	assert.True(t, si.Put(util.KeyOf(200), []byte{}))
+
+	checkDeleted := func() {
+		for i := 0; i < 100; i++ {
+			got, err := si.Get(util.KeyOf(i))
+			if i%2 == 0 {
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, util.ValueOf(i), got)
+			}
+		}
+		got, err := si.Get(util.KeyOf(200))
+		assert.NoError(t, err)
+		assert.Empty(t, got)
+
+		scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(200))
+		assert.NoError(t, err)
+		defer scanner.Close()
+		for i := 1; i < 100; i += 2 {
+			assert.True(t, scanner.IsValid())
+			assert.Equal(t, util.KeyOf(i), scanner.Key())
+			scanner.Next()
+		}
+		assert.True(t, scanner.IsValid())
+		assert.Equal(t, util.KeyOf(200), scanner.Key())
+		scanner.Next()
+		assert.False(t, scanner.IsValid())
+	}
+
+	checkDeleted()
+	flushAll(t, si)
+	checkDeleted()
+
+	// the compaction into the bottom of the tree drops the tombstones
+	compactAll(t, si)
+	checkDeleted()
+	entries := 0
+	for _, level := range si.levels {
+		iter, err := sstable.NewConcatIterAndSeekToFirst(level)
+		assert.NoError(t, err)
+		for ; iter.IsValid(); iter.Next() {
+			assert.Equal(t, kv.KindPut, kv.KindOf(iter.Key()))
+			entries++
+		}
+	}
+	assert.Equal(t, 51, entries)
+}
+
+func TestReadAtSeq(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+
+	key := util.KeyOf(1)
+	assert.True(t, si.Put(key, []byte("v1")))
+	seq1 := si.LastSeq()
+	assert.True(t, si.Put(key, []byte("v2")))
+	seq2 := si.LastSeq()
+	assert.True(t, si.Del(key))
+	seq3 := si.LastSeq()
+	assert.True(t, si.Put(util.KeyOf(2), []byte("other")))
+
+	checkHistory := func() {
+		_, err := si.GetAt(key, seq1-1)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		for seq, want := range map[uint64]string{seq1: "v1", seq2: "v2"} {
+			got, err := si.GetAt(key, seq)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(want), got)
+
+			scanner, err := si.ScanAt(util.KeyOf(0), util.KeyOf(2), seq)
+			assert.NoError(t, err)
+			assert.True(t, scanner.IsValid())
+			assert.Equal(t, key, scanner.Key())
+			assert.Equal(t, []byte(want), scanner.Value())
+			scanner.Next()
+			assert.False(t, scanner.IsValid())
+			assert.NoError(t, scanner.Close())
+		}
+		_, err = si.GetAt(key, seq3)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		_, err = si.Get(key)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+
+	checkHistory()
+	flushAll(t, si)
+	checkHistory()
+	si.Close()
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	assert.Equal(t, seq3+1, si.LastSeq())
+	checkHistory()
+
+	// compaction keeps only the versions visible at the latest sequence number
+	assert.True(t, si.Put(util.KeyOf(3), []byte("x")))
+	flushAll(t, si)
+	compactAll(t, si)
+	got, err := si.GetAt(key, seq2)
+	assert.ErrorIs(t, err, ErrKeyNotFound, "got %q", got)
+	got, err = si.Get(util.KeyOf(2))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("other"), got)
+}
+
 func TestConcurrencySafe(t *testing.T) {
 	path := t.TempDir()
-	si := NewStorageInner(path)
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
 	t.Cleanup(func() {
 		si.Close()
 	})
@@ -66,3 +400,1475 @@ func TestConcurrencySafe(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestConcurrentWritesOverlap(t *testing.T) {
+	si, err := newStorageInner(t.TempDir(), nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	// a write logged, but not applied yet
+	first := NewWriteBatch()
+	first.Put([]byte("a"), []byte("1"))
+	si.writeMu.Lock()
+	w, err := si.logBatch(first)
+	si.writeMu.Unlock()
+	assert.NoError(t, err)
+	seq := si.LastSeq()
+
+	// does not keep a later one from being applied
+	second := NewWriteBatch()
+	second.Put([]byte("b"), []byte("2"))
+	done := make(chan error)
+	go func() {
+		done <- si.Write(second)
+	}()
+	assert.Eventually(t, func() bool {
+		si.mu.RLock()
+		defer si.mu.RUnlock()
+		_, _, ok := si.memTable.Get([]byte("b"), kv.MaxSeq)
+		return ok
+	}, 5*time.Second, time.Millisecond)
+
+	// which is only visible after it
+	select {
+	case err := <-done:
+		t.Fatalf("write returned before the one logged before it: %v", err)
+	default:
+	}
+	assert.Equal(t, seq, si.LastSeq())
+	_, err = si.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	assert.NoError(t, si.applyWrite(w))
+	assert.NoError(t, <-done)
+	assert.Equal(t, seq+2, si.LastSeq())
+	got, err := si.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), got)
+	got, err = si.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), got)
+}
+
+func TestSnapshot(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	const n = 2000
+	for _, kv := range util.GeneratePairs(n) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	flushAll(t, si)
+	snap := si.NewSnapshot()
+
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			assert.True(t, si.Del(util.KeyOf(i)))
+		} else {
+			assert.True(t, si.Put(util.KeyOf(i), []byte("new")))
+		}
+	}
+	flushAll(t, si)
+	compactAll(t, si)
+	assert.NotEmpty(t, si.obsoleteTables)
+
+	for i := 0; i < n; i += 7 {
+		got, err := snap.Get(util.KeyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, util.ValueOf(i), got)
+	}
+	scanner, err := snap.Scan(util.KeyOf(0), util.KeyOf(n-1))
+	assert.NoError(t, err)
+	defer scanner.Close()
+	for i := 0; i < n; i++ {
+		assert.True(t, scanner.IsValid())
+		assert.Equal(t, util.KeyOf(i), scanner.Key())
+		assert.Equal(t, util.ValueOf(i), scanner.Value())
+		scanner.Next()
+	}
+	assert.False(t, scanner.IsValid())
+
+	obsolete := make([]uint32, 0)
+	for sst := range si.obsoleteTables {
+		obsolete = append(obsolete, sst.SSTID())
+	}
+	snap.Release()
+	snap.Release()
+	assert.Empty(t, si.obsoleteTables)
+	assert.Empty(t, si.tableRefs)
+	for _, id := range obsolete {
+		assert.NoFileExists(t, si.sstPath(id))
+	}
+	_, err = snap.Get(util.KeyOf(0))
+	assert.ErrorIs(t, err, ErrSnapshotReleased)
+
+	// without snapshots, compaction drops the versions the snapshot saw
+	compactAll(t, si)
+	for i := 0; i < n; i += 7 {
+		got, err := si.Get(util.KeyOf(i))
+		if i%3 == 0 {
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("new"), got)
+		}
+	}
+}
+
+func TestScanPinsTables(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	const n = 2000
+	for _, kv := range util.GeneratePairs(n) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	flushAll(t, si)
+	scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(n-1))
+	assert.NoError(t, err)
+	for i := 0; i < n/2; i++ {
+		scanner.Next()
+	}
+
+	// a compaction under the scan keeps the tables it reads from
+	for i := 0; i < n; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), []byte("new")))
+	}
+	flushAll(t, si)
+	compactAll(t, si)
+	assert.NotEmpty(t, si.obsoleteTables)
+	obsolete := make([]uint32, 0)
+	for sst := range si.obsoleteTables {
+		obsolete = append(obsolete, sst.SSTID())
+		assert.FileExists(t, si.sstPath(sst.SSTID()))
+	}
+	for i := n / 2; i < n; i++ {
+		assert.True(t, scanner.IsValid())
+		assert.Equal(t, util.KeyOf(i), scanner.Key())
+		assert.Equal(t, util.ValueOf(i), scanner.Value())
+		scanner.Next()
+	}
+	assert.False(t, scanner.IsValid())
+
+	// and lets them go once it is done
+	assert.Empty(t, si.obsoleteTables)
+	assert.Empty(t, si.tableRefs)
+	for _, id := range obsolete {
+		assert.NoFileExists(t, si.sstPath(id))
+	}
+	assert.NoError(t, scanner.Close())
+
+	// or closed
+	scanner, err = si.Scan(util.KeyOf(0), util.KeyOf(n-1))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, si.tableRefs)
+	assert.NoError(t, scanner.Close())
+	assert.Empty(t, si.tableRefs)
+	assert.False(t, scanner.IsValid())
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), []byte("0")))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; round < 10; round++ {
+			for i := 0; i < n; i++ {
+				si.Put(util.KeyOf(i), []byte(strconv.Itoa(round)))
+			}
+			flushAll(t, si)
+			compactAll(t, si)
+		}
+	}()
+
+	for stop := false; !stop; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+		snap := si.NewSnapshot()
+		first, err := snap.Get(util.KeyOf(0))
+		assert.NoError(t, err)
+		scanner, err := snap.Scan(util.KeyOf(0), util.KeyOf(n-1))
+		assert.NoError(t, err)
+		count := 0
+		for ; scanner.IsValid(); scanner.Next() {
+			// a round overwrites the keys in order, so no key is older than
+			// a key after it
+			assert.LessOrEqual(t, string(scanner.Value()), string(first))
+			count++
+		}
+		assert.Equal(t, n, count)
+		assert.NoError(t, scanner.Close())
+		snap.Release()
+	}
+}
+
+func TestTxn(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	assert.True(t, si.Put([]byte("a"), []byte("1")))
+	assert.True(t, si.Put([]byte("b"), []byte("2")))
+
+	txn := si.Begin()
+	got, err := txn.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), got)
+	assert.NoError(t, txn.Put([]byte("a"), []byte("3")))
+	assert.NoError(t, txn.Delete([]byte("b")))
+	assert.ErrorIs(t, txn.Put(nil, []byte("x")), ErrInvalidKey)
+
+	// the transaction reads its own writes, others do not see them yet
+	got, err = txn.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), got)
+	_, err = txn.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	got, err = si.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), got)
+
+	seq := si.LastSeq()
+	assert.NoError(t, txn.Commit())
+	assert.Equal(t, seq+2, si.LastSeq())
+	got, err = si.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), got)
+	_, err = si.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	_, err = txn.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrTxnDone)
+
+	txn = si.Begin()
+	assert.NoError(t, txn.Put([]byte("c"), []byte("4")))
+	txn.Rollback()
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	_, err = si.Get([]byte("c"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Empty(t, si.snapshots)
+}
+
+func TestTxnConflict(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	assert.True(t, si.Put([]byte("a"), []byte("1")))
+
+	txn1 := si.Begin()
+	txn2 := si.Begin()
+	_, err = txn1.Get([]byte("a"))
+	assert.NoError(t, err)
+	_, err = txn2.Get([]byte("a"))
+	assert.NoError(t, err)
+	// reading a missing key conflicts with creating it too
+	_, err = txn2.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.NoError(t, txn1.Put([]byte("a"), []byte("2")))
+	assert.NoError(t, txn1.Commit())
+	assert.NoError(t, txn2.Put([]byte("a"), []byte("3")))
+	assert.ErrorIs(t, txn2.Commit(), ErrTxnConflict)
+
+	got, err := si.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), got)
+
+	txn3 := si.Begin()
+	_, err = txn3.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.True(t, si.Put([]byte("b"), []byte("1")))
+	flushAll(t, si)
+	assert.NoError(t, txn3.Put([]byte("c"), []byte("1")))
+	assert.ErrorIs(t, txn3.Commit(), ErrTxnConflict)
+
+	// blind writes never conflict
+	txn4 := si.Begin()
+	assert.True(t, si.Put([]byte("a"), []byte("4")))
+	assert.NoError(t, txn4.Put([]byte("a"), []byte("5")))
+	assert.NoError(t, txn4.Commit())
+	got, err = si.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("5"), got)
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	key := []byte("counter")
+	assert.True(t, si.Put(key, []byte("0")))
+
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				txn := si.Begin()
+				got, err := txn.Get(key)
+				assert.NoError(t, err)
+				n, err := strconv.Atoi(string(got))
+				assert.NoError(t, err)
+				assert.NoError(t, txn.Put(key, []byte(strconv.Itoa(n+1))))
+				if err := txn.Commit(); err != nil {
+					assert.ErrorIs(t, err, ErrTxnConflict)
+					continue
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := si.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(workers*increments), string(got))
+}
+
+func TestWriteBatch(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+
+	for _, kv := range util.GeneratePairs(10) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	flushAll(t, si)
+
+	batch := NewWriteBatch()
+	batch.Put(util.KeyOf(20), util.ValueOf(20))
+	batch.Put(util.KeyOf(5), []byte("new"))
+	batch.DeleteRange(util.KeyOf(2), util.KeyOf(6))
+	batch.Put(util.KeyOf(3), util.ValueOf(3))
+	batch.Delete(util.KeyOf(8))
+	assert.Equal(t, 5, batch.Count())
+
+	decoded, err := DecodeWriteBatch(batch.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, batch.Bytes(), decoded.Bytes())
+	_, err = DecodeWriteBatch(batch.Bytes()[:len(batch.Bytes())-1])
+	assert.ErrorIs(t, err, ErrInvalidBatch)
+
+	seq := si.LastSeq()
+	assert.NoError(t, si.Write(decoded))
+	// the range delete is a single tombstone, however many keys it deletes
+	assert.Equal(t, seq+5, si.LastSeq())
+
+	check := func() {
+		want := []int{0, 1, 3, 6, 7, 9, 20}
+		scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(20))
+		assert.NoError(t, err)
+		defer scanner.Close()
+		for _, i := range want {
+			assert.True(t, scanner.IsValid())
+			assert.Equal(t, util.KeyOf(i), scanner.Key())
+			assert.Equal(t, util.ValueOf(i), scanner.Value())
+			scanner.Next()
+		}
+		assert.False(t, scanner.IsValid())
+		_, err = si.Get(util.KeyOf(5))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+	check()
+	si.Close()
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	check()
+
+	// a batch with an invalid write applies nothing
+	batch.Reset()
+	assert.Equal(t, 0, batch.Count())
+	batch.Put(util.KeyOf(30), util.ValueOf(30))
+	batch.Put(nil, util.ValueOf(31))
+	seq = si.LastSeq()
+	assert.ErrorIs(t, si.Write(batch), ErrInvalidKey)
+	assert.Equal(t, seq, si.LastSeq())
+	_, err = si.Get(util.KeyOf(30))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestWriteBatchAtomic(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	const n = 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 0; round < 50; round++ {
+			batch := NewWriteBatch()
+			for i := 0; i < n; i++ {
+				batch.Put(util.KeyOf(i), []byte(strconv.Itoa(round)))
+			}
+			assert.NoError(t, si.Write(batch))
+		}
+	}()
+
+	for stop := false; !stop; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+		// the scanner keeps its tables while compactions run
+		scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(n-1))
+		assert.NoError(t, err)
+		defer scanner.Close()
+		if scanner.IsValid() {
+			first, count := string(scanner.Value()), 0
+			for ; scanner.IsValid(); scanner.Next() {
+				assert.Equal(t, first, string(scanner.Value()))
+				count++
+			}
+			assert.Equal(t, n, count)
+		}
+		assert.NoError(t, scanner.Error())
+		assert.NoError(t, scanner.Close())
+	}
+}
+
+func TestWriteFillsMemTable(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+
+	// a full memtable is replaced before the write that does not fit
+	value := bytes.Repeat([]byte("v"), 4<<10)
+	n := 2 * si.arenaSize() / len(value)
+	for i := 0; i < n; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), value))
+	}
+	assert.Less(t, si.memTable.Size(), si.arenaSize())
+
+	// so is one too small for a batch, by one large enough
+	batch := NewWriteBatch()
+	for i := n; i < 2*n; i++ {
+		batch.Put(util.KeyOf(i), value)
+	}
+	assert.NoError(t, si.Write(batch))
+	assert.Greater(t, si.memTable.Size(), si.arenaSize())
+
+	check := func() {
+		for i := 0; i < 2*n; i++ {
+			got, err := si.Get(util.KeyOf(i))
+			assert.NoError(t, err)
+			assert.Equal(t, value, got)
+		}
+	}
+	check()
+	si.Close()
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	check()
+}
+
+func TestFilterSkipsTables(t *testing.T) {
+	for _, policy := range []filter.Policy{filter.NewBloomPolicy(10), nil} {
+		path := t.TempDir()
+		si, err := newStorageInner(path, &Options{FilterPolicy: policy})
+		assert.NoError(t, err)
+		for i := 0; i < 1000; i += 2 {
+			assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		}
+		flushAll(t, si)
+		si.Close()
+
+		si, err = newStorageInner(path, &Options{FilterPolicy: policy})
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			si.Close()
+		})
+		for i := 1; i < 1000; i += 2 {
+			_, err := si.Get(util.KeyOf(i))
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+		}
+		blocksRead := int(si.BlockCacheStats().Misses)
+		if policy != nil {
+			// only false positives read a block
+			assert.Less(t, blocksRead, 5)
+		} else {
+			assert.NotZero(t, blocksRead)
+		}
+		for i := 0; i < 1000; i += 2 {
+			got, err := si.Get(util.KeyOf(i))
+			assert.NoError(t, err)
+			assert.Equal(t, util.ValueOf(i), got)
+		}
+	}
+}
+
+func TestKeyRangeSkipsTables(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, &Options{L0CompactionTrigger: 8})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	// four L0 tables with disjoint key ranges
+	for from := 0; from < 400; from += 100 {
+		for i := from; i < from+100; i++ {
+			assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		}
+		flushAll(t, si)
+	}
+	assert.Len(t, si.l0SSTables, 4)
+
+	var misses uint64
+	blocksRead := func() int {
+		n := si.BlockCacheStats().Misses - misses
+		misses += n
+		return int(n)
+	}
+	blocksRead()
+
+	got, err := si.Get(util.KeyOf(150))
+	assert.NoError(t, err)
+	assert.Equal(t, util.ValueOf(150), got)
+	assert.Equal(t, 1, blocksRead())
+
+	_, err = si.Get([]byte("zzz"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Zero(t, blocksRead())
+
+	scanner, err := si.Scan(util.KeyOf(210), util.KeyOf(220))
+	assert.NoError(t, err)
+	defer scanner.Close()
+	for i := 210; i <= 220; i++ {
+		assert.True(t, scanner.IsValid())
+		assert.Equal(t, util.KeyOf(i), scanner.Key())
+		scanner.Next()
+	}
+	assert.Equal(t, 1, blocksRead())
+}
+
+func TestCorruptionDetected(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	for _, kv := range util.GeneratePairs(100) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	flushAll(t, si)
+	sstPath := si.sstPath(si.l0SSTables[0].SSTID())
+	si.Close()
+
+	fd, err := os.OpenFile(sstPath, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte("garbage"), 10)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	_, err = si.Get(util.KeyOf(0))
+	assert.ErrorIs(t, err, ErrCorruption)
+	var corruption *sstable.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, si.l0SSTables[0].SSTID(), corruption.ID)
+	assert.Equal(t, int64(0), corruption.Offset)
+}
+
+func TestReopenAfterFlushBeforeWALRemoved(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	for _, kv := range util.GeneratePairs(100) {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	assert.NoError(t, si.newMemTable())
+	id := si.immMemTables[0].ID()
+	data, err := os.ReadFile(si.walPath(id))
+	assert.NoError(t, err)
+	assert.NoError(t, si.sinkImmMemTableToSSTable())
+	si.Close()
+
+	// the log outlives its flushed table, as after a crash in between
+	assert.FileExists(t, si.sstPath(id))
+	assert.NoError(t, os.WriteFile(si.walPath(id), data, 0o600))
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	assert.NoFileExists(t, si.walPath(id))
+	si.mu.RLock()
+	for _, mt := range si.immMemTables {
+		assert.NotEqual(t, id, mt.ID())
+	}
+	si.mu.RUnlock()
+	testRange(t, si, 0, 100)
+
+	// later flushes are not held up
+	for _, kv := range util.GeneratePairs(200)[100:] {
+		assert.True(t, si.Put(kv.K, kv.V))
+	}
+	flushAll(t, si)
+	testRange(t, si, 0, 200)
+}
+
+func TestManifestCorruption(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		flushAll(t, si)
+	}
+	si.Close()
+
+	// damage the first record of the manifest, which edits follow
+	manifests, err := filepath.Glob(filepath.Join(path, "MANIFEST-*"))
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 1)
+	fd, err := os.OpenFile(manifests[0], os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xff}, 8)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+	tables, err := filepath.Glob(filepath.Join(path, "*.sst"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tables)
+
+	// the open fails rather than drop the tables of the later edits
+	_, err = newStorageInner(path, nil)
+	assert.ErrorIs(t, err, ErrCorruption)
+	for _, table := range tables {
+		assert.FileExists(t, table)
+	}
+}
+
+func TestScanStopsOnCorruption(t *testing.T) {
+	path := t.TempDir()
+	// a memtable large enough to flush into one table
+	opts := DefaultOptions()
+	opts.MemTableSize = 1 << 20
+	si, err := newStorageInner(path, opts)
+	assert.NoError(t, err)
+	for i := 0; i < 900; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+	}
+	flushAll(t, si)
+	assert.Len(t, si.l0SSTables, 1)
+	sst := si.l0SSTables[0]
+	assert.Greater(t, sst.Len(), uint32(3))
+	sstPath, size := si.sstPath(sst.SSTID()), sst.Size()
+	si.Close()
+
+	// corrupt a block in the middle of the table
+	fd, err := os.OpenFile(sstPath, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte("garbage"), int64(size/2))
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(899))
+	assert.NoError(t, err)
+	n := 0
+	for ; scanner.IsValid(); scanner.Next() {
+		assert.Equal(t, util.KeyOf(n), scanner.Key())
+		n++
+	}
+	assert.Greater(t, n, 0)
+	assert.Less(t, n, 900)
+	assert.ErrorIs(t, scanner.Error(), ErrCorruption)
+	// a failed scan lets its tables go
+	assert.Empty(t, si.tableRefs)
+	assert.NoError(t, scanner.Close())
+}
+
+func TestCompressionPerLevel(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, &Options{
+		MemTableSize: 1 << 20,
+		Compression:  []compress.Compressor{nil, compress.NewZlib(flate.DefaultCompression)},
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id": %d, "name": "user-%d", "enabled": true, "tags": ["a", "b"]}`, i, i))
+	}
+	const n = 800
+	tablesSize := func(tables []*sstable.Table) (size uint64) {
+		for _, t := range tables {
+			size += t.Size()
+		}
+		return size
+	}
+	var halfSize uint64
+	for from := 0; from < n; from += n / 2 {
+		for i := from; i < from+n/2; i++ {
+			assert.True(t, si.Put(util.KeyOf(i), value(i)))
+		}
+		flushAll(t, si)
+		if from == 0 {
+			// L0 is not due for compaction with a single table
+			halfSize = tablesSize(si.l0SSTables)
+		}
+	}
+	compactAll(t, si)
+	assert.Empty(t, si.l0SSTables)
+	assert.Less(t, tablesSize(si.levels[0]), halfSize)
+
+	for i := 0; i < n; i++ {
+		got, err := si.Get(util.KeyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, value(i), got)
+	}
+}
+
+func TestSharedBlockCache(t *testing.T) {
+	c := cache.New(64 << 10)
+	stores := make([]*StorageInner, 2)
+	strategy := newSwitchedStrategy()
+	for i := range stores {
+		si, err := newStorageInner(t.TempDir(), &Options{BlockCache: c, CompactionStrategy: strategy})
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			si.Close()
+		})
+		stores[i] = si
+		for j := 0; j < 2000; j++ {
+			assert.True(t, si.Put(util.KeyOf(j), []byte(fmt.Sprintf("store-%d-%d", i, j))))
+		}
+		flushAll(t, si)
+	}
+
+	// both stores have a table 1 with a block 0, yet read their own
+	for i, si := range stores {
+		for j := 0; j < 2000; j += 10 {
+			got, err := si.Get(util.KeyOf(j))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("store-%d-%d", i, j)), got)
+		}
+	}
+	stats := c.Stats()
+	assert.Equal(t, stats, stores[0].BlockCacheStats())
+	assert.NotZero(t, stats.Hits)
+	assert.NotZero(t, stats.Misses)
+	assert.LessOrEqual(t, stats.Size, int64(64<<10))
+
+	// the blocks of compacted tables are evicted
+	si := stores[0]
+	for j := 0; j < 2000; j++ {
+		assert.True(t, si.Put(util.KeyOf(j), util.ValueOf(j)))
+	}
+	flushAll(t, si)
+	for j := 0; j < 2000; j += 10 {
+		_, err := si.Get(util.KeyOf(j))
+		assert.NoError(t, err)
+	}
+	before := c.Stats().Count
+	strategy.enabled.Store(true)
+	compactAll(t, si)
+	assert.Empty(t, si.l0SSTables)
+	assert.Less(t, c.Stats().Count, before)
+}
+
+func TestDeleteRange(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		if i == 500 {
+			flushAll(t, si)
+		}
+	}
+	snap := si.NewSnapshot()
+	assert.True(t, si.DeleteRange(util.KeyOf(200), util.KeyOf(400)))
+	assert.True(t, si.Put(util.KeyOf(300), []byte("new")))
+
+	check := func() {
+		for _, i := range []int{0, 199, 400, 999} {
+			got, err := si.Get(util.KeyOf(i))
+			assert.NoError(t, err)
+			assert.Equal(t, util.ValueOf(i), got)
+		}
+		for _, i := range []int{200, 250, 399} {
+			_, err := si.Get(util.KeyOf(i))
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+		}
+		got, err := si.Get(util.KeyOf(300))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), got)
+
+		scanner, err := si.Scan(util.KeyOf(150), util.KeyOf(450))
+		assert.NoError(t, err)
+		defer scanner.Close()
+		want := make([]int, 0)
+		for i := 150; i <= 450; i++ {
+			if i < 200 || i == 300 || i >= 400 {
+				want = append(want, i)
+			}
+		}
+		for _, i := range want {
+			assert.True(t, scanner.IsValid())
+			assert.Equal(t, util.KeyOf(i), scanner.Key())
+			scanner.Next()
+		}
+		assert.False(t, scanner.IsValid())
+	}
+	check()
+
+	// a snapshot taken before the range delete still sees the keys
+	got, err := snap.Get(util.KeyOf(250))
+	assert.NoError(t, err)
+	assert.Equal(t, util.ValueOf(250), got)
+	flushAll(t, si)
+	compactAll(t, si)
+	check()
+	got, err = snap.Get(util.KeyOf(250))
+	assert.NoError(t, err)
+	assert.Equal(t, util.ValueOf(250), got)
+	snap.Release()
+
+	// recovered from the log and from the sstables
+	assert.True(t, si.DeleteRange(util.KeyOf(900), util.KeyOf(950)))
+	si.Close()
+	si, err = newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	check()
+	_, err = si.Get(util.KeyOf(920))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// once no snapshot needs them, a compaction of the whole key range into
+	// the bottom of the tree drops the deleted entries and the tombstones
+	flushAll(t, si)
+	assert.True(t, si.Put(util.KeyOf(0), util.ValueOf(0)))
+	assert.True(t, si.Put(util.KeyOf(999), util.ValueOf(999)))
+	flushAll(t, si)
+	compactAll(t, si)
+	assert.Empty(t, si.l0SSTables)
+	check()
+	for _, sst := range si.currentView().sstables() {
+		iter, err := sstable.NewIterAndSeekToFirst(sst)
+		assert.NoError(t, err)
+		for ; iter.IsValid(); iter.Next() {
+			userKey := kv.UserKey(iter.Key())
+			if string(userKey) != string(util.KeyOf(300)) {
+				assert.False(t, string(userKey) >= string(util.KeyOf(200)) && string(userKey) < string(util.KeyOf(400)))
+			}
+			assert.False(t, string(userKey) >= string(util.KeyOf(900)) && string(userKey) < string(util.KeyOf(950)))
+		}
+		assert.Empty(t, sst.RangeDels())
+	}
+}
+
+func TestDeleteRangeDropsTables(t *testing.T) {
+	path := t.TempDir()
+	si, err := newStorageInner(path, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	const n = 10000
+	for from := 0; from < n; from += 2000 {
+		for i := from; i < from+2000; i++ {
+			assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		}
+		flushAll(t, si)
+		compactAll(t, si)
+	}
+	assert.True(t, si.Put(util.KeyOf(n), util.ValueOf(n)))
+	old := si.currentView().sstables()
+	assert.NotEmpty(t, old)
+
+	// a snapshot that may read the tables keeps them
+	snap := si.NewSnapshot()
+	assert.True(t, si.DeleteRange(util.KeyOf(0), util.KeyOf(n)))
+	flushAll(t, si)
+	task := si.pickCompaction()
+	assert.False(t, task != nil && task.deleteOnly)
+	// L0 is ordered from newest to oldest
+	tombstones := si.l0SSTables[0].SSTID()
+	snap.Release()
+
+	// the table of the tombstone is kept as it is, so the others are
+	// dropped without being rewritten
+	task = si.pickCompaction()
+	assert.True(t, task == nil || task.deleteOnly)
+	compactAll(t, si)
+	for _, sst := range old {
+		_, err := os.Stat(si.sstPath(sst.SSTID()))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	tables := si.currentView().sstables()
+	assert.Len(t, tables, 1)
+	assert.Equal(t, tombstones, tables[0].SSTID())
+
+	for _, i := range []int{0, 1234, n - 1} {
+		_, err := si.Get(util.KeyOf(i))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+	got, err := si.Get(util.KeyOf(n))
+	assert.NoError(t, err)
+	assert.Equal(t, util.ValueOf(n), got)
+	scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(n))
+	assert.NoError(t, err)
+	defer scanner.Close()
+	assert.True(t, scanner.IsValid())
+	assert.Equal(t, util.KeyOf(n), scanner.Key())
+	scanner.Next()
+	assert.False(t, scanner.IsValid())
+}
+
+func TestScanReverse(t *testing.T) {
+	si, err := newStorageInner(t.TempDir(), nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		if i%300 == 0 {
+			flushAll(t, si)
+		}
+	}
+	snap := si.NewSnapshot()
+	defer snap.Release()
+	for i := 100; i < 500; i += 10 {
+		assert.True(t, si.Del(util.KeyOf(i)))
+		assert.True(t, si.Put(util.KeyOf(i+1), []byte("new")))
+	}
+	compactAll(t, si)
+
+	value := func(i int) []byte {
+		if i >= 100 && i < 500 && i%10 == 1 {
+			return []byte("new")
+		}
+		return util.ValueOf(i)
+	}
+	scanner, err := si.ScanReverse(util.KeyOf(200), util.KeyOf(400))
+	assert.NoError(t, err)
+	defer scanner.Close()
+	for i := 400; i >= 200; i-- {
+		if i%10 == 0 {
+			continue
+		}
+		assert.True(t, scanner.IsValid())
+		assert.Equal(t, util.KeyOf(i), scanner.Key())
+		assert.Equal(t, value(i), scanner.Value())
+		scanner.Prev()
+	}
+	assert.False(t, scanner.IsValid())
+
+	// change direction in the middle of the range
+	scanner, err = si.ScanReverse(util.KeyOf(200), util.KeyOf(400))
+	assert.NoError(t, err)
+	defer scanner.Close()
+	scanner.SeekForPrev(util.KeyOf(300))
+	assert.Equal(t, util.KeyOf(299), scanner.Key())
+	scanner.Next()
+	assert.Equal(t, util.KeyOf(301), scanner.Key())
+	assert.Equal(t, []byte("new"), scanner.Value())
+	scanner.Prev()
+	scanner.Prev()
+	assert.Equal(t, util.KeyOf(298), scanner.Key())
+
+	// the snapshot sees the keys before they were deleted
+	scanner, err = snap.ScanReverse(util.KeyOf(100), util.KeyOf(120))
+	assert.NoError(t, err)
+	defer scanner.Close()
+	for i := 120; i >= 100; i-- {
+		assert.True(t, scanner.IsValid())
+		assert.Equal(t, util.KeyOf(i), scanner.Key())
+		assert.Equal(t, util.ValueOf(i), scanner.Value())
+		scanner.Prev()
+	}
+	assert.False(t, scanner.IsValid())
+}
+
+func TestScanWithOptions(t *testing.T) {
+	si, err := newStorageInner(t.TempDir(), nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	for i := 0; i < 1000; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+		if i == 600 {
+			flushAll(t, si)
+		}
+	}
+	flushAll(t, si)
+	compactAll(t, si)
+	assert.True(t, si.Put(util.KeyOf(1000), util.ValueOf(1000)))
+
+	keys := func(opts ScanOptions) []int {
+		iter, err := si.ScanWithOptions(opts)
+		assert.NoError(t, err)
+		defer iter.Close()
+		res := make([]int, 0)
+		for ; iter.IsValid(); iter.Next() {
+			var i int
+			_, err := fmt.Sscanf(string(iter.Key()), "key-%05d", &i)
+			assert.NoError(t, err)
+			assert.Equal(t, util.ValueOf(i), iter.Value())
+			res = append(res, i)
+		}
+		assert.NoError(t, iter.Error())
+		return res
+	}
+	span := func(from, to int) []int {
+		res := make([]int, 0)
+		for i := from; i <= to; i++ {
+			res = append(res, i)
+		}
+		return res
+	}
+	// flushed data must not leak past the upper bound
+	assert.Equal(t, span(100, 200), keys(ScanOptions{Lower: Include(util.KeyOf(100)), Upper: Include(util.KeyOf(200))}))
+	assert.Equal(t, span(101, 199), keys(ScanOptions{Lower: Exclude(util.KeyOf(100)), Upper: Exclude(util.KeyOf(200))}))
+	assert.Equal(t, span(0, 9), keys(ScanOptions{Upper: Exclude(util.KeyOf(10))}))
+	assert.Equal(t, span(995, 1000), keys(ScanOptions{Lower: Include(util.KeyOf(995))}))
+	assert.Equal(t, span(0, 1000), keys(ScanOptions{}))
+	assert.Equal(t, span(590, 599), keys(ScanOptions{Prefix: []byte("key-0059")}))
+	assert.Equal(t, span(595, 599), keys(ScanOptions{Lower: Include(util.KeyOf(595)), Prefix: []byte("key-0059")}))
+	assert.Empty(t, keys(ScanOptions{Lower: Include(util.KeyOf(300)), Upper: Exclude(util.KeyOf(300))}))
+	assert.Empty(t, keys(ScanOptions{Prefix: []byte("nope")}))
+
+	iter, err := si.ScanWithOptions(ScanOptions{Prefix: []byte("key-0059"), Reverse: true})
+	assert.NoError(t, err)
+	defer iter.Close()
+	for i := 599; i >= 590; i-- {
+		assert.Equal(t, util.KeyOf(i), iter.Key())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+
+	_, err = si.ScanWithOptions(ScanOptions{Lower: Include(nil)})
+	assert.Error(t, err)
+}
+
+// recordingLogger keeps the messages logged to it.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Infof(template string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(template, args...))
+}
+
+func (l *recordingLogger) Errorf(template string, args ...any) {
+	l.Infof(template, args...)
+}
+
+func (l *recordingLogger) has(message string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Contains(l.messages, message)
+}
+
+func TestOpen(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultBlockSize, db.si.opts.BlockSize)
+	assert.Equal(t, l0CompactionTrigger, db.si.opts.CompactionStrategy.(*compaction.Leveled).L0Trigger)
+	assert.NotNil(t, db.si.opts.FilterPolicy)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, db.Put([]byte("b"), []byte("2")))
+	assert.NoError(t, db.Delete([]byte("a")))
+	assert.ErrorIs(t, db.Put(nil, []byte("3")), ErrInvalidKey)
+	_, err = db.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = db.Get(nil)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	snap := db.NewSnapshot()
+	_, err = snap.Get([]byte{})
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	snap.Release()
+	db.Close()
+
+	// the memtable is replaced as the options say
+	l := &recordingLogger{}
+	opts := &Options{
+		MemTableEntries:   10,
+		BlockSize:         256,
+		BackgroundWorkers: 1,
+		Sync:              SyncEveryWrite,
+		Logger:            l,
+	}
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	assert.Equal(t, defaultMemTableSize, db.si.opts.MemTableSize)
+	assert.Nil(t, db.si.opts.FilterPolicy)
+	assert.Zero(t, opts.MemTableSize, "the options given are not modified")
+	got, err := db.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), got)
+	for _, kv := range util.GeneratePairs(100) {
+		assert.NoError(t, db.Put(kv.K, kv.V))
+	}
+	assert.Eventually(t, func() bool {
+		return l.has("create new memtable")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, opts := range []*Options{
+		{MemTableSize: -1},
+		{MemTableSize: maxMemTableSize + 1},
+		{MemTableEntries: -1},
+		{BlockSize: maxBlockSize + 1},
+		{BlockCacheSize: -1},
+		{L0CompactionTrigger: -1},
+		{LevelSizeMultiplier: 1},
+		{BackgroundWorkers: -1},
+		{ImmMemTableSlowdown: 5, ImmMemTableStop: 2},
+		{L0SlowdownTrigger: -1},
+		{L0StopTrigger: l0CompactionTrigger},
+		{WriteSlowdownDelay: -time.Millisecond},
+		{Sync: SyncEveryWrite + 1},
+	} {
+		_, err := Open(t.TempDir(), opts)
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	open := func() (*DB, *switchedStrategy) {
+		strategy := newSwitchedStrategy()
+		db, err := Open(t.TempDir(), &Options{
+			CompactionStrategy: strategy,
+			L0SlowdownTrigger:  2,
+			L0StopTrigger:      3,
+		})
+		assert.NoError(t, err)
+		return db, strategy
+	}
+	// fillL0 flushes a table into L0 with every write.
+	fillL0 := func(db *DB, n int) {
+		for i := 0; i < n; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+			flushAll(t, db.si)
+		}
+	}
+
+	db, strategy := open()
+	t.Cleanup(func() {
+		db.Close()
+	})
+	assert.Equal(t, WriteStallNone, db.WriteStallStats().State)
+	fillL0(db, 2)
+	assert.Equal(t, WriteStallSlowdown, db.WriteStallStats().State)
+	fillL0(db, 1)
+	stats := db.WriteStallStats()
+	assert.Equal(t, WriteStallStop, stats.State)
+	assert.Equal(t, uint64(1), stats.Slowdowns)
+	assert.Zero(t, stats.Stops)
+
+	// the write waits until compaction empties L0
+	done := make(chan error)
+	go func() {
+		done <- db.Put([]byte("blocked"), []byte("value"))
+	}()
+	assert.Eventually(t, func() bool {
+		return db.WriteStallStats().Stops == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, WriteStallStop, db.WriteStallStats().State)
+	select {
+	case err := <-done:
+		t.Fatalf("write went through a stall: %v", err)
+	default:
+	}
+	strategy.enabled.Store(true)
+	db.si.scheduleBackgroundWork()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked after compaction")
+	}
+	stats = db.WriteStallStats()
+	assert.Equal(t, WriteStallNone, stats.State)
+	assert.Equal(t, uint64(1), stats.Stops)
+	assert.Positive(t, stats.StallTime)
+	got, err := db.Get([]byte("blocked"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), got)
+
+	// closing the store fails the blocked writes
+	stopped, _ := open()
+	fillL0(stopped, 3)
+	go func() {
+		done <- stopped.Put([]byte("blocked"), []byte("value"))
+	}()
+	assert.Eventually(t, func() bool {
+		return stopped.WriteStallStats().Stops == 1
+	}, 5*time.Second, time.Millisecond)
+	stopped.Close()
+	assert.ErrorIs(t, <-done, ErrClosed)
+}
+
+func TestWriteStallBackgroundError(t *testing.T) {
+	strategy := newSwitchedStrategy()
+	db, err := Open(t.TempDir(), &Options{
+		CompactionStrategy: strategy,
+		L0SlowdownTrigger:  2,
+		L0StopTrigger:      3,
+		Compression:        []compress.Compressor{nil, failingCompressor{compress.NewZlib(flate.DefaultCompression)}},
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+		flushAll(t, db.si)
+	}
+	assert.Equal(t, WriteStallStop, db.WriteStallStats().State)
+
+	// the compaction that would end the stall keeps failing, so the blocked
+	// write fails with its error
+	done := make(chan error)
+	go func() {
+		done <- db.Put([]byte("blocked"), []byte("value"))
+	}()
+	assert.Eventually(t, func() bool {
+		return db.WriteStallStats().Stops == 1
+	}, 5*time.Second, time.Millisecond)
+	strategy.enabled.Store(true)
+	db.si.scheduleBackgroundWork()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, errCompressFailed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked after the compaction failed")
+	}
+}
+
+func TestBackgroundWork(t *testing.T) {
+	strategy := newSwitchedStrategy()
+	db, err := Open(t.TempDir(), &Options{MemTableEntries: 100, BlockSize: 256, CompactionStrategy: strategy})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	si := db.si
+
+	// full memtables are replaced on the write path and flushed without
+	// waiting for a timer
+	const n = 1000
+	for i := 0; i < n; i++ {
+		assert.NoError(t, db.Put(util.KeyOf(i), util.ValueOf(i)))
+	}
+	assert.Eventually(t, func() bool {
+		si.mu.RLock()
+		defer si.mu.RUnlock()
+		return len(si.immMemTables) == 0 && len(si.l0SSTables) >= n/100-1
+	}, 5*time.Second, time.Millisecond)
+
+	// a scanner keeps the tables compacted away under it
+	scanner, err := db.Scan(util.KeyOf(0), util.KeyOf(n-1))
+	assert.NoError(t, err)
+	strategy.enabled.Store(true)
+	si.scheduleBackgroundWork()
+	assert.Eventually(t, func() bool {
+		si.mu.RLock()
+		defer si.mu.RUnlock()
+		return len(si.l0SSTables) == 0
+	}, 5*time.Second, time.Millisecond)
+	i := 0
+	for ; scanner.IsValid(); scanner.Next() {
+		assert.Equal(t, util.KeyOf(i), scanner.Key())
+		i++
+	}
+	assert.Equal(t, n, i)
+	assert.NoError(t, scanner.Error())
+	assert.NoError(t, scanner.Close())
+}
+
+func TestConcurrentCompactions(t *testing.T) {
+	strategy := compaction.NewLeveled(l0CompactionTrigger, levelBaseSize, levelSizeMultiplier)
+	si, err := newStorageInner(t.TempDir(), &Options{CompactionStrategy: strategy})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	// the test runs the compactions itself
+	si.stopBackgroundWorkers()
+
+	// a single L1 table of the keys below 200, and two L0 tables of keys
+	// above them
+	put := func(from, to int, value string) {
+		for i := from; i < to; i++ {
+			assert.True(t, si.Put(util.KeyOf(i), []byte(value)))
+		}
+		flushAll(t, si)
+	}
+	put(0, 200, "old")
+	put(0, 200, "new")
+	compactAll(t, si)
+	assert.Len(t, si.levels[0], 1)
+	put(1000, 1100, "old")
+	put(1000, 1100, "new")
+
+	// L1 outgrows its target, and is compacted into L2 while L0 is
+	// compacted into L1
+	strategy.BaseSize = 1
+	first := si.startCompaction()
+	assert.NotNil(t, first)
+	assert.Equal(t, 2, first.outputLevel)
+	second := si.startCompaction()
+	assert.NotNil(t, second)
+	assert.Equal(t, 1, second.outputLevel)
+	assert.Nil(t, si.startCompaction(), "no compaction overlaps the running ones")
+	assert.Len(t, si.compactions, 2)
+
+	var wg sync.WaitGroup
+	for _, task := range []*compactionTask{first, second} {
+		wg.Add(1)
+		go func(task *compactionTask) {
+			defer wg.Done()
+			assert.NoError(t, si.compact(task))
+			si.finishCompaction(task)
+		}(task)
+	}
+	wg.Wait()
+	assert.Empty(t, si.l0SSTables)
+	assert.Empty(t, si.compacting)
+	for _, i := range []int{0, 199, 1000, 1099} {
+		got, err := si.Get(util.KeyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), got)
+	}
+}
+
+var errCompressFailed = errors.New("compress failed")
+
+// failingCompressor fails every block it compresses.
+type failingCompressor struct {
+	compress.Compressor
+}
+
+func (failingCompressor) Compress([]byte) ([]byte, error) {
+	return nil, errCompressFailed
+}
+
+// blockingCompressor holds the first block it compresses until released.
+type blockingCompressor struct {
+	compress.Compressor
+	once     sync.Once
+	entered  chan struct{}
+	released chan struct{}
+}
+
+func (c *blockingCompressor) Compress(src []byte) ([]byte, error) {
+	c.once.Do(func() {
+		close(c.entered)
+		<-c.released
+	})
+	return c.Compressor.Compress(src)
+}
+
+func TestFlushDoesNotBlockReads(t *testing.T) {
+	c := &blockingCompressor{
+		Compressor: compress.NewZlib(flate.DefaultCompression),
+		entered:    make(chan struct{}),
+		released:   make(chan struct{}),
+	}
+	si, err := newStorageInner(t.TempDir(), &Options{Compression: []compress.Compressor{c}})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		si.Close()
+	})
+	for i := 0; i < 100; i++ {
+		assert.True(t, si.Put(util.KeyOf(i), util.ValueOf(i)))
+	}
+	assert.NoError(t, si.newMemTable())
+	<-c.entered
+
+	// reads and writes go on while the table is built
+	got, err := si.Get(util.KeyOf(0))
+	assert.NoError(t, err)
+	assert.Equal(t, util.ValueOf(0), got)
+	assert.True(t, si.Put(util.KeyOf(100), util.ValueOf(100)))
+	scanner, err := si.Scan(util.KeyOf(0), util.KeyOf(100))
+	assert.NoError(t, err)
+	assert.NoError(t, scanner.Close())
+
+	close(c.released)
+	assert.Eventually(t, func() bool {
+		si.mu.RLock()
+		defer si.mu.RUnlock()
+		return len(si.immMemTables) == 0 && len(si.l0SSTables) == 1
+	}, 5*time.Second, time.Millisecond)
+	for _, i := range []int{0, 99, 100} {
+		got, err := si.Get(util.KeyOf(i))
+		assert.NoError(t, err)
+		assert.Equal(t, util.ValueOf(i), got)
+	}
+}
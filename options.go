@@ -0,0 +1,211 @@
+package minilsm
+
+import (
+	"errors"
+	"fmt"
+	"minilsm/cache"
+	"minilsm/compaction"
+	"minilsm/compress"
+	"minilsm/filter"
+	"minilsm/logger"
+	"time"
+)
+
+// SyncPolicy tells when writes are synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncNone leaves syncing the write-ahead log to the operating system.
+	// A write survives a crash of the process, but may be lost in a crash
+	// of the machine.
+	SyncNone SyncPolicy = iota
+	// SyncEveryWrite syncs the write-ahead log before a write returns.
+	SyncEveryWrite
+)
+
+const (
+	// defaultMemTableSize and defaultMemTableEntries are the size in bytes
+	// and the number of entries at which the memtable is replaced.
+	defaultMemTableSize    = 40 << 10
+	defaultMemTableEntries = 1000
+	defaultBlockSize       = 4096
+	// defaultBlockCacheSize is the capacity of the block cache of a store that
+	// does not share one.
+	defaultBlockCacheSize    = 8 << 20
+	defaultBackgroundWorkers = 2
+	// the default write stall thresholds
+	defaultImmMemTableSlowdown = 4
+	defaultImmMemTableStop     = 8
+	defaultL0SlowdownTrigger   = 20
+	defaultL0StopTrigger       = 36
+	defaultWriteSlowdownDelay  = time.Millisecond
+	// bloomBitsPerKey is the bits per key of the default filter policy.
+	bloomBitsPerKey = 10
+
+	// maxMemTableSize and maxBlockSize bound the options, as offsets into
+	// memtables and blocks are 32 bits.
+	maxMemTableSize = 1 << 30
+	maxBlockSize    = 1 << 20
+)
+
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Options configure a store. A zero field takes its default value, except
+// for FilterPolicy and Compression, whose zero values build sstables
+// without filters and without compression. DefaultOptions returns every
+// default, including a bloom filter policy.
+type Options struct {
+	// MemTableSize is the size in bytes, and MemTableEntries the number of
+	// entries, at which the memtable is made immutable and queued for
+	// flushing.
+	MemTableSize    int
+	MemTableEntries int
+	// BlockSize is the size in bytes at which an sstable block is cut.
+	BlockSize int
+	// BlockCache is a cache to share with other stores. Without it, the
+	// store caches blocks in a cache of its own of BlockCacheSize bytes.
+	BlockCache     *cache.Cache
+	BlockCacheSize int64
+	// CompactionStrategy picks the compactions. Without it, the store
+	// compacts into levels, when L0 holds L0CompactionTrigger tables or a
+	// level outgrows its target size: LevelBaseSize bytes for L1, and
+	// LevelSizeMultiplier times that of the level above for the others.
+	CompactionStrategy  compaction.Strategy
+	L0CompactionTrigger int
+	LevelBaseSize       uint64
+	LevelSizeMultiplier uint64
+	// TargetFileSize is the size in bytes at which compaction starts a new
+	// output table.
+	TargetFileSize uint64
+	// FilterPolicy builds the filters of the sstables.
+	FilterPolicy filter.Policy
+	// Compression holds the compressor of the blocks of each level's
+	// sstables: Compression[0] is used for L0, Compression[i] for level i,
+	// and the last one for every level below. A nil compressor leaves the
+	// blocks of its levels uncompressed.
+	Compression []compress.Compressor
+	// BackgroundWorkers is the number of goroutines that flush memtables and
+	// compact. At most one of them flushes at a time, and the others run
+	// compactions of distinct tables.
+	BackgroundWorkers int
+	// Writes are delayed by WriteSlowdownDelay each once there are
+	// ImmMemTableSlowdown immutable memtables waiting for flushing or
+	// L0SlowdownTrigger tables in L0, and blocked at ImmMemTableStop
+	// immutable memtables or L0StopTrigger L0 tables, until flushes and
+	// compactions catch up.
+	ImmMemTableSlowdown int
+	ImmMemTableStop     int
+	L0SlowdownTrigger   int
+	L0StopTrigger       int
+	WriteSlowdownDelay  time.Duration
+	Sync                SyncPolicy
+	// Logger receives the messages of the store.
+	Logger logger.Logger
+}
+
+// DefaultOptions returns the options a store is opened with when none are
+// given.
+func DefaultOptions() *Options {
+	o := &Options{FilterPolicy: filter.NewBloomPolicy(bloomBitsPerKey)}
+	o.setDefaults()
+	return o
+}
+
+// setDefaults gives the zero fields of o their default values.
+func (o *Options) setDefaults() {
+	if o.MemTableSize == 0 {
+		o.MemTableSize = defaultMemTableSize
+	}
+	if o.MemTableEntries == 0 {
+		o.MemTableEntries = defaultMemTableEntries
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = defaultBlockSize
+	}
+	if o.BlockCacheSize == 0 {
+		o.BlockCacheSize = defaultBlockCacheSize
+	}
+	if o.L0CompactionTrigger == 0 {
+		o.L0CompactionTrigger = l0CompactionTrigger
+	}
+	if o.LevelBaseSize == 0 {
+		o.LevelBaseSize = levelBaseSize
+	}
+	if o.LevelSizeMultiplier == 0 {
+		o.LevelSizeMultiplier = levelSizeMultiplier
+	}
+	if o.TargetFileSize == 0 {
+		o.TargetFileSize = targetSSTableSize
+	}
+	if o.BackgroundWorkers == 0 {
+		o.BackgroundWorkers = defaultBackgroundWorkers
+	}
+	// a slowdown threshold left zero is kept below the stop one
+	if o.ImmMemTableStop == 0 {
+		o.ImmMemTableStop = defaultImmMemTableStop
+	}
+	if o.ImmMemTableSlowdown == 0 {
+		o.ImmMemTableSlowdown = min(defaultImmMemTableSlowdown, o.ImmMemTableStop)
+	}
+	if o.L0StopTrigger == 0 {
+		o.L0StopTrigger = defaultL0StopTrigger
+	}
+	if o.L0SlowdownTrigger == 0 {
+		o.L0SlowdownTrigger = min(defaultL0SlowdownTrigger, o.L0StopTrigger)
+	}
+	if o.WriteSlowdownDelay == 0 {
+		o.WriteSlowdownDelay = defaultWriteSlowdownDelay
+	}
+	if o.Logger == nil {
+		o.Logger = logger.GetLogger()
+	}
+}
+
+// Validate reports the first option out of its range, if any. Zero fields
+// are valid, as they take their default values.
+func (o *Options) Validate() error {
+	withDefaults := *o
+	withDefaults.setDefaults()
+	return withDefaults.validate()
+}
+
+// validate is Validate once the defaults are filled in.
+func (o *Options) validate() error {
+	switch {
+	case o.MemTableSize < 0 || o.MemTableSize > maxMemTableSize:
+		return fmt.Errorf("%w: memtable size %d is not in [1, %d]", ErrInvalidOptions, o.MemTableSize, maxMemTableSize)
+	case o.MemTableEntries < 0:
+		return fmt.Errorf("%w: memtable entries %d is negative", ErrInvalidOptions, o.MemTableEntries)
+	case o.BlockSize < 0 || o.BlockSize > maxBlockSize:
+		return fmt.Errorf("%w: block size %d is not in [1, %d]", ErrInvalidOptions, o.BlockSize, maxBlockSize)
+	case o.BlockCacheSize < 0:
+		return fmt.Errorf("%w: block cache size %d is negative", ErrInvalidOptions, o.BlockCacheSize)
+	case o.L0CompactionTrigger < 0:
+		return fmt.Errorf("%w: L0 compaction trigger %d is negative", ErrInvalidOptions, o.L0CompactionTrigger)
+	case o.LevelSizeMultiplier == 1:
+		return fmt.Errorf("%w: level size multiplier must be at least 2", ErrInvalidOptions)
+	case o.BackgroundWorkers < 0:
+		return fmt.Errorf("%w: background workers %d is negative", ErrInvalidOptions, o.BackgroundWorkers)
+	case o.ImmMemTableSlowdown < 0 || o.ImmMemTableStop < o.ImmMemTableSlowdown:
+		return fmt.Errorf("%w: immutable memtable slowdown %d and stop %d are not in order", ErrInvalidOptions, o.ImmMemTableSlowdown, o.ImmMemTableStop)
+	case o.L0SlowdownTrigger < 0 || o.L0StopTrigger < o.L0SlowdownTrigger:
+		return fmt.Errorf("%w: L0 slowdown trigger %d and stop trigger %d are not in order", ErrInvalidOptions, o.L0SlowdownTrigger, o.L0StopTrigger)
+	case o.CompactionStrategy == nil && o.L0StopTrigger <= o.L0CompactionTrigger:
+		// L0 would never be compacted to let the writes go on
+		return fmt.Errorf("%w: L0 stop trigger %d is not above the compaction trigger %d", ErrInvalidOptions, o.L0StopTrigger, o.L0CompactionTrigger)
+	case o.WriteSlowdownDelay < 0:
+		return fmt.Errorf("%w: write slowdown delay %v is negative", ErrInvalidOptions, o.WriteSlowdownDelay)
+	case o.Sync != SyncNone && o.Sync != SyncEveryWrite:
+		return fmt.Errorf("%w: unknown sync policy %d", ErrInvalidOptions, o.Sync)
+	}
+	return nil
+}
+
+// compactionStrategy returns the strategy of o, or the leveled one its
+// fields describe.
+func (o *Options) compactionStrategy() compaction.Strategy {
+	if o.CompactionStrategy != nil {
+		return o.CompactionStrategy
+	}
+	return compaction.NewLeveled(o.L0CompactionTrigger, o.LevelBaseSize, o.LevelSizeMultiplier)
+}
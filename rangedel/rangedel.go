@@ -0,0 +1,181 @@
+package rangedel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sort"
+)
+
+// Tombstone deletes the versions of the user keys in [Start, End) that are
+// older than Seq.
+type Tombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// Contains reports whether userKey is in the range of t.
+func (t Tombstone) Contains(userKey []byte) bool {
+	return bytes.Compare(t.Start, userKey) <= 0 && bytes.Compare(userKey, t.End) < 0
+}
+
+// Covers reports whether t deletes the version seq of userKey.
+func (t Tombstone) Covers(userKey []byte, seq uint64) bool {
+	return seq < t.Seq && t.Contains(userKey)
+}
+
+// Clip returns the part of t in [lower, upper), where a nil bound leaves
+// that side unbounded. ok is false if no part of t is in the range.
+func (t Tombstone) Clip(lower, upper []byte) (clipped Tombstone, ok bool) {
+	clipped = t
+	if lower != nil && bytes.Compare(clipped.Start, lower) < 0 {
+		clipped.Start = lower
+	}
+	if upper != nil && bytes.Compare(clipped.End, upper) > 0 {
+		clipped.End = upper
+	}
+	return clipped, bytes.Compare(clipped.Start, clipped.End) < 0
+}
+
+// MaxSeq returns the largest sequence number, not greater than seq, of the
+// tombstones that contain userKey, or 0 if there is none.
+func MaxSeq(tombstones []Tombstone, userKey []byte, seq uint64) uint64 {
+	var res uint64
+	for _, t := range tombstones {
+		if t.Seq <= seq && t.Seq > res && t.Contains(userKey) {
+			res = t.Seq
+		}
+	}
+	return res
+}
+
+// Fragments are the tombstones visible at some sequence number, split into
+// non-overlapping ranges that each keep the largest sequence number of the
+// tombstones over them, so the tombstone of a key is found by a binary
+// search.
+type Fragments struct {
+	frags []Tombstone
+}
+
+// Fragment returns the fragments of the tombstones whose sequence number is
+// not greater than seq.
+func Fragment(tombstones []Tombstone, seq uint64) *Fragments {
+	visible := make([]Tombstone, 0, len(tombstones))
+	bounds := make([][]byte, 0, 2*len(tombstones))
+	for _, t := range tombstones {
+		if t.Seq <= seq && bytes.Compare(t.Start, t.End) < 0 {
+			visible = append(visible, t)
+			bounds = append(bounds, t.Start, t.End)
+		}
+	}
+	slices.SortFunc(bounds, bytes.Compare)
+	bounds = slices.CompactFunc(bounds, bytes.Equal)
+	slices.SortFunc(visible, func(a, b Tombstone) int {
+		return bytes.Compare(a.Start, b.Start)
+	})
+
+	f := &Fragments{}
+	active := make([]Tombstone, 0)
+	next := 0
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		active = slices.DeleteFunc(active, func(t Tombstone) bool {
+			return bytes.Compare(t.End, start) <= 0
+		})
+		for ; next < len(visible) && bytes.Equal(visible[next].Start, start); next++ {
+			active = append(active, visible[next])
+		}
+		var maxSeq uint64
+		for _, t := range active {
+			maxSeq = max(maxSeq, t.Seq)
+		}
+		if maxSeq == 0 {
+			continue
+		}
+		if n := len(f.frags); n > 0 && f.frags[n-1].Seq == maxSeq && bytes.Equal(f.frags[n-1].End, start) {
+			f.frags[n-1].End = end
+			continue
+		}
+		f.frags = append(f.frags, Tombstone{Start: start, End: end, Seq: maxSeq})
+	}
+	return f
+}
+
+// Seq returns the largest sequence number of the tombstones that contain
+// userKey, or 0 if there is none. A nil *Fragments contains no key.
+func (f *Fragments) Seq(userKey []byte) uint64 {
+	if f == nil {
+		return 0
+	}
+	i := sort.Search(len(f.frags), func(i int) bool {
+		return bytes.Compare(f.frags[i].End, userKey) > 0
+	})
+	if i == len(f.frags) || !f.frags[i].Contains(userKey) {
+		return 0
+	}
+	return f.frags[i].Seq
+}
+
+// Covers reports whether a tombstone deletes the version seq of userKey.
+func (f *Fragments) Covers(userKey []byte, seq uint64) bool {
+	return f.Seq(userKey) > seq
+}
+
+// Encode serializes tombstones, each as
+//
+// +------------+-------+----------+-------+---------+
+// | start size | start | end size |  end  |   seq   |
+// +------------+-------+----------+-------+---------+
+// |  uvarint   | bytes | uvarint  | bytes | uvarint |
+// +------------+-------+----------+-------+---------+
+func Encode(tombstones []Tombstone) []byte {
+	size := 0
+	for _, t := range tombstones {
+		size += 3*binary.MaxVarintLen64 + len(t.Start) + len(t.End)
+	}
+	buf := make([]byte, 0, size)
+	for _, t := range tombstones {
+		buf = binary.AppendUvarint(buf, uint64(len(t.Start)))
+		buf = append(buf, t.Start...)
+		buf = binary.AppendUvarint(buf, uint64(len(t.End)))
+		buf = append(buf, t.End...)
+		buf = binary.AppendUvarint(buf, t.Seq)
+	}
+	return buf
+}
+
+var ErrInvalidTombstones = errors.New("invalid range tombstones")
+
+// Decode parses tombstones serialized by Encode. They share memory with
+// data.
+func Decode(data []byte) ([]Tombstone, error) {
+	tombstones := make([]Tombstone, 0)
+	next := func() ([]byte, bool) {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, false
+		}
+		field := data[n : n+int(size)]
+		data = data[n+int(size):]
+		return field, true
+	}
+	for len(data) > 0 {
+		start, ok := next()
+		if !ok {
+			return nil, ErrInvalidTombstones
+		}
+		end, ok := next()
+		if !ok {
+			return nil, ErrInvalidTombstones
+		}
+		seq, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrInvalidTombstones
+		}
+		data = data[n:]
+		tombstones = append(tombstones, Tombstone{Start: start, End: end, Seq: seq})
+	}
+	return tombstones, nil
+}
@@ -0,0 +1,93 @@
+package rangedel
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tombstone(start, end string, seq uint64) Tombstone {
+	return Tombstone{Start: []byte(start), End: []byte(end), Seq: seq}
+}
+
+func TestTombstone_Covers(t *testing.T) {
+	ts := tombstone("b", "d", 5)
+	assert.False(t, ts.Covers([]byte("a"), 1))
+	assert.True(t, ts.Covers([]byte("b"), 1))
+	assert.True(t, ts.Covers([]byte("c"), 4))
+	assert.False(t, ts.Covers([]byte("c"), 5))
+	assert.False(t, ts.Covers([]byte("d"), 1))
+}
+
+func TestTombstone_Clip(t *testing.T) {
+	ts := tombstone("b", "f", 5)
+	got, ok := ts.Clip([]byte("c"), []byte("e"))
+	assert.True(t, ok)
+	assert.Equal(t, tombstone("c", "e", 5), got)
+	got, ok = ts.Clip(nil, []byte("d"))
+	assert.True(t, ok)
+	assert.Equal(t, tombstone("b", "d", 5), got)
+	_, ok = ts.Clip([]byte("f"), nil)
+	assert.False(t, ok)
+}
+
+func TestFragment(t *testing.T) {
+	ts := []Tombstone{
+		tombstone("a", "e", 3),
+		tombstone("c", "g", 5),
+		tombstone("f", "h", 9),
+	}
+	f := Fragment(ts, 8)
+	for _, tt := range []struct {
+		key  string
+		want uint64
+	}{
+		{"0", 0},
+		{"a", 3},
+		{"b", 3},
+		{"c", 5},
+		{"e", 5},
+		{"f", 5},
+		{"g", 0},
+		{"h", 0},
+	} {
+		assert.Equal(t, tt.want, f.Seq([]byte(tt.key)), tt.key)
+	}
+	assert.Equal(t, uint64(9), Fragment(ts, 9).Seq([]byte("g")))
+	assert.Zero(t, (*Fragments)(nil).Seq([]byte("a")))
+}
+
+func TestFragment_MatchesMaxSeq(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ts := make([]Tombstone, 0, 50)
+	for i := 0; i < 50; i++ {
+		start := r.Intn(100)
+		ts = append(ts, Tombstone{
+			Start: []byte(fmt.Sprintf("%03d", start)),
+			End:   []byte(fmt.Sprintf("%03d", start+1+r.Intn(20))),
+			Seq:   uint64(1 + r.Intn(100)),
+		})
+	}
+	for _, seq := range []uint64{0, 10, 50, 100} {
+		f := Fragment(ts, seq)
+		for i := 0; i < 130; i++ {
+			key := []byte(fmt.Sprintf("%03d", i))
+			assert.Equal(t, MaxSeq(ts, key, seq), f.Seq(key), "key %s at %d", key, seq)
+		}
+	}
+}
+
+func TestEncode_Decode(t *testing.T) {
+	ts := []Tombstone{
+		tombstone("a", "e", 3),
+		tombstone("c", "g", 1<<40),
+	}
+	got, err := Decode(Encode(ts))
+	assert.NoError(t, err)
+	assert.Equal(t, ts, got)
+
+	_, err = Decode(Encode(ts)[:7])
+	assert.ErrorIs(t, err, ErrInvalidTombstones)
+}
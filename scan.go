@@ -0,0 +1,72 @@
+package minilsm
+
+import (
+	"errors"
+	"minilsm/kv"
+)
+
+// BoundKind tells how a Bound limits a scan.
+type BoundKind uint8
+
+const (
+	// Unbounded leaves that end of the scan open.
+	Unbounded BoundKind = iota
+	// Included ends the scan at Key, which is part of it.
+	Included
+	// Excluded ends the scan right before Key.
+	Excluded
+)
+
+// Bound is one end of the key range of a scan. The zero value is
+// Unbounded.
+type Bound struct {
+	Kind BoundKind
+	Key  []byte
+}
+
+// Include returns the bound at key that includes key.
+func Include(key []byte) Bound {
+	return Bound{Kind: Included, Key: key}
+}
+
+// Exclude returns the bound at key that leaves key out.
+func Exclude(key []byte) Bound {
+	return Bound{Kind: Excluded, Key: key}
+}
+
+// ScanOptions select the keys of a scan. The zero value scans every key
+// from the first.
+type ScanOptions struct {
+	Lower Bound
+	Upper Bound
+	// Prefix, if not nil, leaves out the keys that do not start with it.
+	Prefix []byte
+	// Reverse positions the iterator at the last key instead of the first,
+	// to walk backward with Prev.
+	Reverse bool
+}
+
+var errEmptyBound = errors.New("bound key cannot be empty")
+
+// keyRange returns the user keys selected by o.
+func (o ScanOptions) keyRange() (kv.Range, error) {
+	var r kv.Range
+	switch o.Lower.Kind {
+	case Included, Excluded:
+		if len(o.Lower.Key) == 0 {
+			return kv.Range{}, errEmptyBound
+		}
+		r.Lower, r.LowerExclusive = o.Lower.Key, o.Lower.Kind == Excluded
+	}
+	switch o.Upper.Kind {
+	case Included, Excluded:
+		if len(o.Upper.Key) == 0 {
+			return kv.Range{}, errEmptyBound
+		}
+		r.Upper, r.UpperExclusive = o.Upper.Key, o.Upper.Kind == Excluded
+	}
+	if o.Prefix != nil {
+		r = r.Intersect(kv.PrefixRange(o.Prefix))
+	}
+	return r, nil
+}
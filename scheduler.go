@@ -0,0 +1,91 @@
+package minilsm
+
+import "time"
+
+// backgroundErrorDelay is how long a worker waits after a failed flush or
+// compaction before it looks for work again, so a lasting failure, such as
+// a full disk, is not retried in a busy loop.
+const backgroundErrorDelay = time.Second
+
+// startBackgroundWorkers starts the Options.BackgroundWorkers goroutines
+// that run the flushes and compactions of the storage.
+func (si *StorageInner) startBackgroundWorkers() {
+	for i := 0; i < si.opts.BackgroundWorkers; i++ {
+		si.bgWorkers.Add(1)
+		go si.backgroundWorker()
+	}
+}
+
+// stopBackgroundWorkers stops the background workers once the flushes and
+// compactions they are running are done. Stopping them again has no
+// effect.
+func (si *StorageInner) stopBackgroundWorkers() {
+	si.bgMu.Lock()
+	if si.bgClosed {
+		si.bgMu.Unlock()
+		return
+	}
+	si.bgClosed = true
+	close(si.bgDone)
+	si.bgCond.Broadcast()
+	si.bgMu.Unlock()
+	si.bgWorkers.Wait()
+}
+
+// scheduleBackgroundWork wakes the background workers to look for flushes
+// and compactions to run. It is called whenever a memtable is made
+// immutable or the tables change. The caller must not hold si.mu.
+func (si *StorageInner) scheduleBackgroundWork() {
+	si.bgMu.Lock()
+	si.bgCond.Broadcast()
+	si.bgMu.Unlock()
+}
+
+// backgroundWorker runs flushes and compactions until the storage is
+// closed, and sleeps while there are none to run. Flushes go first, as
+// writes stall on immutable memtables. Only one runs at a time, so L0 keeps
+// the order of the memtables.
+func (si *StorageInner) backgroundWorker() {
+	defer si.bgWorkers.Done()
+	si.bgMu.Lock()
+	defer si.bgMu.Unlock()
+
+	for !si.bgClosed {
+		if !si.bgFlushing && si.checkIfImmMemTableShouldFlushToSSTable() {
+			si.bgFlushing = true
+			si.runBackgroundJob(func() error {
+				si.log.Infof("start to sink immutable memtable to sstable")
+				return si.sinkImmMemTableToSSTable()
+			})
+			si.bgFlushing = false
+			continue
+		}
+		if task := si.startCompaction(); task != nil {
+			si.runBackgroundJob(func() error {
+				defer si.finishCompaction(task)
+				return si.compact(task)
+			})
+			continue
+		}
+		si.bgCond.Wait()
+	}
+}
+
+// runBackgroundJob runs job with si.bgMu unlocked, then wakes the other
+// workers, as the job may have made more work. Its error is handed to the
+// writes blocked by a write stall. The caller must hold si.bgMu.
+func (si *StorageInner) runBackgroundJob(job func() error) {
+	si.bgMu.Unlock()
+	defer si.bgMu.Lock()
+
+	err := job()
+	si.setBackgroundError(err)
+	if err != nil {
+		si.log.Errorf("background: %v", err)
+		select {
+		case <-time.After(backgroundErrorDelay):
+		case <-si.bgDone:
+		}
+	}
+	si.scheduleBackgroundWork()
+}
@@ -0,0 +1,235 @@
+package minilsm
+
+import (
+	"fmt"
+	"minilsm/iterator"
+	"minilsm/sstable"
+	"os"
+	"sync/atomic"
+)
+
+// Snapshot is a consistent point-in-time view of the storage. Reads through
+// a snapshot see exactly the writes made before it was taken, no matter
+// which writes, flushes and compactions run afterwards. A snapshot keeps the
+// versions and sstables it reads from alive, so release it once done.
+type Snapshot struct {
+	si       *StorageInner
+	seq      uint64
+	view     *view
+	released atomic.Bool
+}
+
+// NewSnapshot takes a snapshot of the storage as of the latest write.
+func (si *StorageInner) NewSnapshot() *Snapshot {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	si.refMu.Lock()
+	defer si.refMu.Unlock()
+
+	snap := &Snapshot{
+		si:   si,
+		seq:  si.LastSeq(),
+		view: si.currentView(),
+	}
+	si.refTablesLocked(snap.view.sstables())
+	si.snapshots[snap] = struct{}{}
+	return snap
+}
+
+// Seq returns the sequence number of the latest write the snapshot sees.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get is StorageInner.Get as of the snapshot.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.released.Load() {
+		return nil, fmt.Errorf("get: %w", ErrSnapshotReleased)
+	}
+	return s.view.get(key, s.seq)
+}
+
+// Scan is StorageInner.Scan as of the snapshot. The iterator must not be
+// used after the snapshot is released.
+func (s *Snapshot) Scan(lower, upper []byte) (iterator.Iterator, error) {
+	return s.ScanWithOptions(ScanOptions{Lower: Include(lower), Upper: Include(upper)})
+}
+
+// ScanReverse is StorageInner.ScanReverse as of the snapshot. The iterator
+// must not be used after the snapshot is released.
+func (s *Snapshot) ScanReverse(lower, upper []byte) (iterator.Iterator, error) {
+	return s.ScanWithOptions(ScanOptions{Lower: Include(lower), Upper: Include(upper), Reverse: true})
+}
+
+// ScanWithOptions is StorageInner.ScanWithOptions as of the snapshot. The
+// iterator must not be used after the snapshot is released.
+func (s *Snapshot) ScanWithOptions(opts ScanOptions) (iterator.Iterator, error) {
+	if s.released.Load() {
+		return nil, fmt.Errorf("scan: %w", ErrSnapshotReleased)
+	}
+	return s.view.scanWithOptions(opts, s.seq)
+}
+
+// Release lets compaction reclaim what the snapshot kept alive. Releasing a
+// snapshot more than once has no effect.
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+	s.si.refMu.Lock()
+	defer s.si.refMu.Unlock()
+
+	delete(s.si.snapshots, s)
+	s.si.unrefTablesLocked(s.view.sstables())
+}
+
+// refTables keeps tables from being removed by compactions until
+// unrefTables is called with them. The caller must hold si.mu, so none of
+// tables is dropped before.
+func (si *StorageInner) refTables(tables []*sstable.Table) {
+	si.refMu.Lock()
+	defer si.refMu.Unlock()
+	si.refTablesLocked(tables)
+}
+
+// refTablesLocked is refTables for a caller holding si.refMu too.
+func (si *StorageInner) refTablesLocked(tables []*sstable.Table) {
+	for _, t := range tables {
+		si.tableRefs[t]++
+	}
+}
+
+// unrefTables drops the references refTables took, and removes the tables
+// compacted away meanwhile that are referenced no more.
+func (si *StorageInner) unrefTables(tables []*sstable.Table) {
+	si.refMu.Lock()
+	defer si.refMu.Unlock()
+	si.unrefTablesLocked(tables)
+}
+
+// unrefTablesLocked is unrefTables for a caller holding si.refMu.
+func (si *StorageInner) unrefTablesLocked(tables []*sstable.Table) {
+	for _, t := range tables {
+		si.tableRefs[t]--
+		if si.tableRefs[t] > 0 {
+			continue
+		}
+		delete(si.tableRefs, t)
+		if si.obsoleteTables[t] {
+			delete(si.obsoleteTables, t)
+			si.removeTable(t)
+		}
+	}
+}
+
+// pinnedIterator is an iterator that references the sstables it reads from
+// until it runs off either end, fails or is closed. From then on it stays
+// invalid, as the sstables may be gone.
+type pinnedIterator struct {
+	iterator.Iterator
+	si       *StorageInner
+	tables   []*sstable.Table
+	released bool
+}
+
+func newPinnedIterator(si *StorageInner, iter iterator.Iterator, tables []*sstable.Table) *pinnedIterator {
+	si.refTables(tables)
+	it := &pinnedIterator{Iterator: iter, si: si, tables: tables}
+	it.releaseIfDone()
+	return it
+}
+
+func (it *pinnedIterator) IsValid() bool {
+	return !it.released && it.Iterator.IsValid()
+}
+
+func (it *pinnedIterator) Next() {
+	it.Iterator.Next()
+	it.releaseIfDone()
+}
+
+func (it *pinnedIterator) Prev() {
+	it.Iterator.Prev()
+	it.releaseIfDone()
+}
+
+func (it *pinnedIterator) Seek(key []byte) {
+	if !it.released {
+		it.Iterator.Seek(key)
+		it.releaseIfDone()
+	}
+}
+
+func (it *pinnedIterator) SeekToFirst() {
+	if !it.released {
+		it.Iterator.SeekToFirst()
+		it.releaseIfDone()
+	}
+}
+
+func (it *pinnedIterator) SeekToLast() {
+	if !it.released {
+		it.Iterator.SeekToLast()
+		it.releaseIfDone()
+	}
+}
+
+func (it *pinnedIterator) SeekForPrev(key []byte) {
+	if !it.released {
+		it.Iterator.SeekForPrev(key)
+		it.releaseIfDone()
+	}
+}
+
+func (it *pinnedIterator) Close() error {
+	if !it.released {
+		it.released = true
+		it.si.unrefTables(it.tables)
+	}
+	return it.Iterator.Close()
+}
+
+// releaseIfDone drops the references of the iterator once it is no longer
+// valid.
+func (it *pinnedIterator) releaseIfDone() {
+	if !it.released && !it.Iterator.IsValid() {
+		it.released = true
+		it.si.unrefTables(it.tables)
+	}
+}
+
+// gcWatermark returns the oldest sequence number a reader may still read
+// at: that of the oldest snapshot, or the latest write if there is none.
+func (si *StorageInner) gcWatermark() uint64 {
+	si.refMu.Lock()
+	defer si.refMu.Unlock()
+
+	watermark := si.LastSeq()
+	for snap := range si.snapshots {
+		watermark = min(watermark, snap.seq)
+	}
+	return watermark
+}
+
+// dropTables closes and removes tables that are no longer part of the
+// storage, or, for those a snapshot still reads from, defers that until the
+// last such snapshot is released.
+func (si *StorageInner) dropTables(tables []*sstable.Table) {
+	si.refMu.Lock()
+	defer si.refMu.Unlock()
+
+	for _, t := range tables {
+		if si.tableRefs[t] > 0 {
+			si.obsoleteTables[t] = true
+			continue
+		}
+		si.removeTable(t)
+	}
+}
+
+func (si *StorageInner) removeTable(t *sstable.Table) {
+	t.Close()
+	if err := os.Remove(si.sstPath(t.SSTID())); err != nil {
+		si.log.Errorf("remove table %d: %v", t.SSTID(), err)
+	}
+}
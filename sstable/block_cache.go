@@ -0,0 +1,55 @@
+package sstable
+
+import (
+	"minilsm/block"
+	"minilsm/cache"
+)
+
+// BlockCache caches the blocks of the tables of one store, in a cache that
+// may be shared with other stores. A nil *BlockCache caches nothing.
+type BlockCache struct {
+	cache *cache.Cache
+	id    uint64
+}
+
+func NewBlockCache(c *cache.Cache) *BlockCache {
+	return &BlockCache{
+		cache: c,
+		id:    c.NewID(),
+	}
+}
+
+func (bc *BlockCache) get(table, blockIdx uint32) (*block.Block, bool) {
+	if bc == nil {
+		return nil, false
+	}
+	v, ok := bc.cache.Get(cache.Key{ID: bc.id, File: table, Block: blockIdx})
+	if !ok {
+		return nil, false
+	}
+	return v.(*block.Block), true
+}
+
+func (bc *BlockCache) insert(table, blockIdx uint32, b *block.Block) {
+	if bc == nil {
+		return
+	}
+	bc.cache.Insert(cache.Key{ID: bc.id, File: table, Block: blockIdx}, b, int64(b.Size()))
+}
+
+// evict drops the blocks of table.
+func (bc *BlockCache) evict(table uint32) {
+	if bc == nil {
+		return
+	}
+	bc.cache.EvictFile(bc.id, table)
+}
+
+// Stats returns the statistics of the underlying cache, which cover every
+// store sharing it.
+func (bc *BlockCache) Stats() cache.Stats {
+	if bc == nil {
+		return cache.Stats{}
+	}
+	return bc.cache.Stats()
+}
@@ -0,0 +1,221 @@
+package sstable
+
+import (
+	"fmt"
+	"minilsm/iterator"
+	"minilsm/kv"
+	"sort"
+)
+
+// ConcatIter iterates over tables that are sorted by key and whose user key
+// ranges do not overlap, such as the tables of one level, opening one table
+// at a time.
+type ConcatIter struct {
+	tables  []*Table
+	current *Iter
+	idx     int
+	// start and end bound the iterator like those of Iter. It does not
+	// open the tables out of the bounds.
+	start []byte
+	end   []byte
+	err   error
+}
+
+// IsValid implements iterator.Iterator.
+func (c *ConcatIter) IsValid() bool {
+	return c.err == nil && c.current != nil && c.current.IsValid()
+}
+
+// Key implements iterator.Iterator.
+func (c *ConcatIter) Key() []byte {
+	return c.current.Key()
+}
+
+// Value implements iterator.Iterator.
+func (c *ConcatIter) Value() []byte {
+	return c.current.Value()
+}
+
+// Next implements iterator.Iterator.
+func (c *ConcatIter) Next() {
+	if !c.IsValid() {
+		return
+	}
+	c.current.Next()
+	if c.current.IsValid() || c.checkCurrent() {
+		return
+	}
+	c.idx++
+	c.err = c.openValid(1, (*Iter).seekToFirst)
+}
+
+// Prev implements iterator.Iterator.
+func (c *ConcatIter) Prev() {
+	if !c.IsValid() {
+		return
+	}
+	c.current.Prev()
+	if c.current.IsValid() || c.checkCurrent() {
+		return
+	}
+	c.idx--
+	c.err = c.openValid(-1, (*Iter).seekToLast)
+}
+
+// Seek implements iterator.Iterator.
+func (c *ConcatIter) Seek(key []byte) {
+	c.err = c.seek(key)
+}
+
+// SeekToFirst implements iterator.Iterator.
+func (c *ConcatIter) SeekToFirst() {
+	c.err = c.seekToFirst()
+}
+
+// SeekToLast implements iterator.Iterator.
+func (c *ConcatIter) SeekToLast() {
+	c.err = c.seekToLast()
+}
+
+// SeekForPrev implements iterator.Iterator.
+func (c *ConcatIter) SeekForPrev(key []byte) {
+	c.err = c.seekForPrev(key)
+}
+
+// Error implements iterator.Iterator.
+func (c *ConcatIter) Error() error {
+	return c.err
+}
+
+// Close implements iterator.Iterator.
+func (c *ConcatIter) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+var _ iterator.Iterator = (*ConcatIter)(nil)
+
+func (c *ConcatIter) seek(key []byte) error {
+	c.idx = FindTable(c.tables, kv.UserKey(key))
+	return c.openValid(1, func(iter *Iter) error {
+		return iter.seek(key)
+	})
+}
+
+func (c *ConcatIter) seekToFirst() error {
+	if c.start != nil {
+		return c.seek(c.start)
+	}
+	c.idx = 0
+	return c.openValid(1, (*Iter).seekToFirst)
+}
+
+func (c *ConcatIter) seekToLast() error {
+	if c.end != nil {
+		return c.seekForPrev(c.end)
+	}
+	c.idx = len(c.tables) - 1
+	return c.openValid(-1, (*Iter).seekToLast)
+}
+
+func (c *ConcatIter) seekForPrev(key []byte) error {
+	// the last table whose first key is not greater than key
+	c.idx = sort.Search(len(c.tables), func(i int) bool {
+		return kv.Compare(c.tables[i].FirstKey(), key) > 0
+	}) - 1
+	return c.openValid(-1, func(iter *Iter) error {
+		return iter.seekForPrev(key)
+	})
+}
+
+// checkCurrent records the error of the current table, if any, and reports
+// whether there was one.
+func (c *ConcatIter) checkCurrent() bool {
+	if err := c.current.Error(); err != nil {
+		c.err = fmt.Errorf("table %d: %w", c.tables[c.idx].SSTID(), err)
+		return true
+	}
+	return false
+}
+
+// openValid opens tables starting at c.idx and moving by step until one
+// yields a valid iterator once positioned by seek. It stops at the first
+// table out of the bounds.
+func (c *ConcatIter) openValid(step int, seek func(*Iter) error) error {
+	c.current = nil
+	for ; c.idx >= 0 && c.idx < len(c.tables); c.idx += step {
+		t := c.tables[c.idx]
+		if step > 0 && c.end != nil && kv.Compare(t.FirstKey(), c.end) >= 0 ||
+			step < 0 && c.start != nil && kv.Compare(t.LastKey(), c.start) < 0 {
+			return nil
+		}
+		iter := &Iter{table: t, start: c.start, end: c.end}
+		if err := seek(iter); err != nil {
+			return fmt.Errorf("table %d: %w", t.SSTID(), err)
+		}
+		if iter.clamp(); iter.IsValid() {
+			c.current = iter
+			return nil
+		}
+	}
+	return nil
+}
+
+// NewConcatRangeIter returns an iterator over the entries of the user keys
+// in r, positioned at the first of them.
+func NewConcatRangeIter(tables []*Table, r kv.Range) (*ConcatIter, error) {
+	c := &ConcatIter{tables: tables, start: r.Start(), end: r.End()}
+	if err := c.seekToFirst(); err != nil {
+		return nil, fmt.Errorf("new concat range iter: %w", err)
+	}
+	return c, nil
+}
+
+func NewConcatIterAndSeekToFirst(tables []*Table) (*ConcatIter, error) {
+	c := &ConcatIter{tables: tables}
+	if err := c.seekToFirst(); err != nil {
+		return nil, fmt.Errorf("new concat iter and seek to first: %w", err)
+	}
+	return c, nil
+}
+
+func NewConcatIterAndSeekToLast(tables []*Table) (*ConcatIter, error) {
+	c := &ConcatIter{tables: tables}
+	if err := c.seekToLast(); err != nil {
+		return nil, fmt.Errorf("new concat iter and seek to last: %w", err)
+	}
+	return c, nil
+}
+
+// NewConcatIterAndSeekForPrev positions the iterator at the last entry not
+// greater than the internal key key.
+func NewConcatIterAndSeekForPrev(tables []*Table, key []byte) (*ConcatIter, error) {
+	c := &ConcatIter{tables: tables}
+	if err := c.seekForPrev(key); err != nil {
+		return nil, fmt.Errorf("new concat iter and seek for prev: %w", err)
+	}
+	return c, nil
+}
+
+// NewConcatIterAndSeekToKey positions the iterator at the first entry not
+// less than the internal key key.
+func NewConcatIterAndSeekToKey(tables []*Table, key []byte) (*ConcatIter, error) {
+	c := &ConcatIter{tables: tables}
+	if err := c.seek(key); err != nil {
+		return nil, fmt.Errorf("new concat iter and seek to key: %w", err)
+	}
+	return c, nil
+}
+
+// FindTable returns the index of the first of the sorted, non-overlapping
+// tables that covers a user key not less than userKey, or len(tables) if
+// there is none.
+func FindTable(tables []*Table, userKey []byte) int {
+	return sort.Search(len(tables), func(i int) bool {
+		return tables[i].endsAtOrAfter(userKey)
+	})
+}
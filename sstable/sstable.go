@@ -5,22 +5,87 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"hash/crc32"
 	"minilsm/block"
+	"minilsm/compress"
+	"minilsm/filter"
+	"minilsm/kv"
+	"minilsm/rangedel"
 	"os"
-	"sync"
+	"sort"
 )
 
 type Table struct {
-	id          uint32
-	fd          *os.File
-	metas       []*block.Meta
-	metasOffset uint32
-	blockCache  *sync.Map
+	id    uint32
+	fd    *os.File
+	metas []*block.Meta
+	// dataSize is the size of the data blocks, which start the file.
+	dataSize   uint32
+	blockCache *BlockCache
+	firstKey   []byte
+	lastKey    []byte
+	size       uint64
+	// maxSeq is the largest sequence number of the entries and range
+	// tombstones of the table.
+	maxSeq    uint64
+	rangeDels []rangedel.Tombstone
+
+	// filter is built over the user keys of the table by the filter policy
+	// named filterName. It is nil if the table has no filter.
+	filterName string
+	filter     []byte
+}
+
+// footerSize is the size of the fixed-size end of a table file.
+const footerSize = 5 * block.SizeOfUint32
+
+// checksumSize is the size of the CRC32C checksum that follows every block
+// and its compression type.
+const checksumSize = block.SizeOfUint32
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+var ErrCorruption = errors.New("corruption")
+
+// CorruptionError reports table data that failed verification.
+type CorruptionError struct {
+	ID     uint32
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corruption in table %d at offset %d: %s", e.ID, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruption
+}
+
+// OpenTable opens the sstable file at path, as written by TableBulder.Build.
+func OpenTable(id uint32, blockCache *BlockCache, path string) (*Table, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open table: %w", err)
+	}
+	t, err := openTableFromFile(id, blockCache, fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("open table %d: %w", id, err)
+	}
+	return t, nil
 }
 
-// | ...blocks... | blocks_meta | blocks_meta_offset |
-func openTableFromFile(id uint32, blockCache *sync.Map, fd *os.File) (*Table, error) {
+// | ...blocks... | filter | range_dels | blocks_meta | key_range | filter_offset | range_dels_offset | blocks_meta_offset | key_range_offset | checksum |
+//
+// Every block is followed by its compression type and a checksum of both,
+// and the checksum in the footer covers everything from the filter to the
+// key range.
+func openTableFromFile(id uint32, blockCache *BlockCache, fd *os.File) (*Table, error) {
 	errorHandle := func(e error, n int, got int) error {
 		if e != nil {
 			return fmt.Errorf("open table file failed: %v", e)
@@ -35,34 +100,133 @@ func openTableFromFile(id uint32, blockCache *sync.Map, fd *os.File) (*Table, er
 	if err := errorHandle(err, 0, 0); err != nil {
 		return nil, err
 	}
+	footerOffset := fi.Size() - footerSize
+	if footerOffset < 0 {
+		return nil, &CorruptionError{ID: id, Offset: 0, Reason: "file too short"}
+	}
 
-	var raw [block.SizeOfUint32]byte
-	n, err := fd.ReadAt(raw[:], fi.Size()-block.SizeOfUint32)
-	if err := errorHandle(err, n, block.SizeOfUint32); err != nil {
+	var raw [footerSize]byte
+	n, err := fd.ReadAt(raw[:], footerOffset)
+	if err := errorHandle(err, n, footerSize); err != nil {
 		return nil, err
 	}
-	blockMetaOffset := binary.LittleEndian.Uint32(raw[:])
+	filterOffset := binary.LittleEndian.Uint32(raw[:])
+	rangeDelOffset := binary.LittleEndian.Uint32(raw[block.SizeOfUint32:])
+	blockMetaOffset := binary.LittleEndian.Uint32(raw[2*block.SizeOfUint32:])
+	keyRangeOffset := binary.LittleEndian.Uint32(raw[3*block.SizeOfUint32:])
+	tailChecksum := binary.LittleEndian.Uint32(raw[4*block.SizeOfUint32:])
+	if filterOffset > rangeDelOffset || rangeDelOffset > blockMetaOffset || blockMetaOffset > keyRangeOffset || int64(keyRangeOffset) > footerOffset {
+		return nil, &CorruptionError{ID: id, Offset: footerOffset, Reason: "invalid footer"}
+	}
 
-	_, err = fd.Seek(int64(blockMetaOffset), io.SeekStart)
-	if err := errorHandle(err, 0, 0); err != nil {
+	// everything after the data blocks is small enough to read at once
+	tail := make([]byte, footerOffset-int64(filterOffset))
+	n, err = fd.ReadAt(tail, int64(filterOffset))
+	if err := errorHandle(err, n, len(tail)); err != nil {
 		return nil, err
 	}
+	if checksum(tail) != tailChecksum {
+		return nil, &CorruptionError{ID: id, Offset: int64(filterOffset), Reason: "meta checksum mismatch"}
+	}
+	filterData := tail[:rangeDelOffset-filterOffset]
+	rangeDelData := tail[rangeDelOffset-filterOffset : blockMetaOffset-filterOffset]
+	metaData := tail[blockMetaOffset-filterOffset : keyRangeOffset-filterOffset]
+	keyRangeData := tail[keyRangeOffset-filterOffset:]
 
-	metas, err := block.DecodeBlockMetaFromReader(io.LimitReader(fd, int64(fi.Size())-int64(block.SizeOfUint32)-int64(blockMetaOffset)))
-	if err := errorHandle(err, 0, 0); err != nil {
-		return nil, err
+	metas, err := block.DecodeBlockMeta(metaData)
+	if err != nil {
+		return nil, &CorruptionError{ID: id, Offset: int64(blockMetaOffset), Reason: err.Error()}
+	}
+	rangeDels, err := rangedel.Decode(rangeDelData)
+	if err != nil {
+		return nil, &CorruptionError{ID: id, Offset: int64(rangeDelOffset), Reason: err.Error()}
+	}
+	firstKey, lastKey, maxSeq, err := decodeKeyRange(keyRangeData)
+	if err != nil {
+		return nil, &CorruptionError{ID: id, Offset: int64(keyRangeOffset), Reason: err.Error()}
+	}
+
+	t := &Table{
+		id:         id,
+		fd:         fd,
+		metas:      metas,
+		dataSize:   filterOffset,
+		blockCache: blockCache,
+		firstKey:   firstKey,
+		lastKey:    lastKey,
+		maxSeq:     maxSeq,
+		rangeDels:  rangeDels,
+		size:       uint64(fi.Size()),
+	}
+	t.filterName, t.filter = decodeFilter(filterData)
+	return t, nil
+}
+
+// The key range is followed by the largest sequence number of the table.
+//
+// +----------------+-----------+---------------+----------+---------+
+// | first key size | first key | last key size | last key | max seq |
+// +----------------+-----------+---------------+----------+---------+
+// |    uvarint     |   bytes   |    uvarint    |  bytes   | uvarint |
+// +----------------+-----------+---------------+----------+---------+
+func encodeKeyRange(firstKey, lastKey []byte, maxSeq uint64) []byte {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen32+len(firstKey)+len(lastKey)+binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, uint64(len(firstKey)))
+	buf = append(buf, firstKey...)
+	buf = binary.AppendUvarint(buf, uint64(len(lastKey)))
+	buf = append(buf, lastKey...)
+	return binary.AppendUvarint(buf, maxSeq)
+}
+
+var errInvalidKeyRange = errors.New("invalid key range")
+
+func decodeKeyRange(data []byte) (firstKey, lastKey []byte, maxSeq uint64, err error) {
+	next := func() ([]byte, bool) {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, false
+		}
+		key := data[n : n+int(size)]
+		data = data[n+int(size):]
+		return key, true
 	}
+	firstKey, ok := next()
+	if !ok {
+		return nil, nil, 0, errInvalidKeyRange
+	}
+	lastKey, ok = next()
+	if !ok {
+		return nil, nil, 0, errInvalidKeyRange
+	}
+	maxSeq, n := binary.Uvarint(data)
+	if n <= 0 || n != len(data) {
+		return nil, nil, 0, errInvalidKeyRange
+	}
+	if len(firstKey) == 0 {
+		return nil, nil, maxSeq, nil
+	}
+	return firstKey, lastKey, maxSeq, nil
+}
 
-	return &Table{
-		id:          id,
-		fd:          fd,
-		metas:       metas,
-		metasOffset: blockMetaOffset,
-		blockCache:  blockCache,
-	}, nil
+func decodeFilter(data []byte) (name string, filter []byte) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil
+	}
+	return string(data[1 : 1+data[0]]), data[1+data[0]:]
 }
 
+// MayContain reports whether the table may contain userKey, according to
+// its filter. It is true if the table has no filter built by policy.
+func (t *Table) MayContain(policy filter.Policy, userKey []byte) bool {
+	if policy == nil || t.filter == nil || t.filterName != policy.Name() {
+		return true
+	}
+	return policy.MayContain(t.filter, userKey)
+}
+
+// Close closes the table file and drops its blocks from the block cache.
 func (t *Table) Close() error {
+	t.blockCache.evict(t.id)
 	err := t.fd.Close()
 	if err != nil {
 		return fmt.Errorf("table close: %w", err)
@@ -76,7 +240,10 @@ func (t *Table) ReadBlock(blockIdx uint32) (*block.Block, error) {
 	if blockIdx < uint32(len(t.metas)-1) {
 		nextOffset = t.metas[blockIdx+1].Offset
 	} else {
-		nextOffset = t.metasOffset
+		nextOffset = t.dataSize
+	}
+	if nextOffset < offset+1+checksumSize {
+		return nil, &CorruptionError{ID: t.id, Offset: int64(offset), Reason: "invalid block size"}
 	}
 	buf := make([]byte, nextOffset-offset)
 	n, err := t.fd.ReadAt(buf, int64(offset))
@@ -86,23 +253,37 @@ func (t *Table) ReadBlock(blockIdx uint32) (*block.Block, error) {
 	if n != len(buf) {
 		return nil, errors.New("read block data failed")
 	}
+	data := buf[:len(buf)-checksumSize]
+	if checksum(data) != binary.LittleEndian.Uint32(buf[len(data):]) {
+		return nil, &CorruptionError{ID: t.id, Offset: int64(offset), Reason: "block checksum mismatch"}
+	}
+	typ := compress.Type(data[len(data)-1])
+	data = data[:len(data)-1]
+	if typ != compress.None {
+		c, ok := compress.Lookup(typ)
+		if !ok {
+			return nil, &CorruptionError{ID: t.id, Offset: int64(offset), Reason: fmt.Sprintf("unknown compression type %d", typ)}
+		}
+		if data, err = c.Decompress(data); err != nil {
+			return nil, &CorruptionError{ID: t.id, Offset: int64(offset), Reason: err.Error()}
+		}
+	}
 	var b block.Block
-	if err := b.Decode(buf); err != nil {
-		return nil, fmt.Errorf("table read block: %w", err)
+	if err := b.Decode(data); err != nil {
+		return nil, &CorruptionError{ID: t.id, Offset: int64(offset), Reason: err.Error()}
 	}
 	return &b, nil
 }
 
 func (t *Table) ReadBlockCached(blockIdx uint32) (*block.Block, error) {
-	key := [2]uint32{t.id, blockIdx}
-	if v, ok := t.blockCache.Load(key); ok {
-		return v.(*block.Block), nil
+	if b, ok := t.blockCache.get(t.id, blockIdx); ok {
+		return b, nil
 	}
 	b, err := t.ReadBlock(blockIdx)
 	if err != nil {
 		return nil, err
 	}
-	t.blockCache.Store(key, b)
+	t.blockCache.insert(t.id, blockIdx, b)
 	return b, nil
 }
 
@@ -110,15 +291,77 @@ func (t *Table) Len() uint32 {
 	return uint32(len(t.metas))
 }
 
+// FindBlockIdx returns the index of the last block whose first key is not
+// greater than the internal key key, or -1 if there is none.
 func (t *Table) FindBlockIdx(key []byte) int {
-	for i := uint32(0); i < t.Len(); i++ {
-		if bytes.Compare(t.metas[i].FirstKey, key) > 0 {
-			return int(i) - 1
-		}
-	}
-	return int(t.Len()) - 1
+	return sort.Search(len(t.metas), func(i int) bool {
+		return kv.Compare(t.metas[i].FirstKey, key) > 0
+	}) - 1
 }
 
 func (t *Table) SSTID() uint32 {
 	return t.id
 }
+
+// FirstKey returns the smallest internal key of the table.
+func (t *Table) FirstKey() []byte {
+	return t.firstKey
+}
+
+// LastKey returns the largest internal key of the table.
+func (t *Table) LastKey() []byte {
+	return t.lastKey
+}
+
+// Overlaps reports whether the user key range of the table overlaps the
+// user key range [lower, upper].
+func (t *Table) Overlaps(lower, upper []byte) bool {
+	if t.firstKey == nil {
+		return false
+	}
+	return bytes.Compare(kv.UserKey(t.firstKey), upper) <= 0 && t.endsAtOrAfter(lower)
+}
+
+// OverlapsRange reports whether the user key range of the table overlaps r.
+func (t *Table) OverlapsRange(r kv.Range) bool {
+	if t.firstKey == nil {
+		return false
+	}
+	if r.Upper != nil {
+		c := bytes.Compare(kv.UserKey(t.firstKey), r.Upper)
+		if c > 0 || c == 0 && r.UpperExclusive {
+			return false
+		}
+	}
+	if r.Lower != nil {
+		if r.LowerExclusive {
+			return bytes.Compare(kv.UserKey(t.lastKey), r.Lower) > 0
+		}
+		return t.endsAtOrAfter(r.Lower)
+	}
+	return true
+}
+
+// endsAtOrAfter reports whether the table covers a user key not less than
+// userKey. A table whose last key is a sentinel key does not cover the user
+// key of the sentinel.
+func (t *Table) endsAtOrAfter(userKey []byte) bool {
+	c := bytes.Compare(kv.UserKey(t.lastKey), userKey)
+	return c > 0 || c == 0 && !kv.IsSentinelKey(t.lastKey)
+}
+
+// MaxSeq returns the largest sequence number of the entries and range
+// tombstones of the table.
+func (t *Table) MaxSeq() uint64 {
+	return t.maxSeq
+}
+
+// RangeDels returns the range tombstones of the table.
+func (t *Table) RangeDels() []rangedel.Tombstone {
+	return t.rangeDels
+}
+
+// Size returns the size of the table file in bytes.
+func (t *Table) Size() uint64 {
+	return t.size
+}
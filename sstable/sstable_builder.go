@@ -1,74 +1,172 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"minilsm/block"
-	"minilsm/logger"
+	"minilsm/compress"
+	"minilsm/filter"
+	"minilsm/kv"
+	"minilsm/rangedel"
 	"minilsm/util"
 	"os"
-	"sync"
 )
 
-var log = logger.GetLogger()
-
 type TableBulder struct {
 	builder   *block.Builder
 	firstKey  []byte
+	lastKey   []byte
 	data      [][]byte
 	dataSize  uint32
 	metas     []*block.Meta
-	blockSize uint16
+	blockSize uint32
+
+	filterPolicy filter.Policy
+	// filterKeys are the distinct user keys added, for the filter.
+	filterKeys [][]byte
+	compressor compress.Compressor
+
+	rangeDels []rangedel.Tombstone
+	// maxSeq is the largest sequence number of the entries and range
+	// tombstones added.
+	maxSeq uint64
 }
 
-func NewTableBuilder(blockSize uint16) *TableBulder {
-	return &TableBulder{
+type BuilderOption func(tb *TableBulder)
+
+// WithFilterPolicy makes the builder write a filter over the user keys of
+// the table, built by policy.
+func WithFilterPolicy(policy filter.Policy) BuilderOption {
+	return func(tb *TableBulder) {
+		tb.filterPolicy = policy
+	}
+}
+
+// WithCompressor makes the builder compress blocks with c. A block is
+// stored uncompressed when compressing it saves less than an eighth of it.
+func WithCompressor(c compress.Compressor) BuilderOption {
+	return func(tb *TableBulder) {
+		tb.compressor = c
+	}
+}
+
+func NewTableBuilder(blockSize uint32, opts ...BuilderOption) *TableBulder {
+	tb := &TableBulder{
 		builder:   block.NewBlockBuilder(blockSize),
 		metas:     make([]*block.Meta, 0),
 		blockSize: blockSize,
 	}
+	for _, opt := range opts {
+		opt(tb)
+	}
+	return tb
 }
 
+// Add adds an entry whose key is an internal key. Keys must be added in
+// kv.Compare order.
 func (tb *TableBulder) Add(key, value []byte) (err error) {
 	if tb.firstKey == nil {
 		tb.firstKey = util.DeepCopySlice(key)
 	}
 	err = tb.builder.Add(key, value)
-	if err != nil {
-		if errors.Is(err, block.ErrBlockFull) {
-			tb.finishBlock()
-			if tb.Add(key, value) != nil {
-				panic(fmt.Errorf("tablebuilder add: %w", err))
-			}
-			tb.firstKey = util.DeepCopySlice(key)
-		} else {
+	if errors.Is(err, block.ErrBlockFull) {
+		// an empty block takes any entry, however large
+		if err := tb.finishBlock(); err != nil {
 			return fmt.Errorf("tablebuilder add: %w", err)
 		}
+		tb.firstKey = util.DeepCopySlice(key)
+		err = tb.builder.Add(key, value)
 	}
+	if err != nil {
+		return fmt.Errorf("tablebuilder add: %w", err)
+	}
+	if tb.filterPolicy != nil && (tb.lastKey == nil || !bytes.Equal(kv.UserKey(tb.lastKey), kv.UserKey(key))) {
+		tb.filterKeys = append(tb.filterKeys, util.DeepCopySlice(kv.UserKey(key)))
+	}
+	tb.lastKey = util.DeepCopySlice(key)
+	tb.maxSeq = max(tb.maxSeq, kv.Seq(key))
 	return nil
 }
 
-func (tb *TableBulder) finishBlock() {
+// AddRangeDel adds a range tombstone, which is kept in a block of its own
+// rather than among the entries.
+func (tb *TableBulder) AddRangeDel(t rangedel.Tombstone) {
+	tb.rangeDels = append(tb.rangeDels, rangedel.Tombstone{
+		Start: util.DeepCopySlice(t.Start),
+		End:   util.DeepCopySlice(t.End),
+		Seq:   t.Seq,
+	})
+	tb.maxSeq = max(tb.maxSeq, t.Seq)
+}
+
+// EstimatedSize returns the approximate size of the table built so far.
+func (tb *TableBulder) EstimatedSize() uint32 {
+	return tb.dataSize + tb.blockSize
+}
+
+// LastKey returns the last key added.
+func (tb *TableBulder) LastKey() []byte {
+	return tb.lastKey
+}
+
+func (tb *TableBulder) IsEmpty() bool {
+	return len(tb.metas) == 0 && tb.builder.IsEmpty() && len(tb.rangeDels) == 0
+}
+
+func (tb *TableBulder) finishBlock() error {
 	if !tb.builder.IsEmpty() {
+		data, err := tb.compressBlock(tb.builder.Build().Encode())
+		if err != nil {
+			return err
+		}
 		tb.metas = append(tb.metas, block.NewBlockMeta(tb.dataSize, tb.firstKey))
-		data := tb.builder.Build().Encode()
+		data = binary.LittleEndian.AppendUint32(data, checksum(data))
 		tb.data = append(tb.data, data)
 		tb.dataSize += uint32(len(data))
 	}
 	tb.builder = block.NewBlockBuilder(tb.blockSize)
+	return nil
+}
+
+// compressBlock returns data, compressed if that pays off, followed by its
+// compression type.
+func (tb *TableBulder) compressBlock(data []byte) ([]byte, error) {
+	typ := compress.None
+	if tb.compressor != nil {
+		compressed, err := tb.compressor.Compress(data)
+		if err != nil {
+			return nil, fmt.Errorf("compress block: %w", err)
+		}
+		if len(compressed) < len(data)-len(data)/8 {
+			data, typ = compressed, tb.compressor.Type()
+		}
+	}
+	return append(data, byte(typ)), nil
 }
 
 var errIntenalWriteError = errors.New("internal write error")
 
 var errBuildInternalWriteError = fmt.Errorf("tablebuilder build: %w", errIntenalWriteError)
 
-func (tb *TableBulder) Build(id uint32, cache *sync.Map, path string) (*Table, error) {
+// Build writes the table to a new file at path and opens it. On error, the
+// file is closed and removed, so no partial table is left behind.
+func (tb *TableBulder) Build(id uint32, blockCache *BlockCache, path string) (_ *Table, err error) {
+	if err := tb.finishBlock(); err != nil {
+		return nil, fmt.Errorf("tablebuilder build: %w", err)
+	}
 	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o600)
 	if err != nil {
 		return nil, fmt.Errorf("tablebuilder build: %w", err)
 	}
-	tb.finishBlock()
+	defer func() {
+		if err != nil {
+			fd.Close()
+			os.Remove(path)
+		}
+	}()
 
 	for i := range tb.data {
 		n, err := fd.Write(tb.data[i])
@@ -80,8 +178,28 @@ func (tb *TableBulder) Build(id uint32, cache *sync.Map, path string) (*Table, e
 		}
 	}
 
+	filterData := tb.buildFilter()
+	n, err := fd.Write(filterData)
+	if n != len(filterData) {
+		return nil, errBuildInternalWriteError
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tablebuilder build: %w", err)
+	}
+	rangeDelOffset := tb.dataSize + uint32(len(filterData))
+
+	rangeDelData := rangedel.Encode(tb.rangeDels)
+	n, err = fd.Write(rangeDelData)
+	if n != len(rangeDelData) {
+		return nil, errBuildInternalWriteError
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tablebuilder build: %w", err)
+	}
+	metasOffset := rangeDelOffset + uint32(len(rangeDelData))
+
 	metaData := block.EncodeBlockMeta(tb.metas)
-	n, err := fd.Write(metaData[:])
+	n, err = fd.Write(metaData[:])
 	if n != len(metaData) {
 		return nil, errBuildInternalWriteError
 	}
@@ -89,10 +207,29 @@ func (tb *TableBulder) Build(id uint32, cache *sync.Map, path string) (*Table, e
 		return nil, fmt.Errorf("tablebuilder build: %w", err)
 	}
 
-	var buf [block.SizeOfUint32]byte
+	firstKey, lastKey := tb.bounds()
+	keyRangeData := encodeKeyRange(firstKey, lastKey, tb.maxSeq)
+	n, err = fd.Write(keyRangeData)
+	if n != len(keyRangeData) {
+		return nil, errBuildInternalWriteError
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tablebuilder build: %w", err)
+	}
+	keyRangeOffset := metasOffset + uint32(len(metaData))
+
+	var buf [footerSize]byte
 	binary.LittleEndian.PutUint32(buf[:], tb.dataSize)
+	binary.LittleEndian.PutUint32(buf[block.SizeOfUint32:], rangeDelOffset)
+	binary.LittleEndian.PutUint32(buf[2*block.SizeOfUint32:], metasOffset)
+	binary.LittleEndian.PutUint32(buf[3*block.SizeOfUint32:], keyRangeOffset)
+	crc := crc32.Update(0, crcTable, filterData)
+	crc = crc32.Update(crc, crcTable, rangeDelData)
+	crc = crc32.Update(crc, crcTable, metaData)
+	crc = crc32.Update(crc, crcTable, keyRangeData)
+	binary.LittleEndian.PutUint32(buf[4*block.SizeOfUint32:], crc)
 	n, err = fd.Write(buf[:])
-	if n != block.SizeOfUint32 {
+	if n != footerSize {
 		return nil, errBuildInternalWriteError
 	}
 	if err != nil {
@@ -104,11 +241,56 @@ func (tb *TableBulder) Build(id uint32, cache *sync.Map, path string) (*Table, e
 		return nil, fmt.Errorf("tablebuilder build: %w", err)
 	}
 
-	return &Table{
-		id:          id,
-		fd:          fd,
-		metas:       tb.metas,
-		metasOffset: tb.dataSize,
-		blockCache:  cache,
-	}, nil
+	t := &Table{
+		id:         id,
+		fd:         fd,
+		metas:      tb.metas,
+		dataSize:   tb.dataSize,
+		blockCache: blockCache,
+		firstKey:   firstKey,
+		lastKey:    lastKey,
+		maxSeq:     tb.maxSeq,
+		rangeDels:  tb.rangeDels,
+		size:       uint64(keyRangeOffset) + uint64(len(keyRangeData)) + footerSize,
+	}
+	t.filterName, t.filter = decodeFilter(filterData)
+	return t, nil
+}
+
+// bounds returns the smallest and the largest internal key of the table,
+// counting the range tombstones: a tombstone starts at its start key, and
+// ends at the sentinel key of its end, which sorts before every entry of
+// the end key.
+func (tb *TableBulder) bounds() (smallest, largest []byte) {
+	if len(tb.metas) > 0 {
+		smallest, largest = tb.metas[0].FirstKey, tb.lastKey
+	}
+	for _, t := range tb.rangeDels {
+		if start := kv.MakeKey(t.Start, t.Seq, kv.KindRangeDelete); smallest == nil || kv.Compare(start, smallest) < 0 {
+			smallest = start
+		}
+		if end := kv.MakeSentinelKey(t.End); largest == nil || kv.Compare(end, largest) > 0 {
+			largest = end
+		}
+	}
+	return smallest, largest
+}
+
+// buildFilter returns the filter block of the table, or nil if the builder
+// has no filter policy.
+//
+// +----------+------+--------+
+// | name len | name | filter |
+// +----------+------+--------+
+// |    u8    |      |        |
+// +----------+------+--------+
+func (tb *TableBulder) buildFilter() []byte {
+	if tb.filterPolicy == nil {
+		return nil
+	}
+	name := tb.filterPolicy.Name()
+	buf := make([]byte, 0, 1+len(name))
+	buf = append(buf, byte(len(name)))
+	buf = append(buf, name...)
+	return append(buf, tb.filterPolicy.NewFilter(tb.filterKeys)...)
 }
@@ -4,17 +4,26 @@ import (
 	"fmt"
 	"minilsm/block"
 	"minilsm/iterator"
+	"minilsm/kv"
 )
 
+// Iter walks the entries of a table, reading one block at a time. A block
+// that cannot be read ends the iteration with an error.
 type Iter struct {
 	table     *Table
 	blockIter *block.Iter
 	blockIdx  uint32
+	// start and end are the internal keys [start, end) the iterator is
+	// bounded to, where nil leaves that side open. It does not read the
+	// blocks out of the bounds.
+	start []byte
+	end   []byte
+	err   error
 }
 
 // IsValid implements iterator.Iterator.
 func (i *Iter) IsValid() bool {
-	return i.blockIter.IsValid()
+	return i.err == nil && i.blockIter.IsValid()
 }
 
 // Key implements iterator.Iterator.
@@ -22,74 +31,253 @@ func (i *Iter) Key() []byte {
 	return i.blockIter.Key()
 }
 
+// Value implements iterator.Iterator.
+func (i *Iter) Value() []byte {
+	return i.blockIter.Value()
+}
+
 // Next implements iterator.Iterator.
 func (i *Iter) Next() {
+	if !i.IsValid() {
+		return
+	}
 	i.blockIter.Next()
-	if !i.blockIter.IsValid() {
+	if i.blockIter.IsValid() || i.checkBlock() {
+		i.clamp()
+		return
+	}
+	if i.hasNextBlock() {
 		i.blockIdx++
-		if i.blockIdx < i.table.Len() {
-			blk, err := i.table.ReadBlockCached(i.blockIdx)
-			if err != nil {
-				log.Errorf("next: %v", err)
-			}
-			iter, err := block.NewBlockIterAndSeekToFirst(blk)
-			if err != nil {
-				log.Errorf("next: %v", err)
-			}
-			i.blockIter = iter
-		}
+		i.err = i.openBlock((*block.Iter).SeekToFirst)
+		i.clamp()
 	}
 }
 
-// Value implements iterator.Iterator.
-func (i *Iter) Value() []byte {
-	return i.blockIter.Value()
+// Prev implements iterator.Iterator.
+func (i *Iter) Prev() {
+	if !i.IsValid() {
+		return
+	}
+	i.blockIter.Prev()
+	if i.blockIter.IsValid() || i.checkBlock() {
+		i.clamp()
+		return
+	}
+	if i.hasPrevBlock() {
+		i.blockIdx--
+		i.err = i.openBlock((*block.Iter).SeekToLast)
+		i.clamp()
+	}
+}
+
+// Seek implements iterator.Iterator.
+func (i *Iter) Seek(key []byte) {
+	i.err = i.seek(key)
+	i.clamp()
+}
+
+// SeekToFirst implements iterator.Iterator.
+func (i *Iter) SeekToFirst() {
+	i.err = i.seekToFirst()
+	i.clamp()
+}
+
+// SeekToLast implements iterator.Iterator.
+func (i *Iter) SeekToLast() {
+	i.err = i.seekToLast()
+	i.clamp()
+}
+
+// SeekForPrev implements iterator.Iterator.
+func (i *Iter) SeekForPrev(key []byte) {
+	i.err = i.seekForPrev(key)
+	i.clamp()
+}
+
+// Error implements iterator.Iterator.
+func (i *Iter) Error() error {
+	return i.err
+}
+
+// Close implements iterator.Iterator.
+func (i *Iter) Close() error {
+	i.blockIter = nil
+	return nil
 }
 
 var _ iterator.Iterator = (*Iter)(nil)
 
-func NewIterAndSeekToFirst(table *Table) (*Iter, error) {
-	blk, err := table.ReadBlockCached(0)
-	if err != nil {
-		return nil, fmt.Errorf("read block: %w", err)
+func (i *Iter) seek(key []byte) error {
+	i.blockIter = nil
+	if i.table.Len() == 0 {
+		return nil
 	}
-	blkIter, err := block.NewBlockIterAndSeekToFirst(blk)
-	if err != nil {
-		return nil, fmt.Errorf("new block iter and seek to first: %w", err)
+	if i.start != nil && kv.Compare(key, i.start) < 0 {
+		key = i.start
 	}
-	return &Iter{
-		table:     table,
-		blockIter: blkIter,
-		blockIdx:  0,
-	}, nil
+	// the block before the first whose first key is greater than key
+	i.blockIdx = uint32(max(i.table.FindBlockIdx(key), 0))
+	if err := i.openBlock(func(iter *block.Iter) {
+		iter.Seek(key)
+	}); err != nil {
+		return err
+	}
+	if !i.blockIter.IsValid() && i.hasNextBlock() {
+		// key is greater than the last key of the block, so the first key
+		// not less than it starts the next block
+		i.blockIdx++
+		return i.openBlock((*block.Iter).SeekToFirst)
+	}
+	return nil
 }
 
-func NewIterAndSeekToKey(table *Table, key []byte) (*Iter, error) {
-	blkIdx, iter, err := seekToKey(table, key)
-	if err != nil {
-		return nil, fmt.Errorf("new sstable iter and seek to key: %w", err)
+func (i *Iter) seekToFirst() error {
+	if i.start != nil {
+		return i.seek(i.start)
+	}
+	i.blockIter = nil
+	if i.table.Len() == 0 {
+		return nil
 	}
-	return &Iter{
-		table:     table,
-		blockIter: iter,
-		blockIdx:  blkIdx,
-	}, nil
+	i.blockIdx = 0
+	return i.openBlock((*block.Iter).SeekToFirst)
 }
 
-func seekToKey(t *Table, key []byte) (uint32, *block.Iter, error) {
-	blkIdx := t.FindBlockIdx(key)
+func (i *Iter) seekToLast() error {
+	if i.end != nil {
+		// no entry has the key end
+		return i.seekForPrev(i.end)
+	}
+	i.blockIter = nil
+	if i.table.Len() == 0 {
+		return nil
+	}
+	i.blockIdx = i.table.Len() - 1
+	return i.openBlock((*block.Iter).SeekToLast)
+}
+
+func (i *Iter) seekForPrev(key []byte) error {
+	i.blockIter = nil
+	if i.end != nil && kv.Compare(key, i.end) > 0 {
+		key = i.end
+	}
+	blkIdx := i.table.FindBlockIdx(key)
 	if blkIdx < 0 {
-		return 0, nil, fmt.Errorf("seek to key: %w", block.ErrKeyNotFound)
+		// key is less than the first key of the table
+		return nil
 	}
-	blk, err := t.ReadBlockCached(uint32(blkIdx))
+	// the first key of the block is not greater than key, so the block
+	// holds the entry
+	i.blockIdx = uint32(blkIdx)
+	return i.openBlock(func(iter *block.Iter) {
+		iter.SeekForPrev(key)
+	})
+}
+
+// openBlock reads the block at i.blockIdx and positions an iterator over it
+// with seek. On error, the iterator is left invalid.
+func (i *Iter) openBlock(seek func(*block.Iter)) error {
+	i.blockIter = nil
+	blk, err := i.table.ReadBlockCached(i.blockIdx)
 	if err != nil {
-		return 0, nil, fmt.Errorf("seek to key: %w", err)
+		return fmt.Errorf("read block: %w", err)
 	}
+	iter := block.NewBlockIter(blk)
+	seek(iter)
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("block %d: %w", i.blockIdx, err)
+	}
+	i.blockIter = iter
+	return nil
+}
 
-	blkIter, err := block.NewBlockIterAndSeekToKey(blk, key)
-	if err != nil {
-		return 0, nil, fmt.Errorf("seek to key: %w", err)
+// hasNextBlock reports whether there is a block after the current one that
+// may hold keys before end.
+func (i *Iter) hasNextBlock() bool {
+	if i.blockIdx+1 >= i.table.Len() {
+		return false
+	}
+	return i.end == nil || kv.Compare(i.table.metas[i.blockIdx+1].FirstKey, i.end) < 0
+}
+
+// hasPrevBlock reports whether there is a block before the current one that
+// may hold keys not less than start.
+func (i *Iter) hasPrevBlock() bool {
+	if i.blockIdx == 0 {
+		return false
+	}
+	// the keys of the previous block are less than the first of this one
+	return i.start == nil || kv.Compare(i.table.metas[i.blockIdx].FirstKey, i.start) > 0
+}
+
+// clamp invalidates the iterator once it leaves [start, end).
+func (i *Iter) clamp() {
+	if !i.IsValid() {
+		return
+	}
+	key := i.blockIter.Key()
+	if i.end != nil && kv.Compare(key, i.end) >= 0 || i.start != nil && kv.Compare(key, i.start) < 0 {
+		i.blockIter = nil
+	}
+}
+
+// checkBlock records the error of the block iterator, if any, and reports
+// whether there was one.
+func (i *Iter) checkBlock() bool {
+	if err := i.blockIter.Error(); err != nil {
+		i.err = fmt.Errorf("block %d: %w", i.blockIdx, err)
+		return true
 	}
+	return false
+}
+
+// NewRangeIter returns an iterator over the entries of the user keys in r,
+// positioned at the first of them.
+func NewRangeIter(table *Table, r kv.Range) (*Iter, error) {
+	iter := &Iter{table: table, start: r.Start(), end: r.End()}
+	if err := iter.seekToFirst(); err != nil {
+		return nil, fmt.Errorf("new sstable range iter: %w", err)
+	}
+	iter.clamp()
+	return iter, nil
+}
+
+func NewIterAndSeekToFirst(table *Table) (*Iter, error) {
+	iter := &Iter{table: table}
+	if err := iter.seekToFirst(); err != nil {
+		return nil, fmt.Errorf("new sstable iter and seek to first: %w", err)
+	}
+	return iter, nil
+}
+
+func NewIterAndSeekToLast(table *Table) (*Iter, error) {
+	iter := &Iter{table: table}
+	if err := iter.seekToLast(); err != nil {
+		return nil, fmt.Errorf("new sstable iter and seek to last: %w", err)
+	}
+	return iter, nil
+}
+
+// NewIterAndSeekForPrev positions the iterator at the last entry not
+// greater than the internal key key.
+func NewIterAndSeekForPrev(table *Table, key []byte) (*Iter, error) {
+	iter := &Iter{table: table}
+	if err := iter.seekForPrev(key); err != nil {
+		return nil, fmt.Errorf("new sstable iter and seek for prev: %w", err)
+	}
+	return iter, nil
+}
 
-	return uint32(blkIdx), blkIter, nil
+// NewIterAndSeekToKey positions the iterator at the first entry not less
+// than the internal key key. It returns block.ErrKeyNotFound if there is
+// none.
+func NewIterAndSeekToKey(table *Table, key []byte) (*Iter, error) {
+	iter := &Iter{table: table}
+	if err := iter.seek(key); err != nil {
+		return nil, fmt.Errorf("new sstable iter and seek to key: %w", err)
+	}
+	if !iter.IsValid() {
+		return nil, fmt.Errorf("new sstable iter and seek to key: %w", block.ErrKeyNotFound)
+	}
+	return iter, nil
 }
@@ -2,11 +2,20 @@ package sstable
 
 import (
 	"bytes"
+	"compress/flate"
+	"errors"
 	"fmt"
+	"math/rand"
 	"minilsm/block"
+	"minilsm/cache"
+	"minilsm/compress"
+	"minilsm/filter"
+	"minilsm/kv"
+	"minilsm/rangedel"
 	"minilsm/util"
+	"os"
 	"slices"
-	"sync"
+
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,7 +23,7 @@ import (
 
 func TestTableBuilder_Add(t *testing.T) {
 	tests := []struct {
-		giveBlockSize uint16
+		giveBlockSize uint32
 		wantErr       error
 	}{
 		{
@@ -22,21 +31,41 @@ func TestTableBuilder_Add(t *testing.T) {
 			wantErr:       nil,
 		},
 		{
-			giveBlockSize: 16,
+			giveBlockSize: 28,
 			wantErr:       nil,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("blockSize: %d", tt.giveBlockSize), func(t *testing.T) {
 			tb := NewTableBuilder(tt.giveBlockSize)
-			err := tb.Add([]byte("key1"), []byte("value1"))
+			err := tb.Add(kv.MakeKey([]byte("key1"), 2, kv.KindPut), []byte("value1"))
 			assert.Equal(t, tt.wantErr, err)
-			err = tb.Add([]byte("key1"), []byte("value1"))
+			err = tb.Add(kv.MakeKey([]byte("key1"), 1, kv.KindPut), []byte("value1"))
 			assert.Equal(t, tt.wantErr, err)
 		})
 	}
 }
 
+func TestTableBuilder_LargeEntry(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 1<<17)
+	tb := NewTableBuilder(1024)
+	assert.NoError(t, tb.Add(kv.MakeKey([]byte("key0"), 1, kv.KindPut), []byte("value0")))
+	assert.NoError(t, tb.Add(kv.MakeKey([]byte("key1"), 1, kv.KindPut), value))
+	assert.NoError(t, tb.Add(kv.MakeKey([]byte("key2"), 1, kv.KindPut), []byte("value2")))
+	sst, err := tb.Build(1, NewBlockCache(cache.New(1<<20)), t.TempDir()+"/test.sst")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	assert.Equal(t, uint32(3), sst.Len())
+
+	iter, err := NewIterAndSeekToKey(sst, kv.MakeSeekKey([]byte("key1"), kv.MaxSeq))
+	assert.NoError(t, err)
+	assert.Equal(t, value, iter.Value())
+	iter.Next()
+	assert.Equal(t, []byte("value2"), iter.Value())
+}
+
 func TestSSTable_Build(t *testing.T) {
 	tb := NewTableBuilder(1024)
 	tests := []struct {
@@ -45,12 +74,12 @@ func TestSSTable_Build(t *testing.T) {
 		want    error
 	}{
 		{
-			giveKey: []byte("key0"),
+			giveKey: kv.MakeKey([]byte("key0"), 1, kv.KindPut),
 			giveVal: []byte("value0"),
 			want:    nil,
 		},
 		{
-			giveKey: []byte("key1"),
+			giveKey: kv.MakeKey([]byte("key1"), 2, kv.KindPut),
 			giveVal: []byte("value1"),
 			want:    nil,
 		},
@@ -66,7 +95,7 @@ func TestSSTable_Build(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		t.Run("Add: "+string(tt.giveKey)+":"+string(tt.giveVal), func(t *testing.T) {
+		t.Run("Add: "+string(tt.giveVal), func(t *testing.T) {
 			err := tb.Add(tt.giveKey, tt.giveVal)
 			if err == nil {
 				assert.Equal(t, tt.want, nil)
@@ -83,34 +112,87 @@ func TestSSTable_Build(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+// generatePairs returns n pairs whose keys are internal keys.
+func generatePairs(n int) []struct {
+	K []byte
+	V []byte
+} {
+	pairs := util.GeneratePairs(n)
+	for i := range pairs {
+		pairs[i].K = kv.MakeKey(pairs[i].K, uint64(i+1), kv.KindPut)
+	}
+	return pairs
+}
+
 func generateSSTble(t *testing.T, pairs []struct {
 	K []byte
 	V []byte
-}, blockSize uint16, path string) *Table {
+}, blockSize uint32, path string) *Table {
 	tb := NewTableBuilder(blockSize)
 	for _, pair := range pairs {
 		assert.NoError(t, tb.Add(pair.K, pair.V))
 	}
-	sst, err := tb.Build(1, &sync.Map{}, path)
+	sst, err := tb.Build(1, NewBlockCache(cache.New(1<<20)), path)
 	assert.NoError(t, err)
 	return sst
 }
 
 func TestSSTable_Decode(t *testing.T) {
-	pairs := util.GeneratePairs(1000)
+	pairs := generatePairs(1000)
 	tempDir := t.TempDir()
 	sst := generateSSTble(t, pairs, 1024, tempDir+"/test.sst")
 	t.Cleanup(func() {
 		sst.Close()
 	})
 
-	nsst, err := openTableFromFile(1, &sync.Map{}, sst.fd)
+	nsst, err := openTableFromFile(1, NewBlockCache(cache.New(1<<20)), sst.fd)
 	assert.NoError(t, err)
 	assert.Equal(t, sst.metas, nsst.metas)
 }
 
+func TestSSTable_Filter(t *testing.T) {
+	pairs := generatePairs(1000)
+	policy := filter.NewBloomPolicy(10)
+	tb := NewTableBuilder(1024, WithFilterPolicy(policy))
+	for _, pair := range pairs {
+		assert.NoError(t, tb.Add(pair.K, pair.V))
+	}
+	path := t.TempDir() + "/test.sst"
+	sst, err := tb.Build(1, NewBlockCache(cache.New(1<<20)), path)
+	assert.NoError(t, err)
+	sst.Close()
+
+	sst, err = OpenTable(1, NewBlockCache(cache.New(1<<20)), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	for i := range pairs {
+		assert.True(t, sst.MayContain(policy, util.KeyOf(i)))
+	}
+	falsePositives := 0
+	for i := 1000; i < 2000; i++ {
+		if sst.MayContain(policy, util.KeyOf(i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 50)
+	assert.True(t, sst.MayContain(nil, util.KeyOf(1000)))
+
+	// the filter block does not get in the way of reading the data
+	iter, err := NewIterAndSeekToFirst(sst)
+	assert.NoError(t, err)
+	for _, pair := range pairs {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pair.K, iter.Key())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Equal(t, pairs[len(pairs)-1].K, sst.LastKey())
+}
+
 func TestSSTable_SeekToFirst(t *testing.T) {
-	pairs := util.GeneratePairs(1000)
+	pairs := generatePairs(1000)
 	tempDir := t.TempDir()
 	sst := generateSSTble(t, pairs, 1024, tempDir+"/test.sst")
 	t.Cleanup(func() {
@@ -128,13 +210,85 @@ func TestSSTable_SeekToFirst(t *testing.T) {
 	assert.False(t, iter.IsValid())
 }
 
+func TestSSTable_SeekToLast(t *testing.T) {
+	pairs := generatePairs(1000)
+	sst := generateSSTble(t, pairs, 1024, t.TempDir()+"/test.sst")
+	t.Cleanup(func() {
+		sst.Close()
+	})
+
+	iter, err := NewIterAndSeekToLast(sst)
+	assert.NoError(t, err)
+	for i := 999; i >= 0; i-- {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].K, iter.Key())
+		assert.Equal(t, pairs[i].V, iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+
+	for i := 0; i < 1000; i += 7 {
+		userKey := kv.UserKey(pairs[i].K)
+		iter.SeekForPrev(kv.MakeKey(userKey, 0, kv.KindDelete))
+		assert.Equal(t, pairs[i].K, iter.Key())
+		iter.SeekForPrev(kv.MakeSeekKey(userKey, kv.MaxSeq))
+		if i == 0 {
+			assert.False(t, iter.IsValid())
+		} else {
+			assert.Equal(t, pairs[i-1].K, iter.Key())
+		}
+	}
+}
+
+func TestSSTable_RangeIter(t *testing.T) {
+	pairs := generatePairs(1000)
+	sst := generateSSTble(t, pairs, 256, t.TempDir()+"/test.sst")
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	assert.Greater(t, sst.Len(), uint32(50))
+
+	r := kv.Range{Lower: util.KeyOf(100), LowerExclusive: true, Upper: util.KeyOf(200)}
+	before := sst.blockCache.Stats().Misses
+	iter, err := NewRangeIter(sst, r)
+	assert.NoError(t, err)
+	for i := 101; i <= 200; i++ {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].K, iter.Key())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	assert.NoError(t, iter.Error())
+	// only the blocks holding the range are read
+	read := sst.blockCache.Stats().Misses - before
+	assert.Less(t, int(read), int(sst.Len())/4)
+
+	iter.SeekToLast()
+	for i := 200; i > 100; i-- {
+		assert.Equal(t, pairs[i].K, iter.Key())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+
+	iter.Seek(pairs[0].K)
+	assert.Equal(t, pairs[101].K, iter.Key())
+	iter.SeekForPrev(pairs[999].K)
+	assert.Equal(t, pairs[200].K, iter.Key())
+	assert.Equal(t, sst.blockCache.Stats().Misses-before, read)
+
+	// an empty range
+	iter, err = NewRangeIter(sst, kv.Range{Lower: util.KeyOf(300), Upper: util.KeyOf(300), UpperExclusive: true})
+	assert.NoError(t, err)
+	assert.False(t, iter.IsValid())
+}
+
 func TestSSTable_SeekToKet(t *testing.T) {
-	pairs := util.GeneratePairs(1000)
+	pairs := generatePairs(1000)
 	slices.SortFunc(pairs, func(a, b struct {
 		K []byte
 		V []byte
 	}) int {
-		return bytes.Compare(a.K, b.K)
+		return kv.Compare(a.K, b.K)
 	})
 	tempDir := t.TempDir()
 	sst := generateSSTble(t, pairs, 1024, tempDir+"/test.sst")
@@ -150,3 +304,338 @@ func TestSSTable_SeekToKet(t *testing.T) {
 		assert.Equal(t, pairs[i].V, iter.Value())
 	}
 }
+
+func TestConcatIter(t *testing.T) {
+	pairs := generatePairs(3000)
+	tempDir := t.TempDir()
+	tables := make([]*Table, 0, 3)
+	for i := 0; i < 3; i++ {
+		sst := generateSSTble(t, pairs[i*1000:(i+1)*1000], 1024, fmt.Sprintf("%s/%d.sst", tempDir, i))
+		tables = append(tables, sst)
+	}
+	t.Cleanup(func() {
+		for _, sst := range tables {
+			sst.Close()
+		}
+	})
+
+	assert.Equal(t, pairs[999].K, tables[0].LastKey())
+	assert.Equal(t, 1, FindTable(tables, kv.UserKey(pairs[1000].K)))
+	assert.Equal(t, 3, FindTable(tables, []byte("z")))
+
+	iter, err := NewConcatIterAndSeekToKey(tables, pairs[500].K)
+	assert.NoError(t, err)
+	for i := 500; i < 3000; i++ {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].K, iter.Key())
+		assert.Equal(t, pairs[i].V, iter.Value())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+
+	iter, err = NewConcatIterAndSeekForPrev(tables, pairs[2500].K)
+	assert.NoError(t, err)
+	for i := 2500; i >= 0; i-- {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].K, iter.Key())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+
+	iter.SeekToLast()
+	assert.Equal(t, pairs[2999].K, iter.Key())
+
+	iter.SeekForPrev(kv.MakeSeekKey(kv.UserKey(pairs[1000].K), kv.MaxSeq))
+	assert.Equal(t, pairs[999].K, iter.Key())
+	iter.Next()
+	assert.Equal(t, pairs[1000].K, iter.Key())
+
+	// a range in the middle table reads no block of the others, each of
+	// which has a cache of its own
+	misses := func() []uint64 {
+		return []uint64{tables[0].blockCache.Stats().Misses, tables[2].blockCache.Stats().Misses}
+	}
+	before := misses()
+	iter, err = NewConcatRangeIter(tables, kv.Range{Lower: util.KeyOf(1500), Upper: util.KeyOf(2000), UpperExclusive: true})
+	assert.NoError(t, err)
+	for i := 1500; i < 2000; i++ {
+		assert.Equal(t, pairs[i].K, iter.Key())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	iter.SeekToLast()
+	for i := 1999; i >= 1500; i-- {
+		assert.Equal(t, pairs[i].K, iter.Key())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Equal(t, before, misses())
+}
+
+func TestSSTable_KeyRange(t *testing.T) {
+	pairs := generatePairs(1000)
+	path := t.TempDir() + "/test.sst"
+	sst := generateSSTble(t, pairs, 128, path)
+	sst.Close()
+
+	sst, err := OpenTable(1, NewBlockCache(cache.New(1<<20)), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	assert.Equal(t, pairs[0].K, sst.FirstKey())
+	assert.Equal(t, pairs[len(pairs)-1].K, sst.LastKey())
+
+	assert.True(t, sst.Overlaps(util.KeyOf(10), util.KeyOf(20)))
+	assert.True(t, sst.Overlaps([]byte("a"), util.KeyOf(0)))
+	assert.True(t, sst.Overlaps(util.KeyOf(999), []byte("z")))
+	assert.False(t, sst.Overlaps([]byte("a"), []byte("b")))
+	assert.False(t, sst.Overlaps(util.KeyOf(1000), []byte("z")))
+}
+
+func TestSSTable_FindBlockIdx(t *testing.T) {
+	pairs := generatePairs(1000)
+	sst := generateSSTble(t, pairs, 128, t.TempDir()+"/test.sst")
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	assert.Greater(t, sst.Len(), uint32(100))
+
+	assert.Equal(t, -1, sst.FindBlockIdx(kv.MakeSeekKey([]byte("a"), kv.MaxSeq)))
+	assert.Equal(t, int(sst.Len())-1, sst.FindBlockIdx(kv.MakeSeekKey([]byte("z"), kv.MaxSeq)))
+	for i, meta := range sst.metas {
+		assert.Equal(t, i, sst.FindBlockIdx(meta.FirstKey))
+		if i > 0 {
+			// a key just before the first key of a block is in the block before
+			before := kv.MakeKey(kv.UserKey(meta.FirstKey), kv.Seq(meta.FirstKey)+1, kv.KindPut)
+			assert.Equal(t, i-1, sst.FindBlockIdx(before))
+		}
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer fd.Close()
+	var b [1]byte
+	_, err = fd.ReadAt(b[:], offset)
+	assert.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b[:], offset)
+	assert.NoError(t, err)
+}
+
+func TestSSTable_CorruptBlock(t *testing.T) {
+	pairs := generatePairs(100)
+	path := t.TempDir() + "/test.sst"
+	sst := generateSSTble(t, pairs, 128, path)
+	blockOffset := int64(sst.metas[3].Offset)
+	sst.Close()
+	flipByte(t, path, blockOffset+5)
+
+	sst, err := OpenTable(7, NewBlockCache(cache.New(1<<20)), path)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	_, err = sst.ReadBlock(2)
+	assert.NoError(t, err)
+	_, err = sst.ReadBlock(3)
+	assert.ErrorIs(t, err, ErrCorruption)
+	var corruption *CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, uint32(7), corruption.ID)
+	assert.Equal(t, blockOffset, corruption.Offset)
+
+	_, err = NewIterAndSeekToKey(sst, sst.metas[3].FirstKey)
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	// a scan stops at the corrupt block with an error
+	iter, err := NewIterAndSeekToFirst(sst)
+	assert.NoError(t, err)
+	n := 0
+	for ; iter.IsValid(); iter.Next() {
+		assert.Equal(t, pairs[n].K, iter.Key())
+		n++
+	}
+	assert.ErrorIs(t, iter.Error(), ErrCorruption)
+	assert.Equal(t, pairs[n].K, sst.metas[3].FirstKey)
+
+	concat, err := NewConcatIterAndSeekToKey([]*Table{sst}, pairs[0].K)
+	assert.NoError(t, err)
+	for ; concat.IsValid(); concat.Next() {
+	}
+	assert.ErrorIs(t, concat.Error(), ErrCorruption)
+
+	// seeking past it recovers
+	iter.Seek(sst.metas[4].FirstKey)
+	assert.NoError(t, iter.Error())
+	assert.True(t, iter.IsValid())
+	iter.Prev()
+	assert.ErrorIs(t, iter.Error(), ErrCorruption)
+	assert.NoError(t, iter.Close())
+}
+
+func TestSSTable_CorruptMeta(t *testing.T) {
+	pairs := generatePairs(100)
+	path := t.TempDir() + "/test.sst"
+	sst := generateSSTble(t, pairs, 128, path)
+	size := int64(sst.Size())
+	sst.Close()
+
+	// the last byte of the key range, right before the footer
+	flipByte(t, path, size-footerSize-1)
+	_, err := OpenTable(1, NewBlockCache(cache.New(1<<20)), path)
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	flipByte(t, path, size-footerSize-1)
+	sst, err = OpenTable(1, NewBlockCache(cache.New(1<<20)), path)
+	assert.NoError(t, err)
+	sst.Close()
+}
+
+func TestSSTable_Compression(t *testing.T) {
+	build := func(pairs []struct {
+		K []byte
+		V []byte
+	}, opts ...BuilderOption) *Table {
+		tb := NewTableBuilder(1024, opts...)
+		for _, pair := range pairs {
+			assert.NoError(t, tb.Add(pair.K, pair.V))
+		}
+		path := fmt.Sprintf("%s/%d.sst", t.TempDir(), len(opts))
+		sst, err := tb.Build(1, NewBlockCache(cache.New(1<<20)), path)
+		assert.NoError(t, err)
+		sst.Close()
+		sst, err = OpenTable(1, NewBlockCache(cache.New(1<<20)), path)
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			sst.Close()
+		})
+		return sst
+	}
+	checkPairs := func(sst *Table, pairs []struct {
+		K []byte
+		V []byte
+	}) {
+		iter, err := NewIterAndSeekToFirst(sst)
+		assert.NoError(t, err)
+		for _, pair := range pairs {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, pair.K, iter.Key())
+			assert.Equal(t, pair.V, iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+	}
+
+	pairs := generatePairs(1000)
+	for _, c := range []compress.Compressor{compress.NewFlate(flate.BestSpeed), compress.NewZlib(flate.DefaultCompression)} {
+		plain := build(pairs)
+		compressed := build(pairs, WithCompressor(c))
+		assert.Less(t, compressed.Size(), plain.Size()/2)
+		checkPairs(compressed, pairs)
+	}
+
+	// blocks that do not shrink are stored as they are
+	rng := rand.New(rand.NewSource(1))
+	for i := range pairs {
+		pairs[i].V = make([]byte, 200)
+		rng.Read(pairs[i].V)
+	}
+	pairs = pairs[:20]
+	plain := build(pairs)
+	compressed := build(pairs, WithCompressor(compress.NewFlate(flate.BestCompression)))
+	assert.Equal(t, plain.Size(), compressed.Size())
+	checkPairs(compressed, pairs)
+}
+
+type failingCompressor struct {
+	compress.Compressor
+}
+
+var errCompress = errors.New("compress failed")
+
+func (failingCompressor) Compress([]byte) ([]byte, error) {
+	return nil, errCompress
+}
+
+func TestSSTable_CompressionError(t *testing.T) {
+	// a block that cannot be compressed fails the table
+	tb := NewTableBuilder(1024, WithCompressor(failingCompressor{compress.NewFlate(flate.BestSpeed)}))
+	var err error
+	for _, pair := range generatePairs(1000) {
+		if err = tb.Add(pair.K, pair.V); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, errCompress)
+
+	tb = NewTableBuilder(1024, WithCompressor(failingCompressor{compress.NewFlate(flate.BestSpeed)}))
+	assert.NoError(t, tb.Add(kv.MakeKey([]byte("a"), 1, kv.KindPut), []byte("1")))
+	path := t.TempDir() + "/1.sst"
+	_, err = tb.Build(1, NewBlockCache(cache.New(1<<20)), path)
+	assert.ErrorIs(t, err, errCompress)
+	assert.NoFileExists(t, path)
+}
+
+func TestSSTable_CloseEvictsBlocks(t *testing.T) {
+	c := cache.New(1 << 20)
+	path := t.TempDir() + "/test.sst"
+	tb := NewTableBuilder(1024)
+	for _, pair := range generatePairs(1000) {
+		assert.NoError(t, tb.Add(pair.K, pair.V))
+	}
+	sst, err := tb.Build(1, NewBlockCache(c), path)
+	assert.NoError(t, err)
+
+	iter, err := NewIterAndSeekToFirst(sst)
+	assert.NoError(t, err)
+	for ; iter.IsValid(); iter.Next() {
+	}
+	assert.Equal(t, int(sst.Len()), c.Stats().Count)
+	assert.Equal(t, uint64(sst.Len()), c.Stats().Misses)
+
+	assert.NoError(t, sst.Close())
+	assert.Zero(t, c.Stats().Count)
+	assert.Zero(t, c.Stats().Size)
+}
+
+func TestSSTable_RangeDels(t *testing.T) {
+	path := t.TempDir() + "/test.sst"
+	tb := NewTableBuilder(1024)
+	assert.NoError(t, tb.Add(kv.MakeKey([]byte("b"), 3, kv.KindPut), []byte("b")))
+	tb.AddRangeDel(rangedel.Tombstone{Start: []byte("c"), End: []byte("e"), Seq: 7})
+	sst, err := tb.Build(1, nil, path)
+	assert.NoError(t, err)
+	assert.NoError(t, sst.Close())
+
+	sst, err = OpenTable(1, nil, path)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		sst.Close()
+	})
+	assert.Equal(t, []rangedel.Tombstone{{Start: []byte("c"), End: []byte("e"), Seq: 7}}, sst.RangeDels())
+	assert.Equal(t, uint64(7), sst.MaxSeq())
+	assert.Equal(t, kv.MakeKey([]byte("b"), 3, kv.KindPut), sst.FirstKey())
+	assert.Equal(t, kv.MakeSentinelKey([]byte("e")), sst.LastKey())
+	// the end of a tombstone is exclusive
+	assert.True(t, sst.Overlaps([]byte("d"), []byte("d")))
+	assert.False(t, sst.Overlaps([]byte("e"), []byte("f")))
+	assert.Equal(t, 1, FindTable([]*Table{sst}, []byte("e")))
+
+	// a table of tombstones only has no entries
+	tb = NewTableBuilder(1024)
+	tb.AddRangeDel(rangedel.Tombstone{Start: []byte("a"), End: []byte("z"), Seq: 1})
+	assert.False(t, tb.IsEmpty())
+	empty, err := tb.Build(2, nil, t.TempDir()+"/empty.sst")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		empty.Close()
+	})
+	iter, err := NewIterAndSeekToFirst(empty)
+	assert.NoError(t, err)
+	assert.False(t, iter.IsValid())
+	_, err = NewIterAndSeekToKey(empty, kv.MakeSeekKey([]byte("b"), kv.MaxSeq))
+	assert.ErrorIs(t, err, block.ErrKeyNotFound)
+}
@@ -0,0 +1,124 @@
+package minilsm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var ErrClosed = errors.New("storage closed")
+
+// WriteStall is how much writes are throttled, so flushes and compactions
+// can catch up with them.
+type WriteStall int
+
+const (
+	WriteStallNone WriteStall = iota
+	// WriteStallSlowdown delays every write by Options.WriteSlowdownDelay.
+	WriteStallSlowdown
+	// WriteStallStop blocks writes until flushes or compactions have made
+	// progress.
+	WriteStallStop
+)
+
+func (s WriteStall) String() string {
+	switch s {
+	case WriteStallNone:
+		return "none"
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStop:
+		return "stop"
+	}
+	return "unknown"
+}
+
+// WriteStallStats describes the throttling of writes.
+type WriteStallStats struct {
+	// State is the throttling that writes meet now.
+	State WriteStall
+	// Slowdowns and Stops count the writes that were delayed and that were
+	// blocked so far, and StallTime is the time they spent waiting.
+	Slowdowns uint64
+	Stops     uint64
+	StallTime time.Duration
+}
+
+// WriteStallStats returns the throttling of writes now and so far.
+func (si *StorageInner) WriteStallStats() WriteStallStats {
+	return WriteStallStats{
+		State:     si.writeStall(),
+		Slowdowns: atomic.LoadUint64(&si.stallSlowdowns),
+		Stops:     atomic.LoadUint64(&si.stallStops),
+		StallTime: time.Duration(atomic.LoadInt64(&si.stallNanos)),
+	}
+}
+
+// writeStall returns the throttling that the immutable memtables and the L0
+// tables waiting for flushing and compaction call for.
+func (si *StorageInner) writeStall() WriteStall {
+	si.mu.RLock()
+	imm, l0 := len(si.immMemTables), len(si.l0SSTables)
+	si.mu.RUnlock()
+	switch {
+	case imm >= si.opts.ImmMemTableStop || l0 >= si.opts.L0StopTrigger:
+		return WriteStallStop
+	case imm >= si.opts.ImmMemTableSlowdown || l0 >= si.opts.L0SlowdownTrigger:
+		return WriteStallSlowdown
+	}
+	return WriteStallNone
+}
+
+// throttleWrite delays or blocks a write as writeStall calls for. The
+// caller must hold si.writeMu, so the writes behind it wait as well, and
+// not si.mu. It returns ErrClosed if the storage is closed while it waits,
+// and the error of the last background flush or compaction if that failed,
+// as the stall may never end then.
+func (si *StorageInner) throttleWrite() error {
+	stall := si.writeStall()
+	if stall == WriteStallNone {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&si.stallNanos, int64(time.Since(start)))
+	}()
+	if stall == WriteStallSlowdown {
+		atomic.AddUint64(&si.stallSlowdowns, 1)
+		time.Sleep(si.opts.WriteSlowdownDelay)
+		return nil
+	}
+
+	atomic.AddUint64(&si.stallStops, 1)
+	si.log.Infof("write stall: waiting for flushes and compactions")
+	si.stallMu.Lock()
+	defer si.stallMu.Unlock()
+	for si.writeStall() == WriteStallStop {
+		if si.closing {
+			return ErrClosed
+		}
+		if si.bgErr != nil {
+			return fmt.Errorf("write stall: %w", si.bgErr)
+		}
+		si.stallCond.Wait()
+	}
+	return nil
+}
+
+// wakeStalledWrites lets the blocked writes check again whether they may go
+// on. The caller must not hold si.mu.
+func (si *StorageInner) wakeStalledWrites() {
+	si.stallMu.Lock()
+	si.stallCond.Broadcast()
+	si.stallMu.Unlock()
+}
+
+// setBackgroundError records the result of a background flush or
+// compaction and lets the blocked writes see it.
+func (si *StorageInner) setBackgroundError(err error) {
+	si.stallMu.Lock()
+	si.bgErr = err
+	si.stallCond.Broadcast()
+	si.stallMu.Unlock()
+}
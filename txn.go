@@ -0,0 +1,161 @@
+package minilsm
+
+import (
+	"errors"
+	"fmt"
+	"minilsm/kv"
+	"minilsm/util"
+	"slices"
+)
+
+var (
+	ErrTxnConflict = errors.New("transaction conflict")
+	ErrTxnDone     = errors.New("transaction already committed or rolled back")
+)
+
+// Txn is an optimistic transaction. It reads from the snapshot taken by
+// Begin and buffers its writes until Commit, which fails with
+// ErrTxnConflict if a key the transaction read was written by someone else
+// in the meantime. A Txn is not safe for concurrent use.
+type Txn struct {
+	si     *StorageInner
+	snap   *Snapshot
+	writes map[string]txnWrite
+	reads  map[string]struct{}
+	done   bool
+}
+
+type txnWrite struct {
+	value []byte
+	kind  kv.Kind
+}
+
+// Begin starts a transaction reading from the latest data.
+func (si *StorageInner) Begin() *Txn {
+	return &Txn{
+		si:     si,
+		snap:   si.NewSnapshot(),
+		writes: make(map[string]txnWrite),
+		reads:  make(map[string]struct{}),
+	}
+}
+
+// Get returns the value of key as of the start of the transaction, or the
+// value the transaction wrote to it.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, fmt.Errorf("txn get: %w", ErrTxnDone)
+	}
+	if w, ok := txn.writes[string(key)]; ok {
+		if w.kind == kv.KindDelete {
+			return nil, fmt.Errorf("txn get: %w", ErrKeyNotFound)
+		}
+		return util.DeepCopySlice(w.value), nil
+	}
+	txn.reads[string(key)] = struct{}{}
+	return txn.snap.Get(key)
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+	return txn.write(key, value, kv.KindPut)
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	return txn.write(key, nil, kv.KindDelete)
+}
+
+func (txn *Txn) write(key, value []byte, kind kv.Kind) error {
+	if txn.done {
+		return fmt.Errorf("txn write: %w", ErrTxnDone)
+	}
+	if err := validateKey(key); err != nil {
+		return fmt.Errorf("txn write: %w", err)
+	}
+	txn.writes[string(key)] = txnWrite{value: util.DeepCopySlice(value), kind: kind}
+	return nil
+}
+
+// Commit applies the writes of the transaction, all of them becoming
+// visible to readers at once. It returns ErrTxnConflict, and applies
+// nothing, if any key the transaction read has changed since it began.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return fmt.Errorf("txn commit: %w", ErrTxnDone)
+	}
+	txn.done = true
+	defer txn.snap.Release()
+	if len(txn.writes) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(txn.writes))
+	for key := range txn.writes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	batch := NewWriteBatch()
+	for _, key := range keys {
+		if w := txn.writes[key]; w.kind == kv.KindDelete {
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), w.value)
+		}
+	}
+
+	si := txn.si
+	w, err := txn.logBatch(batch)
+	if err != nil {
+		return fmt.Errorf("txn commit: %w", err)
+	}
+	if err := si.applyWrite(w); err != nil {
+		return fmt.Errorf("txn commit: %w", err)
+	}
+	return nil
+}
+
+// logBatch logs batch if none of the keys the transaction read was written
+// since its snapshot. The writes logged before are applied first, so the
+// check sees them.
+func (txn *Txn) logBatch(batch *WriteBatch) (*pendingWrite, error) {
+	si := txn.si
+	si.writeMu.Lock()
+	defer si.writeMu.Unlock()
+	if err := si.makeRoomForWrite(batch); err != nil {
+		return nil, err
+	}
+	si.waitForWrites()
+
+	if err := txn.checkConflicts(); err != nil {
+		return nil, err
+	}
+	return si.logBatch(batch)
+}
+
+// checkConflicts fails with ErrTxnConflict if a key the transaction read
+// was written since its snapshot.
+func (txn *Txn) checkConflicts() error {
+	si := txn.si
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	v := si.currentView()
+	for key := range txn.reads {
+		internalKey, _, err := v.lookup([]byte(key), kv.MaxSeq)
+		if err != nil {
+			return err
+		}
+		if internalKey != nil && kv.Seq(internalKey) > txn.snap.Seq() {
+			return fmt.Errorf("key %q: %w", key, ErrTxnConflict)
+		}
+	}
+	return nil
+}
+
+// Rollback discards the transaction.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snap.Release()
+}
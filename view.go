@@ -0,0 +1,221 @@
+package minilsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"minilsm/block"
+	"minilsm/filter"
+	"minilsm/iterator"
+	"minilsm/kv"
+	"minilsm/memtable"
+	"minilsm/rangedel"
+	"minilsm/sstable"
+	"slices"
+)
+
+// view is the set of memtables and sstables the storage reads from at some
+// point in time. Flushes and compactions replace the slices of StorageInner
+// rather than modifying them, so a view stays valid after it is taken.
+type view struct {
+	memTable     *memtable.Table
+	immMemTables []*memtable.Table
+	l0SSTables   []*sstable.Table
+	levels       [][]*sstable.Table
+	filterPolicy filter.Policy
+}
+
+// currentView returns the view of si. The caller must hold si.mu.
+func (si *StorageInner) currentView() *view {
+	return &view{
+		memTable:     si.memTable,
+		immMemTables: si.immMemTables,
+		l0SSTables:   si.l0SSTables,
+		levels:       slices.Clone(si.levels),
+		filterPolicy: si.opts.FilterPolicy,
+	}
+}
+
+func (v *view) sstables() []*sstable.Table {
+	tables := slices.Clone(v.l0SSTables)
+	for _, level := range v.levels {
+		tables = append(tables, level...)
+	}
+	return tables
+}
+
+func (v *view) get(key []byte, seq uint64) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	internalKey, val, err := v.lookup(key, seq)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	if internalKey == nil || kv.KindOf(internalKey) == kv.KindDelete {
+		return nil, fmt.Errorf("get: %w", ErrKeyNotFound)
+	}
+	return val, nil
+}
+
+// lookup returns the newest entry of key whose sequence number is not
+// greater than seq, as its internal key and value. internalKey is nil if
+// there is no such entry. A range tombstone newer than the entry found is
+// returned as a tombstone of key with the sequence number of the range
+// tombstone.
+func (v *view) lookup(key []byte, seq uint64) (internalKey, val []byte, err error) {
+	internalKey, val, err = v.lookupPoint(key, seq)
+	if err != nil {
+		return nil, nil, err
+	}
+	if delSeq := v.rangeDelSeq(key, seq); delSeq > 0 && (internalKey == nil || kv.Seq(internalKey) < delSeq) {
+		return kv.MakeKey(key, delSeq, kv.KindDelete), nil, nil
+	}
+	return internalKey, val, nil
+}
+
+// rangeDelSeq returns the largest sequence number, not greater than seq, of
+// the range tombstones that contain key, or 0 if there is none.
+func (v *view) rangeDelSeq(key []byte, seq uint64) uint64 {
+	res := v.memTable.RangeDelSeq(key, seq)
+	for _, imt := range v.immMemTables {
+		res = max(res, imt.RangeDelSeq(key, seq))
+	}
+	for _, t := range v.l0SSTables {
+		if len(t.RangeDels()) > 0 && t.Overlaps(key, key) {
+			res = max(res, rangedel.MaxSeq(t.RangeDels(), key, seq))
+		}
+	}
+	for _, level := range v.levels {
+		idx := sstable.FindTable(level, key)
+		if idx < len(level) && len(level[idx].RangeDels()) > 0 && level[idx].Overlaps(key, key) {
+			res = max(res, rangedel.MaxSeq(level[idx].RangeDels(), key, seq))
+		}
+	}
+	return res
+}
+
+// rangeDels returns the range tombstones of the memtables and of the
+// sstables that overlap r.
+func (v *view) rangeDels(r kv.Range) []rangedel.Tombstone {
+	res := v.memTable.RangeDels()
+	for _, imt := range v.immMemTables {
+		res = append(res, imt.RangeDels()...)
+	}
+	for _, t := range v.sstables() {
+		if len(t.RangeDels()) > 0 && t.OverlapsRange(r) {
+			res = append(res, t.RangeDels()...)
+		}
+	}
+	return res
+}
+
+// lookupPoint is lookup leaving range tombstones out.
+func (v *view) lookupPoint(key []byte, seq uint64) (internalKey, val []byte, err error) {
+	if internalKey, val, ok := v.memTable.Lookup(key, seq); ok {
+		return internalKey, val, nil
+	}
+	for _, imt := range v.immMemTables {
+		if internalKey, val, ok := imt.Lookup(key, seq); ok {
+			return internalKey, val, nil
+		}
+	}
+
+	seekKey := kv.MakeSeekKey(key, seq)
+	// the L0 tables are ordered from the newest
+	iterators := make([]iterator.Source, 0, len(v.l0SSTables))
+	for rank, t := range v.l0SSTables {
+		if !t.Overlaps(key, key) || !t.MayContain(v.filterPolicy, key) {
+			continue
+		}
+		iter, err := sstable.NewIterAndSeekToKey(t, seekKey)
+		if err != nil {
+			if errors.Is(err, block.ErrKeyNotFound) {
+				continue
+			}
+			return nil, nil, err
+		}
+		iterators = append(iterators, iterator.Source{Iter: iter, Rank: rank})
+	}
+
+	mergedIter := iterator.NewMergeIterator(iterators...)
+	if err := mergedIter.Error(); err != nil {
+		return nil, nil, err
+	}
+	if mergedIter.IsValid() && bytes.Equal(key, kv.UserKey(mergedIter.Key())) {
+		return mergedIter.Key(), mergedIter.Value(), nil
+	}
+
+	// the tables of a level do not overlap, so at most one can hold the key
+	for _, level := range v.levels {
+		idx := sstable.FindTable(level, key)
+		if idx == len(level) || !level[idx].Overlaps(key, key) {
+			continue
+		}
+		if !level[idx].MayContain(v.filterPolicy, key) {
+			continue
+		}
+		iter, err := sstable.NewIterAndSeekToKey(level[idx], seekKey)
+		if err != nil {
+			if errors.Is(err, block.ErrKeyNotFound) {
+				continue
+			}
+			return nil, nil, err
+		}
+		if iter.IsValid() && bytes.Equal(key, kv.UserKey(iter.Key())) {
+			return iter.Key(), iter.Value(), nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// scanWithOptions is scan over the keys selected by opts.
+func (v *view) scanWithOptions(opts ScanOptions, seq uint64) (iterator.Iterator, error) {
+	r, err := opts.keyRange()
+	if err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	iter, err := v.scan(r, seq)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Reverse {
+		iter.SeekToLast()
+	}
+	return iter, nil
+}
+
+// scan returns an iterator over the latest values, as of seq, of the keys in
+// r. The sstable iterators are bounded to r, so they read no block past it.
+func (v *view) scan(r kv.Range, seq uint64) (iterator.Iterator, error) {
+	// the sources are ranked from the newest: the memtable, the immutable
+	// memtables, the L0 tables and then the levels from the top
+	iters := make([]iterator.Source, 0, 1+len(v.immMemTables)+len(v.l0SSTables)+len(v.levels))
+	add := func(iter iterator.Iterator) {
+		iters = append(iters, iterator.Source{Iter: iter, Rank: len(iters)})
+	}
+	add(v.memTable.ScanRange(r))
+	for _, t := range v.immMemTables {
+		add(t.ScanRange(r))
+	}
+	for _, t := range v.l0SSTables {
+		if !t.OverlapsRange(r) {
+			continue
+		}
+		iter, err := sstable.NewRangeIter(t, r)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		add(iter)
+	}
+	for _, level := range v.levels {
+		iter, err := sstable.NewConcatRangeIter(level, r)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		add(iter)
+	}
+	tombstones := rangedel.Fragment(v.rangeDels(r), seq)
+	return iterator.NewUserIterator(iterator.NewMergeIterator(iters...), seq, tombstones, r), nil
+}
@@ -0,0 +1,150 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const headerSize = 8
+
+// ErrCorruption is matched by the errors of Recover for a log holding a
+// damaged record before its last one, which no crash in an append explains.
+var ErrCorruption = errors.New("wal corruption")
+
+// WAL is an append-only log of records. Every record is written to the file
+// before Append returns, so it survives a crash of the process; call Sync to
+// make it survive a crash of the machine as well.
+type WAL struct {
+	mu sync.Mutex
+	fd *os.File
+}
+
+// Create creates a new, empty log at path. It fails if the file exists.
+func Create(path string) (*WAL, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("wal create: %w", err)
+	}
+	return &WAL{fd: fd}, nil
+}
+
+// Recover replays every intact record of the log at path through fn and then
+// reopens the log for appending. A torn record at the tail, left behind by a
+// crash in the middle of an append, is truncated away. A damaged record
+// followed by more data fails with an error matching ErrCorruption instead,
+// as dropping the records after it would lose acknowledged writes.
+func Recover(path string, fn func(record []byte) error) (*WAL, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("wal recover: %w", err)
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("wal recover: %w", err)
+	}
+	valid, err := replay(fd, fi.Size(), fn)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("wal recover: %w", err)
+	}
+	if err := fd.Truncate(valid); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("wal recover: %w", err)
+	}
+	if _, err := fd.Seek(valid, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("wal recover: %w", err)
+	}
+	return &WAL{fd: fd}, nil
+}
+
+// replay returns the offset just past the last intact record of the size
+// bytes of r. Only the last record may be torn: short, or failing its
+// checksum.
+func replay(r io.Reader, size int64, fn func(record []byte) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var valid int64
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return valid, nil
+			}
+			return 0, err
+		}
+		checksum := binary.LittleEndian.Uint32(header[:4])
+		length := binary.LittleEndian.Uint32(header[4:])
+		// the checksum does not cover the length, so it is checked against
+		// the rest of the log before anything is allocated for the record;
+		// a record running past the end is torn
+		if int64(length) > size-valid-headerSize {
+			return valid, nil
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(br, record); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return valid, nil
+			}
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(record) != checksum {
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				return valid, nil
+			} else if err != nil {
+				return 0, err
+			}
+			return 0, fmt.Errorf("%w: checksum mismatch in record at offset %d", ErrCorruption, valid)
+		}
+		if err := fn(record); err != nil {
+			return 0, err
+		}
+		valid += headerSize + int64(length)
+	}
+}
+
+// +----------+--------+--------+
+// | checksum | length | record |
+// +----------+--------+--------+
+// |  uint32  | uint32 | bytes  |
+// +----------+--------+--------+
+func (w *WAL) Append(record []byte) error {
+	buf := make([]byte, headerSize+len(record))
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(record))
+	binary.LittleEndian.PutUint32(buf[4:headerSize], uint32(len(record)))
+	copy(buf[headerSize:], record)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.fd.Write(buf); err != nil {
+		return fmt.Errorf("wal append: %w", err)
+	}
+	return nil
+}
+
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.fd.Sync(); err != nil {
+		return fmt.Errorf("wal sync: %w", err)
+	}
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.fd.Sync(); err != nil {
+		return fmt.Errorf("wal close: %w", err)
+	}
+	if err := w.fd.Close(); err != nil {
+		return fmt.Errorf("wal close: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Recover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := Create(path)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, w.Append([]byte(strconv.Itoa(i))))
+	}
+	assert.NoError(t, w.Close())
+
+	got := make([]string, 0)
+	w, err = Recover(path, func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, got)
+}
+
+func TestWAL_RecoverTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append([]byte("intact")))
+	assert.NoError(t, w.Append([]byte("torn")))
+	assert.NoError(t, w.Close())
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, fi.Size()-1))
+
+	got := make([]string, 0)
+	w, err = Recover(path, func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"intact"}, got)
+
+	// appends continue right after the last intact record
+	assert.NoError(t, w.Append([]byte("after")))
+	assert.NoError(t, w.Close())
+	got = got[:0]
+	w, err = Recover(path, func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"intact", "after"}, got)
+}
+
+func TestWAL_RecoverCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := Create(path)
+	assert.NoError(t, err)
+	for _, record := range []string{"first", "second", "third"} {
+		assert.NoError(t, w.Append([]byte(record)))
+	}
+	assert.NoError(t, w.Close())
+
+	// a damaged record before the last one is not a torn tail
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte("X"), int64(headerSize+len("first")+headerSize))
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	_, err = Recover(path, func(record []byte) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCorruption)
+	after, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), after.Size(), "the log is not truncated")
+
+	// a damaged last record is
+	fd, err = os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Truncate(headerSize+int64(len("first"))+headerSize+int64(len("second"))))
+	assert.NoError(t, fd.Close())
+	got := make([]string, 0)
+	w, err = Recover(path, func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"first"}, got)
+}
+
+func TestWAL_RecoverDamagedLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := Create(path)
+	assert.NoError(t, err)
+	for _, record := range []string{"first", "second"} {
+		assert.NoError(t, w.Append([]byte(record)))
+	}
+	assert.NoError(t, w.Close())
+
+	// a length past the end of the log is a torn record, whatever its size
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(headerSize+len("first")+4))
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	got := make([]string, 0)
+	w, err = Recover(path, func(record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"first"}, got)
+}